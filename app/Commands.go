@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"marmot/core"
+	"marmot/onebot"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"run", "[flags]", "start the bot (default)", cmdRun},
+	{"init", "", "write the default config.yml and module configs", cmdInit},
+	{"config validate", "", "check config.yml and the configs of enabled modules", cmdConfigValidate},
+	{"modules list", "", "list every available module", cmdModulesList},
+	{"db migrate", "[module...]", "apply pending migrations", cmdDbMigrate},
+	{"db status", "[module...]", "show the migrations of every module", cmdDbStatus},
+	{"backup", "", "write a backup of the database and configs into bot/backups", cmdBackup},
+	{"send", "--group N | --user N [--timeout 30s] message", "wait for the adapter and send one message", cmdSend},
+}
+
+func usage() {
+	fmt.Println("usage: marmot <command> [arguments]")
+	fmt.Println()
+	for _, c := range commands {
+		fmt.Printf("  %-52s %s\n", strings.TrimSpace(c.name+" "+c.args), c.summary)
+	}
+}
+
+// runCommand finds the command named by the first one or two words of
+// args, no command at all runs the bot for compatibility
+func runCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cmdRun(args)
+	}
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != c.name {
+			continue
+		}
+		return c.run(args[len(words):])
+	}
+	if args[0] != "help" {
+		fmt.Printf("unknown command: %s\n\n", strings.Join(args, " "))
+	}
+	usage()
+	return 2
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("marmot "+name, flag.ContinueOnError)
+}
+
+func cmdRun(args []string) int {
+	opt := &runOptions{}
+	fs := newFlagSet("run")
+	opt.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	return runBot(opt)
+}
+
+func cmdInit(_ []string) int {
+	existed := core.IsSubDirFileExist("config.yml")
+	core.LoadConfig()
+	if existed {
+		fmt.Println("kept existing config.yml")
+	} else {
+		fmt.Println("wrote config.yml")
+	}
+
+	written, err := core.WriteDefaultModuleConfigs()
+	for _, file := range written {
+		fmt.Printf("wrote %s\n", file)
+	}
+	if err != nil {
+		fmt.Printf("failed to write module configs: %v\n", err)
+		return 1
+	}
+	fmt.Printf("configs are in %s\n", core.GetDataDir())
+	return 0
+}
+
+func cmdConfigValidate(_ []string) int {
+	if !core.IsSubDirFileExist("config.yml") {
+		fmt.Println("config.yml not found, run `marmot init` first")
+		return 1
+	}
+	core.LoadConfig()
+	errs := core.ValidateConfigs()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("config is valid")
+	return 0
+}
+
+func cmdModulesList(_ []string) int {
+	core.LoadConfig()
+	enabled := make(map[string]bool)
+	for _, name := range core.AppConfig.Modules {
+		enabled[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	fmt.Printf("%-12s %-8s %s\n", "MODULE", "ENABLED", "DESCRIPTION")
+	for _, name := range core.RegisteredModules() {
+		state := "no"
+		if enabled[name] {
+			state = "yes"
+		}
+		fmt.Printf("%-12s %-8s %s\n", name, state, core.ModuleDescription(name))
+	}
+	return 0
+}
+
+// dbModules returns the modules named in args or every module with migrations
+func dbModules(args []string) []string {
+	if len(args) > 0 {
+		return args
+	}
+	return core.MigrationModules()
+}
+
+func cmdDbMigrate(args []string) int {
+	core.InitCommon()
+	defer core.Common.Database.Close()
+
+	code := 0
+	for _, module := range dbModules(args) {
+		if err := core.Common.Database.Migrate(module); err != nil {
+			fmt.Printf("%s: %v\n", module, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: up to date\n", module)
+	}
+	return code
+}
+
+func cmdDbStatus(args []string) int {
+	core.InitCommon()
+	defer core.Common.Database.Close()
+
+	fmt.Printf("%-12s %-8s %-32s %s\n", "MODULE", "VERSION", "NAME", "APPLIED")
+	code := 0
+	for _, module := range dbModules(args) {
+		items, err := core.Common.Database.MigrationStatus(module)
+		if err != nil {
+			fmt.Printf("%s: %v\n", module, err)
+			code = 1
+			continue
+		}
+		for _, item := range items {
+			applied := "pending"
+			if item.Applied {
+				applied = time.Unix(item.AppliedAt, 0).Format(time.DateTime)
+			}
+			fmt.Printf("%-12s %-8d %-32s %s\n", item.Module, item.Version, item.Name, applied)
+		}
+	}
+	return code
+}
+
+func cmdBackup(_ []string) int {
+	core.InitCommon()
+	defer core.Common.Database.Close()
+
+	path, err := core.CreateBackup()
+	if err != nil {
+		fmt.Printf("backup failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("backup written to %s\n", path)
+	return 0
+}
+
+// cmdSend connects like the bot does (ws_url or satori), waits for the
+// adapter and sends a single message
+func cmdSend(args []string) int {
+	fs := newFlagSet("send")
+	group := fs.Int64("group", 0, "group to send the message to")
+	user := fs.Int64("user", 0, "user to send a private message to")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the adapter")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	msg := strings.Join(fs.Args(), " ")
+	if msg == "" || (*group == 0) == (*user == 0) {
+		fmt.Println("usage: marmot send --group N | --user N message")
+		return 2
+	}
+
+	core.InitCommon()
+	defer core.Common.Database.Close()
+	onebot.SetLogger(core.NewZBLogger())
+	onebot.SetIDStore(core.NewIDStore())
+
+	connected := make(chan int64, 1)
+	driver, closeDriver := newDriver(&runOptions{}, func(id int64) {
+		select {
+		case connected <- id:
+		default:
+		}
+	})
+	go func() { // satori dials until it is connected, the timeout below still applies
+		driver.Connect()
+		driver.Listen(func([]byte, onebot.APICaller) {})
+	}()
+	defer closeDriver()
+
+	endpoint := core.AppConfig.WsUrl
+	if core.AppConfig.Satori.URL != "" {
+		endpoint = core.AppConfig.Satori.URL
+	}
+	fmt.Printf("waiting for the adapter at %s\n", endpoint)
+	var selfID int64
+	select {
+	case selfID = <-connected:
+	case <-time.After(*timeout):
+		fmt.Printf("no adapter connected within %s\n", *timeout)
+		return 1
+	}
+
+	ctx := onebot.GetBot(selfID)
+	var id int64
+	if *group != 0 {
+		id = ctx.SendGroupMessage(*group, msg)
+	} else {
+		id = ctx.SendPrivateMessage(*user, msg)
+	}
+	if id == 0 {
+		fmt.Println("the adapter failed to send the message")
+		return 1
+	}
+	fmt.Printf("sent message %d as %d\n", id, selfID)
+	return 0
+}
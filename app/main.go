@@ -1,39 +1,160 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"github.com/goccy/go-json"
 	"marmot/core"
 	_ "marmot/modules"
 	"marmot/onebot"
 	zero "marmot/onebot"
+	"marmot/simulator"
 	"os"
+	"sort"
 )
 
+// runOptions are the flags of the run command
+type runOptions struct {
+	console      bool
+	consoleAddr  string
+	consoleSelf  int64
+	consoleUser  int64
+	consoleGroup int64
+	consoleRole  string
+	replay       string
+	replaySpeed  float64
+}
+
+func (o *runOptions) bind(fs *flag.FlagSet) {
+	fs.BoolVar(&o.console, "console", false, "read messages from stdin instead of connecting to an OneBot adapter")
+	fs.StringVar(&o.consoleAddr, "console-addr", "", "serve the console as a tcp REPL at this address, e.g. 127.0.0.1:9000")
+	fs.Int64Var(&o.consoleSelf, "console-self", 10000, "QQ account of the bot in console mode")
+	fs.Int64Var(&o.consoleUser, "console-user", 10001, "sender of console messages")
+	fs.Int64Var(&o.consoleGroup, "console-group", 20000, "group of console messages, 0 for private messages")
+	fs.StringVar(&o.consoleRole, "console-role", "member", "role of the sender: member, admin or owner")
+	fs.StringVar(&o.replay, "replay", "", "replay a recording from bot/records against a simulated adapter and exit")
+	fs.Float64Var(&o.replaySpeed, "replay-speed", 0, "replay pace, 1 is the original speed, 0 replays without delays")
+}
+
+func newDriver(opt *runOptions, onConnect func(id int64)) (zero.Driver, func()) {
+	if opt.console {
+		driver := onebot.NewConsoleDriver(opt.consoleSelf, opt.consoleUser, opt.consoleGroup, opt.consoleRole)
+		driver.ListenAddr = opt.consoleAddr
+		core.Common.BotQQ = opt.consoleSelf
+		return driver, func() {}
+	}
+
+	hook := func(id int64) {
+		core.Common.BotQQ = id
+		core.LogInfo("Bot id : %v", id)
+		if onConnect != nil {
+			onConnect(id)
+		}
+	}
+	if satori := core.AppConfig.Satori; satori.URL != "" {
+		driver := onebot.NewSatoriDriver(satori.URL, satori.Token, satori.Platform, hook)
+		return driver, driver.Close
+	}
+	driver := onebot.NewWebSocketServer(16, core.AppConfig.WsUrl, "", hook)
+	return driver, driver.Close
+}
+
+// runReplay boots the modules of bot/config.yml in a simulator and feeds the
+// recording through them, printing every api call they make
+func runReplay(path string, speed float64) int {
+	records, err := core.ReadRecording(path)
+	if err != nil {
+		fmt.Printf("failed to read recording %s: %v\n", path, err)
+		return 1
+	}
+	sim, err := simulator.New(simulator.Options{
+		Seed:   core.GetDataDir(),
+		SelfID: simulator.FirstSelfID(records),
+	})
+	if err != nil {
+		fmt.Printf("failed to start simulator: %v\n", err)
+		return 1
+	}
+	onebot.SetLogger(core.NewZBLogger())
+	sim.Caller.OnCall = func(call simulator.Call) {
+		params, _ := json.Marshal(call.Request.Params)
+		fmt.Printf("<< %s %s\n", call.Request.Action, params)
+	}
+
+	result := sim.Replay(records, speed)
+	sim.Close()
+
+	fmt.Printf("replayed %d events, %d timed out\n", result.Events, result.Failed)
+	actions := make(map[string]bool)
+	for action := range result.Recorded {
+		actions[action] = true
+	}
+	for action := range result.Replayed {
+		actions[action] = true
+	}
+	names := make([]string, 0, len(actions))
+	for action := range actions {
+		names = append(names, action)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-32s %10s %10s\n", "action", "recorded", "replayed")
+	for _, action := range names {
+		fmt.Printf("%-32s %10d %10d\n", action, result.Recorded[action], result.Replayed[action])
+	}
+	return 0
+}
+
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runBot starts the bot and blocks until it is shut down by a signal
+func runBot(opt *runOptions) int {
+	if opt.replay != "" {
+		return runReplay(opt.replay, opt.replaySpeed)
+	}
+
 	// init basic services
 	core.InitCommon()
 	onebot.SetLogger(core.NewZBLogger())
+	onebot.SetDebug(core.AppConfig.Log.ProtocolDebug)
+	onebot.SetObserver(core.NewMetricsObserver())
+	if recorder := core.NewRecorder(); recorder != nil {
+		onebot.SetRecorder(recorder)
+	}
+	onebot.SetIDStore(core.NewIDStore())
 
 	// init module manager
 	mMgr := core.NewModuleMgr()
 	if mMgr == nil {
 		core.LogError("Failed to init moduleMgr")
-		os.Exit(1)
+		return 1
 	}
 	//zero.OnMessage().Handle()
 	mMgr.LoadAll()
 
-	// reg shutdown hook to cleanup & save data
+	driver, closeDriver := newDriver(opt, nil)
+
+	// reg shutdown hook to cleanup & save data, hooks run after in-flight handlers are drained
 	core.RegisterShutdownHook(func() {
 		mMgr.UnloadAll()
 	})
+	core.RegisterShutdownHook(closeDriver)
 	core.StartHookWatch()
+	core.StartBackupWatch()
+	core.StartAdminServer()
 
 	// run bot engine's loop
 	zero.RunAndBlock(&zero.Config{
-		NickName: []string{"bot"},
-		Driver: onebot.NewWebSocketServer(16, core.AppConfig.WsUrl, "", func(id int64) {
-			core.Common.BotQQ = id
-			core.LogInfo("Bot id : %v", id)
-		}),
+		NickName:       []string{"bot"},
+		RingLen:        core.AppConfig.RingLen,
+		RingPolicy:     core.AppConfig.RingPolicy,
+		Latency:        core.EventLatency(),
+		MaxProcessTime: core.MaxProcessTime(),
+		DedupWindow:    core.EventDedupWindow(),
+		Sequential:     core.AppConfig.SequentialDispatch,
+		SequenceLen:    core.AppConfig.SequenceLen,
+		Driver:         driver,
 	}, mMgr.HandleEvent)
+	return 0
 }
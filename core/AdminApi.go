@@ -0,0 +1,430 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	"io"
+	zero "marmot/onebot"
+	"marmot/onebot/message"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ApiPrefix is prepended to every path registered by RegisterApi
+const ApiPrefix = "/api/v1"
+
+// NoBody is used as request or response type of apis without a json body
+type NoBody struct{}
+
+// ApiError carries the http status code returned to the client
+type ApiError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ApiError) Error() string {
+	return e.Msg
+}
+
+func NewApiError(code int, format string, args ...interface{}) error {
+	return &ApiError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+type apiRoute struct {
+	method   string
+	path     string
+	summary  string
+	request  reflect.Type
+	response reflect.Type
+}
+
+var (
+	apiRoutes   []apiRoute
+	apiRoutesMu sync.Mutex
+)
+
+// RegisterApi mounts a token protected json api at ApiPrefix+path, the
+// request body is decoded into Req and the result is encoded as json. Both
+// types are described in the generated openapi document
+func RegisterApi[Req any, Rsp any](method string, path string, summary string, fn func(r *http.Request, req *Req) (Rsp, error)) {
+	apiRoutesMu.Lock()
+	apiRoutes = append(apiRoutes, apiRoute{
+		method:   method,
+		path:     path,
+		summary:  summary,
+		request:  reflect.TypeOf((*Req)(nil)).Elem(),
+		response: reflect.TypeOf((*Rsp)(nil)).Elem(),
+	})
+	apiRoutesMu.Unlock()
+
+	hasBody := reflect.TypeOf((*Req)(nil)).Elem() != reflect.TypeOf(NoBody{})
+	RegisterHttpFunc(method+" "+ApiPrefix+path, RequireToken(func(w http.ResponseWriter, r *http.Request) {
+		req := new(Req)
+		if hasBody {
+			data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err == nil {
+				err = json.Unmarshal(data, req)
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+				return
+			}
+		}
+		rsp, err := fn(r, req)
+		if err != nil {
+			var apiErr *ApiError
+			if errors.As(err, &apiErr) {
+				writeError(w, apiErr.Code, apiErr)
+			} else {
+				writeError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		writeJson(w, http.StatusOK, rsp)
+	}))
+}
+
+// PathInt parses the path value name as int64
+func PathInt(r *http.Request, name string) (int64, error) {
+	v, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		return 0, NewApiError(http.StatusBadRequest, "invalid %s: %s", name, r.PathValue(name))
+	}
+	return v, nil
+}
+
+type SendMessageReq struct {
+	SelfID  int64  `json:"self_id"`  // account sending the message, first connected one when 0
+	GroupID int64  `json:"group_id"` // send to group when not 0
+	UserID  int64  `json:"user_id"`  // send privately when group_id is 0
+	Message string `json:"message"`  // message text, CQ codes are supported
+}
+
+type SendMessageRsp struct {
+	MessageID int64 `json:"message_id"`
+}
+
+type GroupMember struct {
+	UserID   int64  `json:"user_id"`
+	Nickname string `json:"nickname"`
+	Card     string `json:"card"`
+	Role     string `json:"role"`
+}
+
+type InvokeCommandReq struct {
+	SelfID   int64  `json:"self_id"`
+	GroupID  int64  `json:"group_id"`
+	UserID   int64  `json:"user_id"`
+	Nickname string `json:"nickname"`
+	Role     string `json:"role"`    // member/admin/owner
+	Command  string `json:"command"` // full text, e.g. ".status"
+	Forward  bool   `json:"forward"` // also send replies through the real connection
+}
+
+type ApiCallRecord struct {
+	Action string         `json:"action"`
+	Params map[string]any `json:"params"`
+}
+
+type InvokeCommandRsp struct {
+	Calls []ApiCallRecord `json:"calls"`
+}
+
+// recordingCaller records api calls made by a command and optionally
+// forwards them to a real connection
+type recordingCaller struct {
+	mu      sync.Mutex
+	forward zero.APICaller
+	calls   []ApiCallRecord
+}
+
+func (c *recordingCaller) CallAPI(req zero.APIRequest) (zero.APIResponse, error) {
+	c.mu.Lock()
+	c.calls = append(c.calls, ApiCallRecord{Action: req.Action, Params: req.Params})
+	c.mu.Unlock()
+	if c.forward != nil {
+		return c.forward.CallAPI(req)
+	}
+	return zero.APIResponse{Status: "ok", Data: gjson.Parse(`{"message_id":0}`)}, nil
+}
+
+// findCaller returns the connection of selfID, or the first connected one when selfID is 0
+func findCaller(selfID int64) (int64, zero.APICaller, error) {
+	if selfID == 0 {
+		accounts := ConnectedAccounts()
+		if len(accounts) == 0 {
+			return 0, nil, NewApiError(http.StatusServiceUnavailable, "no onebot connection")
+		}
+		selfID = accounts[0]
+	}
+	caller, ok := zero.APICallers.Load(selfID)
+	if !ok {
+		return 0, nil, NewApiError(http.StatusNotFound, "account %d is not connected", selfID)
+	}
+	return selfID, caller, nil
+}
+
+func apiSendMessage(_ *http.Request, req *SendMessageReq) (SendMessageRsp, error) {
+	if req.Message == "" || (req.GroupID == 0 && req.UserID == 0) {
+		return SendMessageRsp{}, NewApiError(http.StatusBadRequest, "message and group_id or user_id are required")
+	}
+	_, caller, err := findCaller(req.SelfID)
+	if err != nil {
+		return SendMessageRsp{}, err
+	}
+	ctx := zero.NewCtx(&zero.Event{}, caller)
+	msg := message.ParseMessageFromString(req.Message)
+	if req.GroupID != 0 {
+		return SendMessageRsp{MessageID: ctx.SendGroupMessage(req.GroupID, msg)}, nil
+	}
+	return SendMessageRsp{MessageID: ctx.SendPrivateMessage(req.UserID, msg)}, nil
+}
+
+func apiAccounts(_ *http.Request, _ *NoBody) ([]int64, error) {
+	return ConnectedAccounts(), nil
+}
+
+func apiGroups(r *http.Request, _ *NoBody) ([]consoleGroup, error) {
+	selfID, err := PathInt(r, "self_id")
+	if err != nil {
+		return nil, err
+	}
+	_, caller, err := findCaller(selfID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]consoleGroup, 0)
+	for _, g := range zero.NewCtx(&zero.Event{}, caller).GetGroupList().Array() {
+		result = append(result, consoleGroup{
+			GroupID:     g.Get("group_id").Int(),
+			GroupName:   g.Get("group_name").String(),
+			MemberCount: g.Get("member_count").Int(),
+		})
+	}
+	return result, nil
+}
+
+func apiMembers(r *http.Request, _ *NoBody) ([]GroupMember, error) {
+	selfID, err := PathInt(r, "self_id")
+	if err != nil {
+		return nil, err
+	}
+	groupID, err := PathInt(r, "group_id")
+	if err != nil {
+		return nil, err
+	}
+	_, caller, err := findCaller(selfID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]GroupMember, 0)
+	for _, m := range zero.NewCtx(&zero.Event{}, caller).GetGroupMemberList(groupID).Array() {
+		result = append(result, GroupMember{
+			UserID:   m.Get("user_id").Int(),
+			Nickname: m.Get("nickname").String(),
+			Card:     m.Get("card").String(),
+			Role:     m.Get("role").String(),
+		})
+	}
+	return result, nil
+}
+
+func apiInvokeCommand(_ *http.Request, req *InvokeCommandReq) (InvokeCommandRsp, error) {
+	mgr := GetModuleMgr()
+	if mgr == nil {
+		return InvokeCommandRsp{}, NewApiError(http.StatusServiceUnavailable, "module manager is not ready")
+	}
+	if req.UserID == 0 || req.Command == "" {
+		return InvokeCommandRsp{}, NewApiError(http.StatusBadRequest, "user_id and command are required")
+	}
+	label, _ := parseInputCmd(req.Command, AppConfig.CmdPrefix)
+	cmd := mgr.commands()
+	if cmd == nil || !cmd.Has(label) {
+		return InvokeCommandRsp{}, NewApiError(http.StatusNotFound, "command %s not found", label)
+	}
+
+	caller := &recordingCaller{}
+	selfID := req.SelfID
+	if req.Forward {
+		id, real, err := findCaller(req.SelfID)
+		if err != nil {
+			return InvokeCommandRsp{}, err
+		}
+		selfID, caller.forward = id, real
+	}
+	if req.Role == "" {
+		req.Role = "member"
+	}
+
+	event := &zero.Event{
+		PostType:    "message",
+		DetailType:  "group",
+		MessageType: "group",
+		SubType:     "normal",
+		MessageID:   int64(0),
+		SelfID:      selfID,
+		GroupID:     req.GroupID,
+		UserID:      req.UserID,
+		RawMessage:  req.Command,
+		Message:     message.Message{message.Text(req.Command)},
+		Sender:      &zero.User{ID: req.UserID, NickName: req.Nickname, Role: req.Role},
+	}
+	if req.GroupID == 0 {
+		event.DetailType, event.MessageType = "private", "private"
+	}
+	if !BeginTask() {
+		return InvokeCommandRsp{}, NewApiError(http.StatusServiceUnavailable, "bot is shutting down")
+	}
+	defer EndTask()
+	cmd.invokeCmd(zero.NewCtx(event, caller))
+	LogInfo("[Admin] command %s invoked through api as %d", label, req.UserID)
+
+	caller.mu.Lock()
+	defer caller.mu.Unlock()
+	return InvokeCommandRsp{Calls: append([]ApiCallRecord{}, caller.calls...)}, nil
+}
+
+var pathParamRegex = regexp.MustCompile(`\{([a-zA-Z_]+)}`)
+
+// schemaOf describes t as an openapi schema object
+func schemaOf(t reflect.Type, depth int) map[string]any {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if depth > 8 {
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), depth+1)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), depth+1)}
+	case reflect.Struct:
+		props := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				// embedded struct, promote its fields
+				for k, v := range schemaOf(f.Type, depth+1)["properties"].(map[string]any) {
+					props[k] = v
+				}
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if tag, ok := f.Tag.Lookup("json"); ok {
+				tag, _, _ = strings.Cut(tag, ",")
+				if tag == "-" {
+					continue
+				}
+				if tag != "" {
+					name = tag
+				}
+			}
+			props[name] = schemaOf(f.Type, depth+1)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	default:
+		return map[string]any{}
+	}
+}
+
+// OpenApiDocument describes every api registered by RegisterApi
+func OpenApiDocument() map[string]any {
+	apiRoutesMu.Lock()
+	routes := append([]apiRoute{}, apiRoutes...)
+	apiRoutesMu.Unlock()
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].path < routes[j].path
+	})
+
+	errorSchema := map[string]any{"$ref": "#/components/schemas/Error"}
+	paths := make(map[string]map[string]any)
+	for _, route := range routes {
+		path := ApiPrefix + route.path
+		params := make([]any, 0)
+		for _, m := range pathParamRegex.FindAllStringSubmatch(route.path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		op := map[string]any{
+			"summary":     route.summary,
+			"operationId": strings.ToLower(route.method) + strings.NewReplacer("/", "_", "{", "", "}", "").Replace(route.path),
+			"parameters":  params,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content":     map[string]any{"application/json": map[string]any{"schema": schemaOf(route.response, 0)}},
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+				},
+			},
+		}
+		if route.request != reflect.TypeOf(NoBody{}) {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemaOf(route.request, 0)}},
+			}
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(route.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "Marmot admin api", "version": Version},
+		"paths":   paths,
+		"security": []any{
+			map[string]any{"bearer": []any{}},
+		},
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": map[string]any{
+				"Error": map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"error": map[string]any{"type": "string"}},
+				},
+			},
+		},
+	}
+}
+
+func init() {
+	RegisterApi("POST", "/messages", "Send a message to a group or user", apiSendMessage)
+	RegisterApi("GET", "/accounts", "List connected accounts", apiAccounts)
+	RegisterApi("GET", "/accounts/{self_id}/groups", "List groups of an account", apiGroups)
+	RegisterApi("GET", "/accounts/{self_id}/groups/{group_id}/members", "List members of a group", apiMembers)
+	RegisterApi("POST", "/commands", "Invoke a registered command as the given user", apiInvokeCommand)
+	RegisterHttpFunc("GET "+ApiPrefix+"/openapi.json", RequireToken(func(w http.ResponseWriter, _ *http.Request) {
+		writeJson(w, http.StatusOK, OpenApiDocument())
+	}))
+}
@@ -0,0 +1,253 @@
+package core
+
+import (
+	"embed"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"io/fs"
+	zero "marmot/onebot"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed web
+var consoleFiles embed.FS
+
+// AdminView provides read only data shown in the "browse" page of the
+// admin console, such as templates, filter rules or scheduled tasks
+type AdminView func() (any, error)
+
+var (
+	adminViews   = make(map[string]AdminView)
+	adminViewsMu sync.RWMutex
+)
+
+// RegisterAdminView adds a named view to the admin console
+func RegisterAdminView(name string, view AdminView) {
+	adminViewsMu.Lock()
+	adminViews[strings.ToLower(strings.TrimSpace(name))] = view
+	adminViewsMu.Unlock()
+}
+
+type consoleModule struct {
+	Name      string `json:"name"`
+	Enabled   bool   `json:"enabled"`
+	Loaded    bool   `json:"loaded"`
+	HasConfig bool   `json:"has_config"`
+}
+
+type consoleGroup struct {
+	GroupID     int64  `json:"group_id"`
+	GroupName   string `json:"group_name"`
+	MemberCount int64  `json:"member_count"`
+}
+
+type consoleAccount struct {
+	SelfID int64          `json:"self_id"`
+	Groups []consoleGroup `json:"groups"`
+}
+
+func registerConsole() {
+	static, _ := fs.Sub(consoleFiles, "web")
+	RegisterHttpHandler("GET /admin/", http.StripPrefix("/admin/", http.FileServerFS(static)))
+
+	RegisterHttpFunc("GET /admin/api/status", RequireToken(statusHandler))
+	RegisterHttpFunc("GET /admin/api/accounts", RequireToken(consoleAccounts))
+	RegisterHttpFunc("GET /admin/api/modules", RequireToken(consoleModules))
+	RegisterHttpFunc("POST /admin/api/modules/{name}/enable", RequireToken(consoleEnableModule))
+	RegisterHttpFunc("POST /admin/api/modules/{name}/disable", RequireToken(consoleDisableModule))
+	RegisterHttpFunc("POST /admin/api/reload", RequireToken(consoleReload))
+	RegisterHttpFunc("GET /admin/api/modules/{name}/config", RequireToken(consoleReadConfig))
+	RegisterHttpFunc("PUT /admin/api/modules/{name}/config", RequireToken(consoleWriteConfig))
+	RegisterHttpFunc("GET /admin/api/views", RequireToken(consoleViews))
+	RegisterHttpFunc("GET /admin/api/views/{name}", RequireToken(consoleView))
+	RegisterHttpFunc("GET /admin/api/logs", RequireToken(consoleLogs))
+	RegisterHttpFunc("GET /admin/api/logs/stream", RequireToken(consoleLogStream))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, map[string]string{"error": err.Error()})
+}
+
+func consoleAccounts(w http.ResponseWriter, _ *http.Request) {
+	result := make([]consoleAccount, 0, 1)
+	for _, id := range ConnectedAccounts() {
+		account := consoleAccount{SelfID: id, Groups: make([]consoleGroup, 0)}
+		if ctx := zero.GetBot(id); ctx != nil {
+			for _, g := range ctx.GetGroupList().Array() {
+				account.Groups = append(account.Groups, consoleGroup{
+					GroupID:     g.Get("group_id").Int(),
+					GroupName:   g.Get("group_name").String(),
+					MemberCount: g.Get("member_count").Int(),
+				})
+			}
+		}
+		result = append(result, account)
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+func consoleModules(w http.ResponseWriter, _ *http.Request) {
+	enabled := make(map[string]bool)
+	for _, name := range AppConfig.Modules {
+		enabled[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	loaded := make(map[string]bool)
+	if mgr := GetModuleMgr(); mgr != nil {
+		for _, name := range mgr.ListAll() {
+			loaded[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+
+	result := make([]consoleModule, 0, len(registry))
+	for _, name := range RegisteredModules() {
+		result = append(result, consoleModule{
+			Name:      name,
+			Enabled:   enabled[name],
+			Loaded:    loaded[name],
+			HasConfig: HasModuleConfig(name),
+		})
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+func setModuleEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	mgr := GetModuleMgr()
+	if mgr == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("module manager is not ready"))
+		return
+	}
+	if err := mgr.SetModuleEnabled(r.PathValue("name"), enabled); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	consoleModules(w, r)
+}
+
+func consoleEnableModule(w http.ResponseWriter, r *http.Request) {
+	setModuleEnabled(w, r, true)
+}
+
+func consoleDisableModule(w http.ResponseWriter, r *http.Request) {
+	setModuleEnabled(w, r, false)
+}
+
+func consoleReload(w http.ResponseWriter, r *http.Request) {
+	mgr := GetModuleMgr()
+	if mgr == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("module manager is not ready"))
+		return
+	}
+	mgr.Reload()
+	LogInfo("[Admin] modules reloaded from admin console")
+	consoleModules(w, r)
+}
+
+func consoleReadConfig(w http.ResponseWriter, r *http.Request) {
+	file, content, err := ReadModuleConfig(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"file": file, "content": content})
+}
+
+func consoleWriteConfig(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Content string `json:"content"`
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name := r.PathValue("name")
+	if !HasModuleConfig(name) {
+		writeError(w, http.StatusNotFound, ErrNoModuleConfig)
+		return
+	}
+	if err := ValidateModuleConfig(name, body.Content); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	mgr := GetModuleMgr()
+	if mgr == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("module manager is not ready"))
+		return
+	}
+	if err := mgr.UpdateModuleConfig(name, body.Content); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	LogInfo("[Admin] config of module %s updated from admin console", name)
+	writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func consoleViews(w http.ResponseWriter, _ *http.Request) {
+	adminViewsMu.RLock()
+	names := make([]string, 0, len(adminViews))
+	for name := range adminViews {
+		names = append(names, name)
+	}
+	adminViewsMu.RUnlock()
+	sort.Strings(names)
+	writeJson(w, http.StatusOK, names)
+}
+
+func consoleView(w http.ResponseWriter, r *http.Request) {
+	adminViewsMu.RLock()
+	view, ok := adminViews[strings.ToLower(r.PathValue("name"))]
+	adminViewsMu.RUnlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("view %s not found", r.PathValue("name")))
+		return
+	}
+	data, err := view()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, data)
+}
+
+func consoleLogs(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	writeJson(w, http.StatusOK, webLogs.Recent(n))
+}
+
+// consoleLogStream pushes new log lines with server-sent events
+func consoleLogStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := webLogs.Subscribe()
+	defer webLogs.Unsubscribe(ch)
+	for {
+		select {
+		case line := <-ch:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var adminMux = http.NewServeMux()
+
+// RegisterHttpHandler mounts handler on the admin http server, should be
+// called before StartAdminServer
+func RegisterHttpHandler(pattern string, handler http.Handler) {
+	adminMux.Handle(pattern, handler)
+}
+
+func RegisterHttpFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	adminMux.HandleFunc(pattern, handler)
+}
+
+// RequireToken rejects requests without `admin_token`, passed either by
+// `Authorization: Bearer <token>` or the `token` query (for EventSource)
+func RequireToken(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AppConfig.AdminToken == "" {
+			writeJson(w, http.StatusForbidden, map[string]string{"error": "admin_token is not configured"})
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(AppConfig.AdminToken)) != 1 {
+			writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// StartAdminServer serves the admin endpoints on `admin_listen`, nothing
+// happens when the address is empty
+func StartAdminServer() {
+	if AppConfig.AdminListen == "" {
+		return
+	}
+	RegisterHttpFunc("/healthz", healthzHandler)
+	RegisterHttpFunc("/readyz", readyzHandler)
+	RegisterHttpFunc("/status", RequireToken(statusHandler))
+	if AppConfig.Metrics {
+		RegisterHttpHandler("/metrics", Metrics)
+	}
+	registerConsole()
+	if AppConfig.AdminToken == "" {
+		LogWarn("[Admin] admin_token is empty, admin console is disabled")
+	}
+
+	srv := &http.Server{
+		Addr:              AppConfig.AdminListen,
+		Handler:           adminMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogError("[Admin] admin http server stopped: %v", err)
+		}
+	}()
+	RegisterShutdownHook(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			LogWarn("[Admin] failed to stop admin http server: %v", err)
+		}
+	})
+	LogInfo("[Admin] admin http server listening on %s", AppConfig.AdminListen)
+}
@@ -0,0 +1,322 @@
+package core
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupDirName  = "backups"
+	backupDbName   = "marmot_data.db"
+	backupPrefix   = "backup_"
+	exportPrefix   = "export_"
+	backupTimeTmpl = "2006_01_02_15_04_05"
+)
+
+var (
+	dataModels   = make(map[string][]interface{})
+	dataModelsMu sync.Mutex
+	backupMu     sync.Mutex
+)
+
+// RegisterDataModels declares the gorm models owned by module,
+// they are used to export/import the module's data as json
+func RegisterDataModels(module string, models ...interface{}) {
+	module = strings.ToLower(strings.TrimSpace(module))
+	dataModelsMu.Lock()
+	defer dataModelsMu.Unlock()
+	dataModels[module] = append(dataModels[module], models...)
+}
+
+func getDataModels(module string) []interface{} {
+	dataModelsMu.Lock()
+	defer dataModelsMu.Unlock()
+	return dataModels[module]
+}
+
+// ModuleExport is the json layout of an exported module
+type ModuleExport struct {
+	Module     string                     `json:"module"`
+	ExportedAt int64                      `json:"exported_at"`
+	Tables     map[string]json.RawMessage `json:"tables"`
+	Kv         []KvItem                   `json:"kv"`
+}
+
+func getBackupDir() (string, error) {
+	r, ok := GetSubDir(backupDirName)
+	if !ok {
+		return "", errors.New("failed to create backup directory")
+	}
+	return r, nil
+}
+
+// CreateBackup snapshots the database and every file under bot/ (except logs and backups)
+// into a zip archive, returns the path of the archive
+func CreateBackup() (string, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	dir, err := getBackupDir()
+	if err != nil {
+		return "", err
+	}
+	stamp := time.Now().Format(backupTimeTmpl)
+	snapshot := filepath.Join(dir, "snapshot_"+stamp+".db")
+	defer os.Remove(snapshot)
+
+	// VACUUM INTO makes a consistent copy while the bot is running
+	if err := Common.Database.Db.Exec("VACUUM INTO ?", snapshot).Error; err != nil {
+		return "", fmt.Errorf("snapshot database failed: %w", err)
+	}
+
+	path := filepath.Join(dir, backupPrefix+stamp+".zip")
+	if err := writeBackupArchive(path, snapshot); err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+
+	if err := rotateBackups(dir, AppConfig.BackupKeep); err != nil {
+		LogWarn("[Backup] failed to rotate old backups: %v", err)
+	}
+	LogInfo("[Backup] created backup %s", path)
+	return path, nil
+}
+
+func writeBackupArchive(path string, snapshot string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	if err := addZipFile(zw, snapshot, backupDbName); err != nil {
+		return err
+	}
+
+	root := GetDataDir()
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == "logs" || rel == backupDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// the live database is already included as snapshot
+		if strings.HasPrefix(rel, backupDbName) {
+			return nil
+		}
+		return addZipFile(zw, path, filepath.ToSlash(rel))
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, path string, name string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, in)
+	return err
+}
+
+// ListBackups returns backup archives sorted from oldest to newest
+func ListBackups() ([]string, error) {
+	dir, err := getBackupDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupPrefix) && strings.HasSuffix(e.Name(), ".zip") {
+			result = append(result, e.Name())
+		}
+	}
+	// names contain the timestamp, lexical order is chronological
+	sort.Strings(result)
+	return result, nil
+}
+
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	items, err := ListBackups()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(items)-keep; i++ {
+		if err := os.Remove(filepath.Join(dir, items[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartBackupWatch creates backups periodically according to AppConfig.BackupInterval
+func StartBackupWatch() {
+	if AppConfig.BackupInterval == "" {
+		return
+	}
+	dur, err := time.ParseDuration(AppConfig.BackupInterval)
+	if err != nil || dur <= 0 {
+		LogWarn("[Backup] invalid backup interval %s, scheduled backup disabled", AppConfig.BackupInterval)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(dur)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := CreateBackup(); err != nil {
+					LogError("[Backup] scheduled backup failed: %v", err)
+				}
+			case <-Context().Done():
+				return
+			}
+		}
+	}()
+	LogInfo("[Backup] scheduled backup every %s", dur)
+}
+
+// ExportModule dumps every registered model and kv entry of module into a json file
+func ExportModule(module string) (string, error) {
+	module = strings.ToLower(strings.TrimSpace(module))
+	models := getDataModels(module)
+
+	result := ModuleExport{
+		Module:     module,
+		ExportedAt: time.Now().Unix(),
+		Tables:     make(map[string]json.RawMessage, len(models)),
+	}
+	for _, model := range models {
+		name, err := tableNameOf(model)
+		if err != nil {
+			return "", err
+		}
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+		if err := Common.Database.Db.Model(model).Find(rows.Interface()).Error; err != nil {
+			return "", fmt.Errorf("export table %s failed: %w", name, err)
+		}
+		data, err := json.Marshal(rows.Interface())
+		if err != nil {
+			return "", err
+		}
+		result.Tables[name] = data
+	}
+	if err := Common.Database.Db.Where("namespace = ?", module).Find(&result.Kv).Error; err != nil {
+		return "", fmt.Errorf("export kv failed: %w", err)
+	}
+	if len(models) == 0 && len(result.Kv) == 0 {
+		return "", fmt.Errorf("module %s has no exportable data", module)
+	}
+
+	dir, err := getBackupDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, exportPrefix+module+"_"+time.Now().Format(backupTimeTmpl)+".json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	LogInfo("[Backup] exported module %s to %s", module, path)
+	return path, nil
+}
+
+// ImportModule upserts the rows of an exported json file (looked up in the backup directory)
+func ImportModule(module string, file string) error {
+	module = strings.ToLower(strings.TrimSpace(module))
+	dir, err := getBackupDir()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.Base(file)))
+	if err != nil {
+		return err
+	}
+	var in ModuleExport
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Module != module {
+		return fmt.Errorf("export file belongs to module %s, not %s", in.Module, module)
+	}
+
+	models := getDataModels(module)
+	return Common.Database.Transaction(func(tx *gorm.DB) error {
+		for _, model := range models {
+			name, err := tableNameOf(model)
+			if err != nil {
+				return err
+			}
+			raw, ok := in.Tables[name]
+			if !ok {
+				continue
+			}
+			rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+			if err := json.Unmarshal(raw, rows.Interface()); err != nil {
+				return fmt.Errorf("decode table %s failed: %w", name, err)
+			}
+			if rows.Elem().Len() == 0 {
+				continue
+			}
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(rows.Interface()).Error; err != nil {
+				return fmt.Errorf("import table %s failed: %w", name, err)
+			}
+		}
+		for _, item := range in.Kv {
+			item.Namespace = module
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&item).Error; err != nil {
+				return fmt.Errorf("import kv failed: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func tableNameOf(model interface{}) (string, error) {
+	stmt := &gorm.Statement{DB: Common.Database.Db}
+	if err := stmt.Parse(model); err != nil {
+		return "", err
+	}
+	return stmt.Schema.Table, nil
+}
@@ -6,6 +6,7 @@ import (
 	"marmot/onebot/message"
 	"marmot/utils"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,6 +14,7 @@ type CmdHandler func(args []string, ctx *zero.Ctx)
 type CmdInfo struct {
 	handler    CmdHandler
 	permission byte
+	module     string
 }
 
 type CmdCall struct {
@@ -22,10 +24,12 @@ type CmdCall struct {
 
 type CmdMgr struct {
 	reqMap map[int64]int64
+	reqMu  sync.Mutex // reqMap is shared by the processor and sequential dispatch
 	cmds   map[string]CmdInfo
 	buf    *utils.RingQueue[CmdCall]
 	dur    int64
 	durTxt string
+	module string // module registering commands, set by ModuleMgr.LoadAll
 }
 
 func newCmdMgr() *CmdMgr {
@@ -42,6 +46,7 @@ func newCmdMgr() *CmdMgr {
 		durTxt: fmt.Sprintf("抱歉，您发送的太快了 命令冷却时间:%s", AppConfig.CmdCoolDown),
 	}
 
+	RegisterQueueMetrics("cmd", mgr.buf)
 	go mgr.processor()
 
 	return mgr
@@ -51,36 +56,71 @@ func (m *CmdMgr) processor() {
 	for {
 		t, e := m.buf.WaitDequeue()
 		if !e {
+			return // closed and drained
+		}
+		if m.buf.IsClosed() { // the modules of this manager were unloaded
+			EndTask()
 			continue
 		}
-		id := t.c.Event.Sender.ID
-		lTime, ok := m.reqMap[id]
-		if !ok {
-			m.reqMap[id] = time.Now().UnixNano()
-			go m.invokeCmd(t.c)
-		} else {
-			dur := t.time - lTime
-			m.reqMap[id] = t.time
-			if dur < m.dur {
-				t.c.SendGroupMessage(t.c.Event.GroupID, MakeReply(message.Reply(t.c.Event.MessageID), message.Text(m.durTxt)))
-				continue
-			}
-
-			go m.invokeCmd(t.c)
+		if !m.admit(t.c, t.time) {
+			EndTask()
+			continue
 		}
+		m.dispatch(t.c)
 	}
 }
 
+// admit records the command sent at and reports whether the cooldown of its
+// sender has passed, the sender is told to slow down otherwise
+func (m *CmdMgr) admit(c *zero.Ctx, at int64) bool {
+	id := c.Event.Sender.ID
+	m.reqMu.Lock()
+	last, ok := m.reqMap[id]
+	m.reqMap[id] = at
+	m.reqMu.Unlock()
+	if ok && at-last < m.dur {
+		metricCommands.Inc(m.parseCmdLabel(c), "cooldown")
+		c.SendGroupMessage(c.Event.GroupID, MakeReply(message.Reply(c.Event.MessageID), message.Text(m.durTxt)))
+		return false
+	}
+	return true
+}
+
+// OnCmdInOrder runs the command on the worker pool and waits for it instead
+// of queueing it, so sequential dispatch keeps it in the order of its group.
+// The cooldown applies as for queued commands.
+func (m *CmdMgr) OnCmdInOrder(c *zero.Ctx) {
+	if !BeginTask() {
+		return
+	}
+	if !m.admit(c, time.Now().UnixNano()) {
+		EndTask()
+		return
+	}
+	sharedWorkerPool().await(m.event(c), c, nil)
+}
+
+// close stops the processor, commands still queued are dropped
+func (m *CmdMgr) close() {
+	m.buf.Close()
+}
+
 func (m *CmdMgr) Register(label string, handler CmdHandler, permission byte) {
 	_, ok := m.cmds[label]
 	if ok {
 		LogError("[Bot] Duplicated cmd: %s", label)
 		return
 	}
-	info := CmdInfo{handler: handler, permission: permission}
+	info := CmdInfo{handler: handler, permission: permission, module: m.module}
 	m.cmds[label] = info
 }
 
+// Has reports whether label is a registered command
+func (m *CmdMgr) Has(label string) bool {
+	_, ok := m.cmds[label]
+	return ok
+}
+
 func (m *CmdMgr) RegisterMember(label string, handler CmdHandler) *CmdMgr {
 	m.Register(label, handler, 0)
 	return m
@@ -96,24 +136,42 @@ func (m *CmdMgr) RegisterBotAdmin(label string, handler CmdHandler) *CmdMgr {
 	return m
 }
 
+// dispatch hands the command to the worker pool, which ends the task begun
+// by OnCmd
+func (m *CmdMgr) dispatch(c *zero.Ctx) {
+	sharedWorkerPool().submit(m.event(c), c, nil)
+}
+
+// event wraps the command of c as a handler of the worker pool
+func (m *CmdMgr) event(c *zero.Ctx) Event {
+	module := ""
+	if cmd, ok := m.cmds[m.parseCmdLabel(c)]; ok {
+		module = cmd.module
+	}
+	return Event{Type: ETGroupMsg, Handler: m.invokeCmd, Module: module}
+}
+
 func (m *CmdMgr) invokeCmd(c *zero.Ctx) {
 	msg := c.ExtractPlainText()
 	lb, arg := parseInputCmd(msg, AppConfig.CmdPrefix)
 	cmd, ok := m.cmds[lb]
 	if !ok {
-		LogError("[Bot] Command not found: %s", msg)
+		metricCommands.Inc("", "not_found")
+		CtxLogger(c).Error("[Bot] Command not found: %s", msg)
 		return
 	}
 
 	switch cmd.permission {
 	case 2:
 		if !IsBotAdmin(c) {
+			metricCommands.Inc(lb, "denied")
 			c.SendGroupMessage(c.Event.GroupID, MakeReply(message.Reply(c.Event.MessageID), message.Text("很抱歉 您没有权限执行这条命令 只有管理员可以执行")))
 			return
 		}
 		break
 	case 1:
 		if !IsGroupAdmin(c) && !IsBotAdmin(c) {
+			metricCommands.Inc(lb, "denied")
 			c.SendGroupMessage(c.Event.GroupID, MakeReply(message.Reply(c.Event.MessageID), message.Text("很抱歉 您没有权限执行这条命令 只有管理员可以执行")))
 			return
 		}
@@ -122,13 +180,41 @@ func (m *CmdMgr) invokeCmd(c *zero.Ctx) {
 	case 0:
 		break
 	}
+	if c.State == nil {
+		c.State = zero.State{}
+	}
+	c.State[stateCommandKey] = lb
+	c.State[stateModuleKey] = cmd.module
+	defer func() {
+		if r := recover(); r != nil {
+			metricCommands.Inc(lb, "panic")
+			metricPanics.Inc(cmd.module)
+			CtxLogger(c).Error("[Bot] command %s panicked: %v", lb, r)
+		}
+	}()
 	cmd.handler(arg, c)
+	metricCommands.Inc(lb, "ok")
+}
+
+// parseCmdLabel returns the label of a known command, or an empty string
+// to keep the cardinality of metrics labels bounded
+func (m *CmdMgr) parseCmdLabel(c *zero.Ctx) string {
+	lb, _ := parseInputCmd(c.ExtractPlainText(), AppConfig.CmdPrefix)
+	if _, ok := m.cmds[lb]; ok {
+		return lb
+	}
+	return ""
 }
 
 func (m *CmdMgr) OnCmd(c *zero.Ctx) {
+	if !BeginTask() {
+		return
+	}
 	err := m.buf.Enqueue(CmdCall{c: c, time: time.Now().UnixNano()})
 	if err != nil {
+		EndTask()
 		c.SendGroupMessage(c.Event.GroupID, MakeReply(message.Reply(c.Event.MessageID), message.Text("命令无法被处理，内部错误")))
+		metricCommands.Inc(m.parseCmdLabel(c), "dropped")
 		LogError("[Bot] command enqueue failed %v", err)
 	}
 }
@@ -1,36 +1,131 @@
 package core
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type GlobalConfig struct {
-	WsUrl            string   `koanf:"ws_url" yaml:"ws_url"`
-	RecordLog        bool     `koanf:"record_log" yaml:"record_log"`
-	AutoCleanOldLogs bool     `koanf:"auto_clean_old_logs" yaml:"auto_clean_old_logs"`
-	MaxLogFiles      int      `koanf:"max_log_files" yaml:"max_log_files"`
-	CleanUpAmount    int      `koanf:"clean_up_amount" yaml:"clean_up_amount"`
-	CmdPrefix        string   `koanf:"cmd_prefix" yaml:"cmd_prefix"`
-	AdminQQ          []int64  `koanf:"admin" yaml:"admin"`
-	DbQueueSize      int      `koanf:"db_queue_size" yaml:"db_queue_size"`
-	CmdQueueSize     int      `koanf:"cmd_queue_size" yaml:"cmd_queue_size"`
-	CmdCoolDown      string   `koanf:"cmd_cooldown" yaml:"cmd_cooldown"`
-	MessageBufSize   int      `koanf:"message_buf_size" yaml:"message_buf_size"`
-	Modules          []string `koanf:"modules" yaml:"modules"`
+	WsUrl              string          `koanf:"ws_url" yaml:"ws_url"`
+	RecordLog          bool            `koanf:"record_log" yaml:"record_log"`
+	AutoCleanOldLogs   bool            `koanf:"auto_clean_old_logs" yaml:"auto_clean_old_logs"`
+	MaxLogFiles        int             `koanf:"max_log_files" yaml:"max_log_files"`
+	CleanUpAmount      int             `koanf:"clean_up_amount" yaml:"clean_up_amount,omitempty"` // deprecated and ignored, kept so older config.yml still validate
+	CmdPrefix          string          `koanf:"cmd_prefix" yaml:"cmd_prefix"`
+	AdminQQ            []int64         `koanf:"admin" yaml:"admin"`
+	DbQueueSize        int             `koanf:"db_queue_size" yaml:"db_queue_size"`
+	DbBatchSize        int             `koanf:"db_batch_size" yaml:"db_batch_size"`
+	CmdQueueSize       int             `koanf:"cmd_queue_size" yaml:"cmd_queue_size"`
+	CmdCoolDown        string          `koanf:"cmd_cooldown" yaml:"cmd_cooldown"`
+	MessageBufSize     int             `koanf:"message_buf_size" yaml:"message_buf_size"`
+	Modules            []string        `koanf:"modules" yaml:"modules"`
+	BackupInterval     string          `koanf:"backup_interval" yaml:"backup_interval"`
+	BackupKeep         int             `koanf:"backup_keep" yaml:"backup_keep"`
+	AdminListen        string          `koanf:"admin_listen" yaml:"admin_listen"`               // address of admin http server, empty disables it
+	AdminToken         string          `koanf:"admin_token" yaml:"admin_token"`                 // bearer token of admin console and api, empty disables them
+	Metrics            bool            `koanf:"metrics" yaml:"metrics"`                         // expose /metrics on admin http server
+	ShutdownTimeout    string          `koanf:"shutdown_timeout" yaml:"shutdown_timeout"`       // max time to drain handlers and db writes
+	StatusNotify       bool            `koanf:"status_notify" yaml:"status_notify"`             // private message admins when an account goes offline or back online
+	EventDedup         string          `koanf:"event_dedup" yaml:"event_dedup"`                 // window to drop events resent by the adapter, 0 disables
+	SequentialDispatch bool            `koanf:"sequential_dispatch" yaml:"sequential_dispatch"` // handle events and commands of a group or user in order
+	SequenceLen        uint            `koanf:"sequence_len" yaml:"sequence_len"`               // events a conversation queues in sequential dispatch, the oldest is dropped when full
+	Workers            int             `koanf:"workers" yaml:"workers"`                         // event handler workers, 0 uses twice the cpu count
+	EventQueueSize     int             `koanf:"event_queue_size" yaml:"event_queue_size"`       // handlers waiting for a worker, group messages are dropped first when full
+	MaxProcessTime     string          `koanf:"max_process_time" yaml:"max_process_time"`       // the context of handlers running longer is cancelled, 0 disables
+	RingLen            uint            `koanf:"ring_len" yaml:"ring_len"`                       // queue events in a ring drained by one loop, 0 handles every event right away
+	RingPolicy         string          `koanf:"ring_policy" yaml:"ring_policy"`                 // when the ring is full: drop_oldest, block or spill
+	EventLatency       string          `koanf:"event_latency" yaml:"event_latency"`             // delay before handling events, the drain interval of the ring
+	Log                LogConfig       `koanf:"log" yaml:"log"`
+	Record             RecordConfig    `koanf:"record" yaml:"record"`
+	Satori             SatoriConfig    `koanf:"satori" yaml:"satori"`
+	TextImage          TextImageConfig `koanf:"text_image" yaml:"text_image"`
+}
+
+type LogConfig struct {
+	ConsoleLevel  string            `koanf:"console_level" yaml:"console_level"`   // debug/info/warn/error
+	FileLevel     string            `koanf:"file_level" yaml:"file_level"`         // debug/info/warn/error
+	ConsoleFormat string            `koanf:"console_format" yaml:"console_format"` // console/json
+	FileFormat    string            `koanf:"file_format" yaml:"file_format"`       // console/json
+	MaxSize       int               `koanf:"max_size" yaml:"max_size"`             // MB, 0 disables size based rotation
+	RotateDaily   bool              `koanf:"rotate_daily" yaml:"rotate_daily"`
+	Compress      bool              `koanf:"compress" yaml:"compress"`
+	MaxAgeDays    int               `koanf:"max_age_days" yaml:"max_age_days"` // 0 keeps logs forever
+	ModuleLevels  map[string]string `koanf:"module_levels" yaml:"module_levels"`
+	ProtocolDebug bool              `koanf:"protocol_debug" yaml:"protocol_debug"` // log every onebot frame
+}
+
+type RecordConfig struct {
+	Enabled  bool `koanf:"enabled" yaml:"enabled"`     // record raw events and api calls into records/
+	MaxSize  int  `koanf:"max_size" yaml:"max_size"`   // MB, 0 disables size based rotation
+	MaxFiles int  `koanf:"max_files" yaml:"max_files"` // rotated recordings to keep, 0 keeps all
+}
+
+type SatoriConfig struct {
+	URL      string `koanf:"url" yaml:"url"`           // http base of a Satori gateway, replaces ws_url when set
+	Token    string `koanf:"token" yaml:"token"`       // gateway token, may be empty
+	Platform string `koanf:"platform" yaml:"platform"` // login to use on a gateway serving several platforms
+}
+
+type TextImageConfig struct {
+	Font       string  `koanf:"font" yaml:"font"`               // ttf/otf/ttc with CJK glyphs, empty looks for a font of the system
+	Width      int     `koanf:"width" yaml:"width"`             // px, 0 is 800
+	FontSize   float64 `koanf:"font_size" yaml:"font_size"`     // 0 is 24
+	AutoRender int     `koanf:"auto_render" yaml:"auto_render"` // long replies above this many characters are sent as an image, 0 disables
 }
 
 func (c GlobalConfig) CreateDefaultConfig() interface{} {
 	return &GlobalConfig{
-		WsUrl:            "ws://127.0.0.1:8080",
-		RecordLog:        true,
-		AutoCleanOldLogs: true,
-		MaxLogFiles:      100,
-		DbQueueSize:      100,
-		CleanUpAmount:    10,
-		CmdQueueSize:     100,
-		CmdCoolDown:      "5s",
-		CmdPrefix:        ".",
-		AdminQQ:          []int64{},
-		MessageBufSize:   100,
-		Modules:          []string{},
+		WsUrl:              "ws://127.0.0.1:8080",
+		RecordLog:          true,
+		AutoCleanOldLogs:   true,
+		MaxLogFiles:        100,
+		DbQueueSize:        100,
+		DbBatchSize:        100,
+		CmdQueueSize:       100,
+		CmdCoolDown:        "5s",
+		CmdPrefix:          ".",
+		AdminQQ:            []int64{},
+		MessageBufSize:     100,
+		Modules:            []string{},
+		BackupInterval:     "24h",
+		BackupKeep:         7,
+		AdminListen:        "",
+		AdminToken:         "",
+		Metrics:            true,
+		ShutdownTimeout:    "15s",
+		StatusNotify:       false,
+		EventDedup:         "5m",
+		SequentialDispatch: false,
+		SequenceLen:        100,
+		Workers:            0,
+		EventQueueSize:     1000,
+		MaxProcessTime:     "4m",
+		RingLen:            0,
+		RingPolicy:         "drop_oldest",
+		EventLatency:       "0s",
+		Log: LogConfig{
+			ConsoleLevel:  "debug",
+			FileLevel:     "debug",
+			ConsoleFormat: "console",
+			FileFormat:    "console",
+			MaxSize:       50,
+			RotateDaily:   true,
+			Compress:      true,
+			MaxAgeDays:    30,
+			ModuleLevels:  map[string]string{},
+			ProtocolDebug: false,
+		},
+		Record: RecordConfig{
+			Enabled:  false,
+			MaxSize:  64,
+			MaxFiles: 10,
+		},
+		TextImage: TextImageConfig{
+			Font:       "",
+			Width:      800,
+			FontSize:   24,
+			AutoRender: 0,
+		},
 	}
 }
 
@@ -54,3 +149,44 @@ func InitConfig() {
 		panic("failed to init bot config")
 	}
 }
+
+// EventDedupWindow returns the parsed event_dedup, 5m when it is missing and
+// 0 when it is disabled
+func EventDedupWindow() time.Duration {
+	if AppConfig.EventDedup == "" {
+		return 5 * time.Minute
+	}
+	dur, err := time.ParseDuration(AppConfig.EventDedup)
+	if err != nil || dur < 0 {
+		LogWarn("[Bot] invalid event_dedup %s, event deduplication disabled", AppConfig.EventDedup)
+		return 0
+	}
+	return dur
+}
+
+// MaxProcessTime returns the parsed max_process_time, 4m when it is missing
+// and 0 when it is disabled
+func MaxProcessTime() time.Duration {
+	if AppConfig.MaxProcessTime == "" {
+		return 4 * time.Minute
+	}
+	dur, err := time.ParseDuration(AppConfig.MaxProcessTime)
+	if err != nil || dur < 0 {
+		LogWarn("[Bot] invalid max_process_time %s, handler deadline disabled", AppConfig.MaxProcessTime)
+		return 0
+	}
+	return dur
+}
+
+// EventLatency returns the parsed event_latency, 0 when it is missing
+func EventLatency() time.Duration {
+	if AppConfig.EventLatency == "" {
+		return 0
+	}
+	dur, err := time.ParseDuration(AppConfig.EventLatency)
+	if err != nil || dur < 0 {
+		LogWarn("[Bot] invalid event_latency %s, events are handled without latency", AppConfig.EventLatency)
+		return 0
+	}
+	return dur
+}
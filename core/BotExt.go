@@ -3,6 +3,8 @@ package core
 import (
 	zero "marmot/onebot"
 	"marmot/onebot/message"
+	"sync"
+	"unicode/utf8"
 )
 
 func IsGroupChat(z *zero.Ctx) bool {
@@ -14,13 +16,39 @@ func IsBotAdmin(z *zero.Ctx) bool {
 }
 
 func IsGroupAdmin(ctx *zero.Ctx) bool {
-	return ctx.Event.Sender.Role == "owner" || ctx.Event.Sender.Role == "admin"
+	role := ctx.SenderRole()
+	return role == "owner" || role == "admin"
 }
 
 func IsGroupOwner(ctx *zero.Ctx) bool {
-	return ctx.Event.Sender.Role == "owner"
+	return ctx.SenderRole() == "owner"
 }
 
 func MakeReply(msg ...message.Segment) message.Message {
 	return msg
 }
+
+var textImageFont sync.Once
+
+// LongText returns the text as message, texts longer than text_image.auto_render
+// are rendered to an image. Falls back to the text when rendering fails.
+func LongText(text string) message.Message {
+	cfg := AppConfig.TextImage
+	if cfg.AutoRender <= 0 || utf8.RuneCountInString(text) <= cfg.AutoRender {
+		return message.Message{message.Text(text)}
+	}
+	textImageFont.Do(func() {
+		if cfg.Font == "" {
+			return
+		}
+		if err := message.SetTextImageFont(cfg.Font); err != nil {
+			LogWarn("[Bot] failed to load text_image.font %s: %v", cfg.Font, err)
+		}
+	})
+	img, err := message.TextImage(text, message.TextImageOptions{Width: cfg.Width, FontSize: cfg.FontSize})
+	if err != nil {
+		LogWarn("[Bot] failed to render text image: %v", err)
+		return message.Message{message.Text(text)}
+	}
+	return message.Message{img}
+}
@@ -26,6 +26,6 @@ func (Z *BotLogger) Warn(msg string) {
 
 func NewZBLogger() *BotLogger {
 	return &BotLogger{
-		logger: Common.Logger.GetZap(),
+		logger: Common.Logger.Named("onebot").GetZap(),
 	}
 }
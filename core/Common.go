@@ -15,22 +15,54 @@ type AppCommon struct {
 
 var Common *AppCommon = nil
 
+// CommonOptions changes where InitCommonWith keeps the bot's data, the
+// zero value behaves like InitCommon
+type CommonOptions struct {
+	DataDir    string // directory of config.yml, logs and the database, defaults to ./bot
+	InMemoryDb bool   // use an in-memory sqlite database instead of marmot_data.db
+}
+
+var dataDir string
+
 func InitCommon() {
+	InitCommonWith(CommonOptions{})
+}
+
+func InitCommonWith(opt CommonOptions) {
+	dataDir = opt.DataDir
+	LoadConfig()
+
+	Common = &AppCommon{}
+	Common.Logger = createLogger()
+	if opt.InMemoryDb {
+		Common.Database = newDbCtx(MemoryDb)
+	} else {
+		Common.Database = newDbCtx("marmot_data.db")
+	}
+	if Common.Database == nil {
+		panic("failed to init bot database")
+	}
+	if err := Common.Database.Migrate("core"); err != nil {
+		LogError("[Db] failed to migrate core tables: %v", err)
+		panic(err)
+	}
+	purgeExpiredKv()
+}
+
+// LoadConfig creates the data directory and loads config.yml (writing the
+// default one when missing) without starting any service
+func LoadConfig() {
 	err := checkAppDir()
 	if err != nil {
 		fmt.Printf("[ERROR] Failed to init bot's data directory, err:%e\n", err)
 		panic(err)
 	}
 	InitConfig()
-
-	Common = &AppCommon{}
-	Common.Logger = createLogger()
-	Common.Database = newDbCtx("marmot_data.db")
 }
 
 func checkAppDir() error {
-	if !utils.IsDirExists("bot") {
-		err := os.Mkdir("bot", 0777)
+	if dir := GetDataDir(); !utils.IsDirExists(dir) {
+		err := os.MkdirAll(dir, 0777)
 		if err != nil {
 			return err
 		}
@@ -40,7 +72,7 @@ func checkAppDir() error {
 }
 
 func GetSubDir(name string) (string, bool) {
-	realPth := filepath.Join("bot", name)
+	realPth := filepath.Join(GetDataDir(), name)
 
 	if !utils.IsDirExists(realPth) {
 		err := os.Mkdir(realPth, 0777)
@@ -75,6 +107,9 @@ func GetSubDirFilePath(name string) string {
 }
 
 func GetDataDir() string {
+	if dataDir != "" {
+		return dataDir
+	}
 	wd, err := os.Getwd()
 	if err != nil {
 		fmt.Printf("[ERROR] Failed to get working directory, err:%v\n", err)
@@ -44,7 +44,8 @@ func InitCustomConfig[T IConfig](config *T, path string) error {
 	r := LoadCustomConfigFromFile[T](path, config)
 	if r != nil {
 		r := *config
-		config = r.CreateDefaultConfig().(*T)
+		// fill the caller's struct, reassigning the pointer would leave it empty
+		*config = *r.CreateDefaultConfig().(*T)
 		rs := SaveCustomConfigToFile[T](path, config)
 		if rs != nil {
 			fmt.Printf("[Config] failed to save default config to file: %v\n", rs)
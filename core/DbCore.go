@@ -4,6 +4,7 @@ import (
 	"errors"
 	"gorm.io/gorm"
 	"marmot/utils"
+	"reflect"
 	"sync"
 )
 
@@ -13,69 +14,191 @@ const (
 	TTypeUnknown TaskType = iota
 	TTypeInsert
 	TTypeUpdate
-	TTypeDelete // hard delete
-	TTypeRemove // soft delete
+	TTypeDelete      // hard delete
+	TTypeRemove      // soft delete
+	TTypeTransaction // run closure inside db.Transaction
 )
 
+var (
+	ErrNilDbResult     = errors.New("nil db result")
+	ErrNoSoftDelete    = errors.New("model has no gorm.DeletedAt field, soft delete unsupported")
+	ErrUnknownTaskType = errors.New("unknown db task type")
+	ErrDbClosed        = errors.New("database is closed")
+)
+
+var deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+
+// TxFunc runs on the writer goroutine, every statement must go through tx.
+// Calling Insert/Update/Post/Transaction of the DbCtx from it deadlocks, as
+// they wait for the writer goroutine the TxFunc is blocking.
+type TxFunc func(tx *gorm.DB) error
+
 type QueueTask struct {
 	taskType TaskType
 	taskData interface{}
-	resultCh chan error
+	txFunc   TxFunc
+	future   *DbFuture
+}
+
+// DbFuture is the pending result of a queued db task
+type DbFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newDbFuture() *DbFuture {
+	return &DbFuture{done: make(chan struct{})}
+}
+
+func (f *DbFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed after the task has been executed
+func (f *DbFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the task has been executed and returns its error
+func (f *DbFuture) Wait() error {
+	<-f.done
+	return f.err
 }
 
 type DbCtx struct {
 	Db         *gorm.DB
 	writeQueue *utils.RingQueue[QueueTask]
-	closeCh    chan struct{}
+	batchSize  int
 	wg         sync.WaitGroup
+	pending    *QueueTask // task dequeued while coalescing inserts
 }
 
+// MemoryDb is the database name of a sqlite database living in memory
+const MemoryDb = ":memory:"
+
 func newDbCtx(name string) *DbCtx {
-	path := GetSubDirFilePath(name)
+	path := name
+	if name != MemoryDb {
+		path = GetSubDirFilePath(name)
+	}
 	db, err := utils.OpenSqlite(path)
 	if err != nil {
 		LogError("[Db] failed to open database: %v", err)
 		return nil
 	}
+	if name == MemoryDb {
+		// every connection would open its own empty database
+		if sqlDb, err := db.DB(); err == nil {
+			sqlDb.SetMaxOpenConns(1)
+		}
+	}
 
 	ctx := &DbCtx{
 		Db:         db,
 		writeQueue: utils.NewRingQueue[QueueTask](AppConfig.DbQueueSize),
-		closeCh:    make(chan struct{}),
+		batchSize:  AppConfig.DbBatchSize,
+	}
+	if ctx.batchSize <= 0 {
+		ctx.batchSize = 100
 	}
+	RegisterQueueMetrics("db", ctx.writeQueue)
 	ctx.wg.Add(1)
 	go ctx.actionWorker()
 	return ctx
 }
 
+// Close stops accepting new tasks, flushes every queued write and closes the
+// connection. Db stays set, so handlers still running get errors instead of
+// dereferencing nil.
 func (db *DbCtx) Close() {
-	close(db.closeCh)
 	db.writeQueue.Close()
 	db.wg.Wait()
-	//_ = db.Db.Close()
-	db.Db = nil
+	if sqlDb, err := db.Db.DB(); err == nil {
+		_ = sqlDb.Close()
+	}
+}
+
+func (db *DbCtx) next() (QueueTask, bool) {
+	if db.pending != nil {
+		t := *db.pending
+		db.pending = nil
+		return t, true
+	}
+	return db.writeQueue.WaitDequeue()
 }
 
 func (db *DbCtx) actionWorker() {
 	defer db.wg.Done()
-	defer func() {
-		if r := recover(); r != nil {
-			LogError("[Db] panic in worker: %v", r)
-		}
-	}()
 
 	for {
-		select {
-		case <-db.closeCh:
+		d, ok := db.next()
+		if !ok {
 			return
-		default:
 		}
 
-		d, ok := db.writeQueue.WaitDequeue()
-		if !ok {
-			return
+		if d.taskType == TTypeInsert {
+			batch := db.collectInserts(d)
+			if len(batch) > 1 {
+				db.runBatchInsert(batch)
+				continue
+			}
 		}
 
+		err := db.runTask(d)
+		if err != nil {
+			LogError("[Db] run queue task failed [type: %v, error: %v]", d.taskType, err)
+		}
+		if d.future != nil {
+			d.future.resolve(err)
+		}
+	}
+}
+
+// collectInserts drains consecutive inserts of the same model type already waiting in the queue
+func (db *DbCtx) collectInserts(first QueueTask) []QueueTask {
+	tp := reflect.TypeOf(first.taskData)
+	if tp == nil || tp.Kind() != reflect.Pointer || tp.Elem().Kind() != reflect.Struct {
+		return []QueueTask{first}
+	}
+
+	batch := []QueueTask{first}
+	for len(batch) < db.batchSize {
+		t, err := db.writeQueue.Dequeue()
+		if err != nil {
+			break
+		}
+		if t.taskType != TTypeInsert || reflect.TypeOf(t.taskData) != tp {
+			db.pending = &t
+			break
+		}
+		batch = append(batch, t)
+	}
+	return batch
+}
+
+func (db *DbCtx) runBatchInsert(batch []QueueTask) {
+	tp := reflect.TypeOf(batch[0].taskData)
+	values := reflect.MakeSlice(reflect.SliceOf(tp), 0, len(batch))
+	for _, t := range batch {
+		values = reflect.Append(values, reflect.ValueOf(t.taskData))
+	}
+
+	err := db.safeExec(func() error {
+		return db.Db.CreateInBatches(values.Interface(), db.batchSize).Error
+	})
+	if err != nil {
+		LogError("[Db] run batched insert failed [size: %v, error: %v]", len(batch), err)
+	}
+	for _, t := range batch {
+		if t.future != nil {
+			t.future.resolve(err)
+		}
+	}
+}
+
+func (db *DbCtx) runTask(d QueueTask) error {
+	return db.safeExec(func() error {
 		var r *gorm.DB
 		switch d.taskType {
 		case TTypeInsert:
@@ -83,45 +206,107 @@ func (db *DbCtx) actionWorker() {
 		case TTypeUpdate:
 			r = db.Db.Model(d.taskData).Updates(d.taskData)
 		case TTypeRemove:
-		case TTypeDelete:
+			if !db.isSoftDeletable(d.taskData) {
+				return ErrNoSoftDelete
+			}
 			r = db.Db.Delete(d.taskData)
-		case TTypeUnknown:
-			r = nil
+		case TTypeDelete:
+			r = db.Db.Unscoped().Delete(d.taskData)
+		case TTypeTransaction:
+			return db.Db.Transaction(d.txFunc)
+		default:
+			return ErrUnknownTaskType
 		}
 
-		if r == nil || r.Error != nil {
-			LogError("[Db] run queue task failed [type: %v, error: %v]", d.taskType, r)
+		if r == nil {
+			return ErrNilDbResult
 		}
+		return r.Error
+	})
+}
 
-		if d.resultCh != nil {
-			var err error
-			if r != nil {
-				err = r.Error
-			} else {
-				err = errors.New("nil db result")
-			}
+func (db *DbCtx) safeExec(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			LogError("[Db] panic in worker: %v", r)
+			err = errors.New("panic in db worker")
+		}
+	}()
+	return fn()
+}
 
-			select {
-			case d.resultCh <- err:
-			default:
-				// Skip blocked
-			}
+func (db *DbCtx) isSoftDeletable(data interface{}) bool {
+	stmt := &gorm.Statement{DB: db.Db}
+	if err := stmt.Parse(data); err != nil {
+		return false
+	}
+	for _, field := range stmt.Schema.Fields {
+		if field.FieldType == deletedAtType {
+			return true
 		}
 	}
+	return false
+}
+
+func (db *DbCtx) enqueue(tsk QueueTask) error {
+	err := db.writeQueue.Enqueue(tsk)
+	if errors.Is(err, utils.ErrClosed) {
+		return ErrDbClosed
+	}
+	return err
 }
 
 func (db *DbCtx) submit(taskType TaskType, data interface{}) error {
-	ch := make(chan error, 1)
-	tsk := QueueTask{
+	return db.Async(taskType, data).Wait()
+}
+
+// Async queues a task and returns a future of its result
+func (db *DbCtx) Async(taskType TaskType, data interface{}) *DbFuture {
+	f := newDbFuture()
+	err := db.enqueue(QueueTask{
 		taskType: taskType,
 		taskData: data,
-		resultCh: ch,
+		future:   f,
+	})
+	if err != nil {
+		f.resolve(err)
 	}
-	err := db.writeQueue.Enqueue(tsk)
+	return f
+}
+
+// Post queues a task without waiting for it, failures are only logged
+func (db *DbCtx) Post(taskType TaskType, data interface{}) error {
+	return db.enqueue(QueueTask{
+		taskType: taskType,
+		taskData: data,
+	})
+}
+
+// Transaction runs fn inside a transaction on the writer goroutine and waits for it,
+// fn must use tx instead of db (see TxFunc)
+func (db *DbCtx) Transaction(fn TxFunc) error {
+	return db.TransactionAsync(fn).Wait()
+}
+
+// PostTransaction queues fn without waiting for it, failures are only logged
+func (db *DbCtx) PostTransaction(fn TxFunc) error {
+	return db.enqueue(QueueTask{
+		taskType: TTypeTransaction,
+		txFunc:   fn,
+	})
+}
+
+func (db *DbCtx) TransactionAsync(fn TxFunc) *DbFuture {
+	f := newDbFuture()
+	err := db.enqueue(QueueTask{
+		taskType: TTypeTransaction,
+		txFunc:   fn,
+		future:   f,
+	})
 	if err != nil {
-		return err
+		f.resolve(err)
 	}
-	return <-ch
+	return f
 }
 
 func (db *DbCtx) Insert(data interface{}) error {
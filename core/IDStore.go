@@ -0,0 +1,31 @@
+package core
+
+import (
+	zero "marmot/onebot"
+	"strconv"
+	"time"
+)
+
+// idTTL is how long a hashed id is kept after it was last saved, ids in use
+// are saved again daily (see zero.IDStore)
+const idTTL = 30 * 24 * time.Hour
+
+// kvIDStore keeps the string ids of Satori and OneBot v12 accounts in the
+// kv store, see zero.IDStore
+type kvIDStore struct {
+	kv *KvStore
+}
+
+func (s kvIDStore) LoadID(n int64) (string, bool) {
+	return s.kv.Get(strconv.FormatInt(n, 10))
+}
+
+func (s kvIDStore) SaveID(n int64, id string) error {
+	// SaveID is called on the event path, don't wait for the database
+	return s.kv.PostWithTTL(strconv.FormatInt(n, 10), id, idTTL)
+}
+
+// NewIDStore returns the store of hashed string ids, InitCommon must be called first
+func NewIDStore() zero.IDStore {
+	return kvIDStore{kv: GetKvStore("onebot_ids")}
+}
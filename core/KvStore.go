@@ -0,0 +1,288 @@
+package core
+
+import (
+	"errors"
+	"github.com/goccy/go-json"
+	lru "github.com/hashicorp/golang-lru"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KvItem is a single row of the `kv_store` table
+type KvItem struct {
+	Namespace string `gorm:"primaryKey"`
+	Key       string `gorm:"primaryKey;column:item_key"`
+	Value     string `gorm:"column:item_value"`
+	ExpireAt  int64  `gorm:"index"` // unix nano, 0 means never expire
+}
+
+func (KvItem) TableName() string {
+	return "kv_store"
+}
+
+func (i *KvItem) expired(now int64) bool {
+	return i.ExpireAt != 0 && i.ExpireAt <= now
+}
+
+// KvStore is a namespaced key-value storage with a write-through lru cache,
+// reads check the cache first and fall back to the database on a miss,
+// writes go through DbCtx's write queue.
+type KvStore struct {
+	namespace string
+	db        *DbCtx
+	cache     *lru.Cache
+	mu        sync.Mutex
+}
+
+var (
+	kvStores   = make(map[string]*KvStore)
+	kvStoresMu sync.Mutex
+)
+
+// GetKvStore returns the shared store of namespace, stores of a database
+// replaced by InitCommonWith (e.g. the next simulator) are created again
+func GetKvStore(namespace string) *KvStore {
+	namespace = strings.ToLower(strings.TrimSpace(namespace))
+	kvStoresMu.Lock()
+	defer kvStoresMu.Unlock()
+
+	if s, ok := kvStores[namespace]; ok && s.db == Common.Database {
+		return s
+	}
+	size := AppConfig.MessageBufSize
+	if size <= 0 {
+		size = 100
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		LogError("[Kv] failed to create lru cache for %s: %v", namespace, err)
+		return nil
+	}
+	s := &KvStore{
+		namespace: namespace,
+		db:        Common.Database,
+		cache:     cache,
+	}
+	kvStores[namespace] = s
+	return s
+}
+
+func (s *KvStore) Namespace() string {
+	return s.namespace
+}
+
+func (s *KvStore) load(key string) (*KvItem, bool) {
+	if v, ok := s.cache.Get(key); ok {
+		item := v.(*KvItem)
+		if !item.expired(time.Now().UnixNano()) {
+			return item, true
+		}
+		s.cache.Remove(key)
+		return nil, false
+	}
+
+	var item KvItem
+	r := s.db.Db.Where("namespace = ? AND item_key = ?", s.namespace, key).Limit(1).Find(&item)
+	if r.Error != nil {
+		LogError("[Kv] failed to read %s/%s: %v", s.namespace, key, r.Error)
+		return nil, false
+	}
+	if r.RowsAffected == 0 {
+		return nil, false
+	}
+	if item.expired(time.Now().UnixNano()) {
+		_ = s.db.Post(TTypeDelete, &item)
+		return nil, false
+	}
+	s.cache.Add(key, &item)
+	return &item, true
+}
+
+// Get returns the value of key, ok is false when it's missing or expired
+func (s *KvStore) Get(key string) (string, bool) {
+	item, ok := s.load(key)
+	if !ok {
+		return "", false
+	}
+	return item.Value, true
+}
+
+func (s *KvStore) Has(key string) bool {
+	_, ok := s.load(key)
+	return ok
+}
+
+func (s *KvStore) Set(key string, value string) error {
+	return s.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL stores value which expires after ttl, zero ttl never expires
+func (s *KvStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	item := &KvItem{
+		Namespace: s.namespace,
+		Key:       key,
+		Value:     value,
+	}
+	if ttl > 0 {
+		item.ExpireAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(item).Error
+	})
+	if err != nil {
+		s.cache.Remove(key)
+		return err
+	}
+	s.cache.Add(key, item)
+	return nil
+}
+
+// PostWithTTL is SetWithTTL without waiting for the database, the value is
+// readable at once and a failed write is only logged
+func (s *KvStore) PostWithTTL(key string, value string, ttl time.Duration) error {
+	item := &KvItem{
+		Namespace: s.namespace,
+		Key:       key,
+		Value:     value,
+	}
+	if ttl > 0 {
+		item.ExpireAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.PostTransaction(func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(item).Error
+	})
+	if err != nil {
+		s.cache.Remove(key)
+		return err
+	}
+	s.cache.Add(key, item)
+	return nil
+}
+
+func (s *KvStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Remove(key)
+	return s.db.Delete(&KvItem{Namespace: s.namespace, Key: key})
+}
+
+// List returns every alive entry whose key starts with prefix
+func (s *KvStore) List(prefix string) (map[string]string, error) {
+	var items []KvItem
+	r := s.db.Db.Where("namespace = ? AND item_key LIKE ? ESCAPE '\\'", s.namespace, escapeLike(prefix)+"%").
+		Where("expire_at = 0 OR expire_at > ?", time.Now().UnixNano()).
+		Find(&items)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	result := make(map[string]string, len(items))
+	for _, item := range items {
+		result[item.Key] = item.Value
+	}
+	return result, nil
+}
+
+// Incr atomically adds delta to the integer stored at key and returns the new value,
+// missing keys start from zero and the ttl of existing keys is kept
+func (s *KvStore) Incr(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result KvItem
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var item KvItem
+		r := tx.Where("namespace = ? AND item_key = ?", s.namespace, key).Limit(1).Find(&item)
+		if r.Error != nil {
+			return r.Error
+		}
+
+		var val int64
+		if r.RowsAffected == 0 || item.expired(time.Now().UnixNano()) {
+			item = KvItem{Namespace: s.namespace, Key: key}
+		} else if item.Value != "" {
+			v, err := strconv.ParseInt(item.Value, 10, 64)
+			if err != nil {
+				return errors.New("value of " + key + " is not an integer")
+			}
+			val = v
+		}
+		item.Value = strconv.FormatInt(val+delta, 10)
+		result = item
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&item).Error
+	})
+	if err != nil {
+		s.cache.Remove(key)
+		return 0, err
+	}
+	s.cache.Add(key, &result)
+	return strconv.ParseInt(result.Value, 10, 64)
+}
+
+// Clear removes every entry of this namespace
+func (s *KvStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Purge()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.Where("namespace = ?", s.namespace).Delete(&KvItem{}).Error
+	})
+}
+
+// KvGet decodes the json value of key into T
+func KvGet[T any](s *KvStore, key string) (T, bool, error) {
+	var out T
+	raw, ok := s.Get(key)
+	if !ok {
+		return out, false, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		return out, false, err
+	}
+	return out, true, nil
+}
+
+// KvSet stores v as json, zero ttl never expires
+func KvSet[T any](s *KvStore, key string, v T, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.SetWithTTL(key, string(data), ttl)
+}
+
+func escapeLike(str string) string {
+	str = strings.ReplaceAll(str, "\\", "\\\\")
+	str = strings.ReplaceAll(str, "%", "\\%")
+	str = strings.ReplaceAll(str, "_", "\\_")
+	return str
+}
+
+// purgeExpiredKv drops every expired entry of all namespaces
+func purgeExpiredKv() {
+	err := Common.Database.Transaction(func(tx *gorm.DB) error {
+		return tx.Where("expire_at != 0 AND expire_at <= ?", time.Now().UnixNano()).Delete(&KvItem{}).Error
+	})
+	if err != nil {
+		LogWarn("[Kv] failed to purge expired entries: %v", err)
+	}
+}
+
+func init() {
+	RegisterMigrations("core", Migration{
+		Name: "create_kv_store",
+		// frozen DDL of KvItem at v1, schema changes go into a new migration
+		UpSQL: "CREATE TABLE IF NOT EXISTS `kv_store` (`namespace` text,`item_key` text,`item_value` text,`expire_at` integer,PRIMARY KEY (`namespace`,`item_key`));" +
+			"CREATE INDEX IF NOT EXISTS `idx_kv_store_expire_at` ON `kv_store`(`expire_at`)",
+		DownSQL: "DROP TABLE IF EXISTS `kv_store`",
+	})
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"go.uber.org/zap"
+	zero "marmot/onebot"
+)
+
+const (
+	stateModuleKey  = "__marmot_module__"
+	stateCommandKey = "__marmot_command__"
+)
+
+// With returns a child logger which attaches fields to every entry
+func (l *Logger) With(fields ...zap.Field) *Logger {
+	return &Logger{
+		logger: l.logger.With(fields...),
+		name:   l.name,
+	}
+}
+
+// WithCtx attaches the ids of the event held by ctx, plus module and
+// command when the ctx is dispatched by CmdMgr
+func (l *Logger) WithCtx(ctx *zero.Ctx) *Logger {
+	return l.With(CtxFields(ctx)...)
+}
+
+// InfoFields/WarnFields/ErrorFields/DebugFields log msg as is with structured fields
+func (l *Logger) InfoFields(msg string, fields ...zap.Field) {
+	l.logger.Info(msg, fields...)
+}
+
+func (l *Logger) WarnFields(msg string, fields ...zap.Field) {
+	l.logger.Warn(msg, fields...)
+}
+
+func (l *Logger) ErrorFields(msg string, fields ...zap.Field) {
+	l.logger.Error(msg, fields...)
+}
+
+func (l *Logger) DebugFields(msg string, fields ...zap.Field) {
+	l.logger.Debug(msg, fields...)
+}
+
+func LogWith(fields ...zap.Field) *Logger {
+	return Common.Logger.With(fields...)
+}
+
+// CtxLogger returns the logger bound to the event of ctx, the module's named
+// logger is used when the ctx comes from one of its commands
+func CtxLogger(ctx *zero.Ctx) *Logger {
+	if module, ok := ctx.State[stateModuleKey].(string); ok && module != "" {
+		return Common.Logger.Named(module).WithCtx(ctx)
+	}
+	return Common.Logger.WithCtx(ctx)
+}
+
+// handlerLogger returns the logger of the module handling event, the module
+// comes from the event since only commands put it into ctx.State
+func handlerLogger(event Event, ctx *zero.Ctx) *Logger {
+	if event.Module == "" {
+		return Common.Logger.With(eventFields(ctx, 4)...)
+	}
+	return Common.Logger.Named(event.Module).With(append(eventFields(ctx, 5), zap.String("module", event.Module))...)
+}
+
+// CtxFields collects self_id, group_id, user_id, message_id, module and command of ctx
+func CtxFields(ctx *zero.Ctx) []zap.Field {
+	if ctx == nil {
+		return nil
+	}
+	fields := eventFields(ctx, 6)
+	if module, ok := ctx.State[stateModuleKey].(string); ok && module != "" {
+		fields = append(fields, zap.String("module", module))
+	}
+	if cmd, ok := ctx.State[stateCommandKey].(string); ok && cmd != "" {
+		fields = append(fields, zap.String("command", cmd))
+	}
+	return fields
+}
+
+// eventFields collects the ids of the event held by ctx without touching
+// ctx.State, which handlers of other modules may be writing
+func eventFields(ctx *zero.Ctx, capacity int) []zap.Field {
+	fields := make([]zap.Field, 0, capacity)
+	if ctx == nil {
+		return fields
+	}
+	if e := ctx.Event; e != nil {
+		fields = append(fields, zap.Int64("self_id", e.SelfID))
+		if e.GroupID != 0 {
+			fields = append(fields, zap.Int64("group_id", e.GroupID))
+		}
+		if e.UserID != 0 {
+			fields = append(fields, zap.Int64("user_id", e.UserID))
+		}
+		if e.MessageID != nil {
+			fields = append(fields, zap.Any("message_id", e.MessageID))
+		}
+	}
+	return fields
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"strings"
+	"sync"
+)
+
+// logHub keeps the latest log lines in memory and fans them out to
+// subscribers, used by the live log view of the admin console
+type logHub struct {
+	mu    sync.Mutex
+	lines []string
+	head  int
+	full  bool
+	subs  map[chan string]struct{}
+}
+
+const logHubSize = 500
+
+var webLogs = &logHub{
+	lines: make([]string, logHubSize),
+	subs:  make(map[chan string]struct{}),
+}
+
+func (h *logHub) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	h.mu.Lock()
+	h.lines[h.head] = line
+	h.head = (h.head + 1) % logHubSize
+	if h.head == 0 {
+		h.full = true
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- line:
+		default: // slow subscriber, drop the line
+		}
+	}
+	h.mu.Unlock()
+	return len(p), nil
+}
+
+func (h *logHub) Sync() error {
+	return nil
+}
+
+// Recent returns up to n latest lines from old to new
+func (h *logHub) Recent(n int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	size := h.head
+	if h.full {
+		size = logHubSize
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	result := make([]string, 0, n)
+	for i := size - n; i < size; i++ {
+		idx := i
+		if h.full {
+			idx = (h.head + i) % logHubSize
+		}
+		result = append(result, h.lines[idx])
+	}
+	return result
+}
+
+func (h *logHub) Subscribe() chan string {
+	ch := make(chan string, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *logHub) Unsubscribe(ch chan string) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"marmot/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	latestLogName = "latest.log"
+	oldLogPrefix  = "log_"
+)
+
+// rotateWriter writes into latest.log and rotates it by size and/or day,
+// rotated files are renamed to log_yyyy_MM_dd_HH_mm_ss.log (optionally gzipped).
+// The names are configurable so event recordings can share it.
+type rotateWriter struct {
+	mu       sync.Mutex
+	pending  sync.Map // rotated logs being compressed, skipped by cleanUp
+	dir      string
+	latest   string // name of the file being written
+	prefix   string // name prefix of rotated files
+	ext      string
+	file     *os.File
+	size     int64
+	day      string
+	maxSize  int64
+	daily    bool
+	compress bool
+	maxAge   time.Duration
+	maxFiles int
+}
+
+func newRotateWriter(dir string, cfg *LogConfig) (*rotateWriter, error) {
+	w := &rotateWriter{
+		dir:      dir,
+		latest:   latestLogName,
+		prefix:   oldLogPrefix,
+		ext:      ".log",
+		maxSize:  int64(cfg.MaxSize) * 1024 * 1024,
+		daily:    cfg.RotateDaily,
+		compress: cfg.Compress,
+		maxAge:   time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+	}
+	if AppConfig.AutoCleanOldLogs {
+		w.maxFiles = AppConfig.MaxLogFiles
+	}
+	return w.init()
+}
+
+// init archives the file left by last run and opens a new one
+func (w *rotateWriter) init() (*rotateWriter, error) {
+	// rotate the log left by last run
+	if utils.IsFileExists(w.latestPath()) {
+		if err := w.archive(); err != nil {
+			return nil, fmt.Errorf("log rotate failed: %w", err)
+		}
+	} else {
+		w.removeOldLogs()
+	}
+	if err := w.open(); err != nil {
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) latestPath() string {
+	return filepath.Join(w.dir, w.latest)
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.latestPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.day = time.Now().Format(time.DateOnly)
+	return nil
+}
+
+// archive renames latest.log and compresses it in background if enabled,
+// old logs are removed once the compression finished
+func (w *rotateWriter) archive() error {
+	timestamp := time.Now().Format("2006_01_02_15_04_05")
+	backupPath := filepath.Join(w.dir, w.prefix+timestamp+w.ext)
+	for i := 1; utils.IsFileExists(backupPath) || utils.IsFileExists(backupPath+".gz"); i++ {
+		backupPath = filepath.Join(w.dir, fmt.Sprintf("%s%s_%d%s", w.prefix, timestamp, i, w.ext))
+	}
+
+	if err := os.Rename(w.latestPath(), backupPath); err != nil {
+		return err
+	}
+	if !w.compress {
+		w.removeOldLogs()
+		return nil
+	}
+	w.pending.Store(backupPath, struct{}{})
+	go func() {
+		compressLogFile(backupPath)
+		w.pending.Delete(backupPath)
+		w.removeOldLogs()
+	}()
+	return nil
+}
+
+func (w *rotateWriter) removeOldLogs() {
+	if err := w.cleanUp(); err != nil {
+		fmt.Printf("[WARN] remove old logs failed, err:%v\n", err)
+	}
+}
+
+func compressLogFile(path string) {
+	err := func() error {
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+
+		out, err := os.Create(path + ".gz")
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		gw := gzip.NewWriter(out)
+		if _, err := io.Copy(gw, in); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		// keep the time of rotation, cleanUp orders and expires by it
+		return os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	}()
+	if err != nil {
+		fmt.Printf("[WARN] compress log %s failed, err:%v\n", path, err)
+		_ = os.Remove(path + ".gz")
+		return
+	}
+	_ = os.Remove(path)
+}
+
+func (w *rotateWriter) shouldRotate(n int) bool {
+	if w.maxSize > 0 && w.size+int64(n) > w.maxSize && w.size > 0 {
+		return true
+	}
+	return w.daily && time.Now().Format(time.DateOnly) != w.day
+}
+
+func (w *rotateWriter) rotate() error {
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+	if err := w.archive(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			fmt.Printf("[ERROR] log rotate failed, err:%v\n", err)
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// cleanUp removes rotated logs older than maxAge and the oldest ones exceeding maxFiles
+func (w *rotateWriter) cleanUp() error {
+	if w.maxAge <= 0 && w.maxFiles <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+
+	type oldLog struct {
+		path    string
+		modTime time.Time
+	}
+	files := make([]oldLog, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), w.prefix) {
+			continue
+		}
+		if _, ok := w.pending.Load(filepath.Join(w.dir, strings.TrimSuffix(e.Name(), ".gz"))); ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, oldLog{path: filepath.Join(w.dir, e.Name()), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	now := time.Now()
+	toDelete := 0
+	if w.maxFiles > 0 && len(files) > w.maxFiles {
+		toDelete = len(files) - w.maxFiles
+	}
+	for i, f := range files {
+		if i < toDelete || (w.maxAge > 0 && now.Sub(f.modTime) > w.maxAge) {
+			_ = os.Remove(f.path)
+		}
+	}
+	return nil
+}
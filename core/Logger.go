@@ -4,18 +4,31 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"io/fs"
-	"marmot/utils"
 	"os"
-	"path/filepath"
-	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Logger struct {
 	logger *zap.Logger
+	name   string
 }
 
+// logSink is one output of the logger (console or file) with its own level
+type logSink struct {
+	name    string
+	encoder zapcore.Encoder
+	ws      zapcore.WriteSyncer
+	level   zap.AtomicLevel
+}
+
+var (
+	logSinks     []*logSink
+	moduleLevels sync.Map // module name -> zapcore.Level
+	namedLoggers sync.Map // module name -> *Logger
+)
+
 func (l *Logger) GetZap() *zap.Logger {
 	return l.logger
 }
@@ -36,20 +49,81 @@ func (l *Logger) Debug(tmp string, args ...interface{}) {
 	l.logger.Debug(fmt.Sprintf(tmp, args...))
 }
 
+// Named returns the logger of a module, its level can be overridden
+// by `log.module_levels` in config.yml or the `loglevel` command
+func (l *Logger) Named(name string) *Logger {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if r, ok := namedLoggers.Load(name); ok {
+		return r.(*Logger)
+	}
+	r, _ := namedLoggers.LoadOrStore(name, &Logger{
+		logger: newZapLogger(name).Named(l.name).Named(name),
+		name:   name,
+	})
+	return r.(*Logger)
+}
+
 func LogInfo(tmp string, args ...interface{}) {
-	Common.Logger.Info(fmt.Sprintf(tmp, args...))
+	Common.Logger.Info(tmp, args...)
 }
 
 func LogWarn(tmp string, args ...interface{}) {
-	Common.Logger.Warn(fmt.Sprintf(tmp, args...))
+	Common.Logger.Warn(tmp, args...)
 }
 
 func LogError(tmp string, args ...interface{}) {
-	Common.Logger.Error(fmt.Sprintf(tmp, args...))
+	Common.Logger.Error(tmp, args...)
 }
 
 func LogDebug(tmp string, args ...interface{}) {
-	Common.Logger.Debug(fmt.Sprintf(tmp, args...))
+	Common.Logger.Debug(tmp, args...)
+}
+
+// SetLogLevel changes the level of a sink ("console"/"file") or of a named module logger at runtime
+func SetLogLevel(target string, level string) error {
+	target = strings.ToLower(strings.TrimSpace(target))
+	lv, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	for _, sink := range logSinks {
+		if sink.name == target {
+			sink.level.SetLevel(lv)
+			return nil
+		}
+	}
+	moduleLevels.Store(target, lv)
+	return nil
+}
+
+// ResetLogLevel removes the level override of a module
+func ResetLogLevel(module string) {
+	moduleLevels.Delete(strings.ToLower(strings.TrimSpace(module)))
+}
+
+// LogLevels describes current levels of every sink and module override
+func LogLevels() map[string]string {
+	result := make(map[string]string)
+	for _, sink := range logSinks {
+		result[sink.name] = sink.level.Level().String()
+	}
+	moduleLevels.Range(func(key, value any) bool {
+		result[key.(string)] = value.(zapcore.Level).String()
+		return true
+	})
+	return result
+}
+
+func parseLogLevel(level string) zapcore.Level {
+	if level == "" {
+		return zap.DebugLevel
+	}
+	lv, err := zapcore.ParseLevel(level)
+	if err != nil {
+		fmt.Printf("[WARN] invalid log level %s, using debug instead\n", level)
+		return zap.DebugLevel
+	}
+	return lv
 }
 
 func customTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
@@ -90,141 +164,92 @@ func customLevelEncoderWithoutColor(l zapcore.Level, enc zapcore.PrimitiveArrayE
 	enc.AppendString(level)
 }
 
-func setupLogFile(r string) (*os.File, error) {
-	logPath := filepath.Join(r, "latest.log")
-
-	if utils.IsFileExists(logPath) {
-		// format current time
-		timestamp := time.Now().Format("2006_01_02_15_04_05")
-		backupName := fmt.Sprintf("log_%s.log", timestamp)
-		backupPath := filepath.Join(r, backupName)
-
-		// rename file latest.log → log_yyyy_MM_dd_HH_mm_ss.log
-		if err := os.Rename(logPath, backupPath); err != nil {
-			return nil, fmt.Errorf("log rotate failed: %w", err)
-		}
-	}
-
-	if AppConfig.AutoCleanOldLogs {
-		err := cleanUpOldLogs(r, AppConfig.MaxLogFiles, AppConfig.CleanUpAmount)
-		if err != nil {
-			fmt.Printf("[WARN] remove old logs failed, err:%v\n", err)
-		}
-	}
-
-	// open new log file: latest.log
-	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open log: %w", err)
-	}
-	return logFile, nil
-}
-
-type fileInfoWithPath struct {
-	path string
-	info fs.FileInfo
-}
-
-func cleanUpOldLogs(dir string, maxFiles, deleteCount int) error {
-	var files []fileInfoWithPath
-
-	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			files = append(files, fileInfoWithPath{path: path, info: info})
-		}
-		return nil
-	})
-	if err != nil {
-		return err
+func newEncoder(format string, levelEncoder zapcore.LevelEncoder) zapcore.Encoder {
+	if format == "json" {
+		cfg := zap.NewProductionEncoderConfig()
+		cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+		return zapcore.NewJSONEncoder(cfg)
 	}
-
-	if len(files) <= maxFiles {
-		return nil
-	}
-
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	return zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+		TimeKey:        "T",
+		LevelKey:       "L",
+		NameKey:        "N",
+		CallerKey:      "",
+		MessageKey:     "M",
+		EncodeTime:     customTimeEncoder,
+		EncodeLevel:    levelEncoder,
+		EncodeName:     zapcore.FullNameEncoder,
+		EncodeDuration: zapcore.SecondsDurationEncoder,
 	})
+}
 
-	toDelete := len(files) - maxFiles
-	if toDelete > deleteCount {
-		toDelete = deleteCount
-	}
-
-	for i := 0; i < toDelete; i++ {
-		//fmt.Println("deleting :", files[i].path)
-		_ = os.Remove(files[i].path)
+// newZapLogger builds a zap logger over every sink, module's override level
+// takes the place of the sink's level when present
+func newZapLogger(module string) *zap.Logger {
+	cores := make([]zapcore.Core, 0, len(logSinks))
+	for _, sink := range logSinks {
+		s := sink
+		enabler := zap.LevelEnablerFunc(func(l zapcore.Level) bool {
+			if module != "" {
+				if lv, ok := moduleLevels.Load(module); ok {
+					return l >= lv.(zapcore.Level)
+				}
+			}
+			return s.level.Enabled(l)
+		})
+		cores = append(cores, zapcore.NewCore(s.encoder, s.ws, enabler))
 	}
-
-	return nil
+	return zap.New(zapcore.NewTee(cores...), zap.AddCaller(), zap.AddCallerSkip(1))
 }
 
 func createLogger() *Logger {
+	cfg := &AppConfig.Log
+	logSinks = []*logSink{{
+		name:    "console",
+		encoder: newEncoder(cfg.ConsoleFormat, customLevelEncoder),
+		ws:      zapcore.Lock(os.Stdout),
+		level:   zap.NewAtomicLevelAt(parseLogLevel(cfg.ConsoleLevel)),
+	}}
+
 	r, s := GetSubDir("logs")
-	var logFile *os.File
 	if s && AppConfig.RecordLog {
-		var err error
-		logFile, err = setupLogFile(r)
+		w, err := newRotateWriter(r, cfg)
 		if err != nil {
 			fmt.Println("[ERROR] Failed to create latest.log for logger", err)
+		} else {
+			logSinks = append(logSinks, &logSink{
+				name:    "file",
+				encoder: newEncoder(cfg.FileFormat, customLevelEncoderWithoutColor),
+				ws:      w,
+				level:   zap.NewAtomicLevelAt(parseLogLevel(cfg.FileLevel)),
+			})
 		}
-	} else {
-		s = false
 	}
 
-	encoderCfg := zapcore.EncoderConfig{
-		TimeKey:        "T",
-		LevelKey:       "L",
-		NameKey:        "N",
-		CallerKey:      "",
-		MessageKey:     "M",
-		EncodeTime:     customTimeEncoder,
-		EncodeLevel:    customLevelEncoder,
-		EncodeName:     zapcore.FullNameEncoder,
-		EncodeDuration: zapcore.SecondsDurationEncoder,
-	}
+	// in-memory sink for the admin console, follows console level
+	logSinks = append(logSinks, &logSink{
+		name:    "web",
+		encoder: newEncoder("json", customLevelEncoderWithoutColor),
+		ws:      webLogs,
+		level:   zap.NewAtomicLevelAt(parseLogLevel(cfg.ConsoleLevel)),
+	})
 
-	consoleEncoder := zapcore.NewConsoleEncoder(encoderCfg)
-	consoleWS := zapcore.Lock(os.Stdout)
-
-	if s {
-		encoderCfgForFile := zapcore.EncoderConfig{
-			TimeKey:        "T",
-			LevelKey:       "L",
-			NameKey:        "N",
-			CallerKey:      "",
-			MessageKey:     "M",
-			EncodeTime:     customTimeEncoder,
-			EncodeLevel:    customLevelEncoderWithoutColor,
-			EncodeName:     zapcore.FullNameEncoder,
-			EncodeDuration: zapcore.SecondsDurationEncoder,
+	for module, level := range cfg.ModuleLevels {
+		if err := SetLogLevel(module, level); err != nil {
+			fmt.Printf("[WARN] invalid log level %s of module %s\n", level, module)
 		}
+	}
 
-		fileEncoder := zapcore.NewConsoleEncoder(encoderCfgForFile) // json encoder, use default config
-		fileWS := zapcore.AddSync(logFile)
-
-		core := zapcore.NewTee(
-			zapcore.NewCore(consoleEncoder, consoleWS, zap.DebugLevel),
-			zapcore.NewCore(fileEncoder, fileWS, zap.DebugLevel),
-		)
+	return &Logger{
+		logger: newZapLogger("").Named("bot"),
+		name:   "bot",
+	}
+}
 
-		logger := zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
-		realLogger := &Logger{
-			logger: logger.Named("bot"),
-		}
-		return realLogger
-	} else {
-		core := zapcore.NewTee(
-			zapcore.NewCore(consoleEncoder, consoleWS, zap.DebugLevel),
-		)
-
-		logger := zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
-		realLogger := &Logger{
-			logger: logger.Named("bot"),
-		}
-		return realLogger
+// syncLogger flushes every sink, should be called before exit
+func syncLogger() {
+	for _, sink := range logSinks {
+		// stdout may not support sync, ignore it
+		_ = sink.ws.Sync()
 	}
 }
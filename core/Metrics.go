@@ -0,0 +1,337 @@
+package core
+
+import (
+	"fmt"
+	zero "marmot/onebot"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A tiny prometheus compatible registry, only counters, gauges and histograms
+// with text exposition format are supported.
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	write(sb *strings.Builder)
+}
+
+type MetricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+	names   []string
+}
+
+var Metrics = &MetricsRegistry{
+	metrics: make(map[string]metric),
+}
+
+func (r *MetricsRegistry) register(name string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.metrics[name]; ok {
+		return old
+	}
+	r.metrics[name] = m
+	r.names = append(r.names, name)
+	sort.Strings(r.names)
+	return m
+}
+
+// Write renders every metric in prometheus text format
+func (r *MetricsRegistry) Write() string {
+	r.mu.Lock()
+	items := make([]metric, 0, len(r.names))
+	for _, n := range r.names {
+		items = append(items, r.metrics[n])
+	}
+	r.mu.Unlock()
+
+	sb := strings.Builder{}
+	for _, m := range items {
+		m.write(&sb)
+	}
+	return sb.String()
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(r.Write()))
+}
+
+// labelKey joins label values, \xff never shows in valid utf-8
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	sb := strings.Builder{}
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		sb.WriteString(n)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(v))
+		sb.WriteByte('"')
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extra[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(extra[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(sb *strings.Builder, name, help, tp string) {
+	sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, tp))
+}
+
+// CounterVec is a monotonically increasing value per label set
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values sync.Map // labelKey -> *counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      atomic.Uint64
+}
+
+func (r *MetricsRegistry) Counter(name, help string, labels ...string) *CounterVec {
+	return r.register(name, &CounterVec{name: name, help: help, labels: labels}).(*CounterVec)
+}
+
+func (c *CounterVec) Add(delta uint64, labelValues ...string) {
+	key := labelKey(labelValues)
+	v, ok := c.values.Load(key)
+	if !ok {
+		v, _ = c.values.LoadOrStore(key, &counterValue{labels: labelValues})
+	}
+	v.(*counterValue).v.Add(delta)
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(sb *strings.Builder) {
+	writeHeader(sb, c.name, c.help, "counter")
+	c.values.Range(func(_, value any) bool {
+		v := value.(*counterValue)
+		sb.WriteString(c.name + formatLabels(c.labels, v.labels) + " " + strconv.FormatUint(v.v.Load(), 10) + "\n")
+		return true
+	})
+}
+
+// GaugeFunc samples its value on every scrape
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	funcs  map[string]gaugeSample
+}
+
+type gaugeSample struct {
+	labels []string
+	fn     func() float64
+}
+
+func (r *MetricsRegistry) Gauge(name, help string, labels ...string) *GaugeFunc {
+	return r.register(name, &GaugeFunc{name: name, help: help, labels: labels, funcs: make(map[string]gaugeSample)}).(*GaugeFunc)
+}
+
+// Set binds fn to the label set, replacing the previous one
+func (g *GaugeFunc) Set(fn func() float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.funcs[labelKey(labelValues)] = gaugeSample{labels: labelValues, fn: fn}
+}
+
+func (g *GaugeFunc) Remove(labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.funcs, labelKey(labelValues))
+}
+
+func (g *GaugeFunc) write(sb *strings.Builder) {
+	g.mu.Lock()
+	samples := make([]gaugeSample, 0, len(g.funcs))
+	for _, s := range g.funcs {
+		samples = append(samples, s)
+	}
+	g.mu.Unlock()
+
+	writeHeader(sb, g.name, g.help, "gauge")
+	for _, s := range samples {
+		sb.WriteString(g.name + formatLabels(g.labels, s.labels) + " " + formatFloat(s.fn()) + "\n")
+	}
+}
+
+// HistogramVec tracks distributions of observed values (seconds for latency)
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  sync.Map // labelKey -> *histogramValue
+}
+
+type histogramValue struct {
+	mu     sync.Mutex
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = defaultBuckets
+	}
+	return r.register(name, &HistogramVec{name: name, help: help, labels: labels, buckets: buckets}).(*HistogramVec)
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	val, ok := h.values.Load(key)
+	if !ok {
+		val, _ = h.values.LoadOrStore(key, &histogramValue{labels: labelValues, counts: make([]uint64, len(h.buckets))})
+	}
+	hv := val.(*histogramValue)
+	hv.mu.Lock()
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+	hv.mu.Unlock()
+}
+
+func (h *HistogramVec) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(sb *strings.Builder) {
+	writeHeader(sb, h.name, h.help, "histogram")
+	h.values.Range(func(_, value any) bool {
+		hv := value.(*histogramValue)
+		hv.mu.Lock()
+		defer hv.mu.Unlock()
+		for i, b := range h.buckets {
+			sb.WriteString(h.name + "_bucket" + formatLabels(h.labels, hv.labels, "le", formatFloat(b)) + " " + strconv.FormatUint(hv.counts[i], 10) + "\n")
+		}
+		sb.WriteString(h.name + "_bucket" + formatLabels(h.labels, hv.labels, "le", "+Inf") + " " + strconv.FormatUint(hv.count, 10) + "\n")
+		sb.WriteString(h.name + "_sum" + formatLabels(h.labels, hv.labels) + " " + formatFloat(hv.sum) + "\n")
+		sb.WriteString(h.name + "_count" + formatLabels(h.labels, hv.labels) + " " + strconv.FormatUint(hv.count, 10) + "\n")
+		return true
+	})
+}
+
+// QueueStats is implemented by utils.RingQueue
+type QueueStats interface {
+	Len() int
+	Cap() int
+	Dropped() uint64
+}
+
+var (
+	metricEvents        = Metrics.Counter("marmot_events_total", "Events dispatched to modules by type.", "type")
+	metricPanics        = Metrics.Counter("marmot_module_panics_total", "Panics recovered in module handlers.", "module")
+	metricCommands      = Metrics.Counter("marmot_commands_total", "Commands invoked by result.", "command", "result")
+	metricAPICalls      = Metrics.Histogram("marmot_api_call_seconds", "Latency of OneBot api calls.", nil, "action")
+	metricAPIErrors     = Metrics.Counter("marmot_api_call_failures_total", "Failed OneBot api calls.", "action")
+	metricWsConnects    = Metrics.Counter("marmot_ws_connections_total", "WebSocket connection events by kind.", "kind")
+	metricRingOverflows = Metrics.Counter("marmot_event_ring_overflows_total", "Events arriving at a full event ring by policy.", "policy")
+	metricQueueLen      = Metrics.Gauge("marmot_queue_length", "Current length of internal queues.", "queue")
+	metricQueueCap      = Metrics.Gauge("marmot_queue_capacity", "Capacity of internal queues.", "queue")
+	metricQueueDrops    = Metrics.Gauge("marmot_queue_dropped", "Items rejected by full internal queues.", "queue")
+	metricStartTime     = Metrics.Gauge("marmot_start_time_seconds", "Start time of the process since unix epoch.")
+)
+
+var queueStats sync.Map // name -> QueueStats
+
+// RegisterQueueMetrics exposes length, capacity and drops of q under name
+func RegisterQueueMetrics(name string, q QueueStats) {
+	queueStats.Store(name, q)
+	metricQueueLen.Set(func() float64 { return float64(q.Len()) }, name)
+	metricQueueCap.Set(func() float64 { return float64(q.Cap()) }, name)
+	metricQueueDrops.Set(func() float64 { return float64(q.Dropped()) }, name)
+}
+
+func RemoveQueueMetrics(name string) {
+	queueStats.Delete(name)
+	metricQueueLen.Remove(name)
+	metricQueueCap.Remove(name)
+	metricQueueDrops.Remove(name)
+}
+
+// metricsObserver receives api/connection events from onebot
+type metricsObserver struct{}
+
+var _ zero.IObserver = metricsObserver{}
+
+func (metricsObserver) OnAPICall(action string, elapsed time.Duration, err error) {
+	metricAPICalls.ObserveDuration(elapsed, action)
+	if err != nil {
+		metricAPIErrors.Inc(action)
+	}
+}
+
+func (metricsObserver) OnConnect(_ int64) {
+	metricWsConnects.Inc("connect")
+}
+
+func (metricsObserver) OnDisconnect(_ int64) {
+	metricWsConnects.Inc("disconnect")
+}
+
+func (metricsObserver) OnEventOverflow(policy string) {
+	metricRingOverflows.Inc(policy)
+}
+
+func NewMetricsObserver() zero.IObserver {
+	return metricsObserver{}
+}
+
+func init() {
+	start := float64(time.Now().Unix())
+	metricStartTime.Set(func() float64 { return start })
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MigrationFunc func(tx *gorm.DB) error
+
+// Migration is a single named schema step of a module.
+// Either Up/Down funcs or UpSQL/DownSQL statements can be provided,
+// funcs take priority when both are set.
+type Migration struct {
+	Name    string
+	Up      MigrationFunc
+	Down    MigrationFunc
+	UpSQL   string
+	DownSQL string
+}
+
+// SchemaMigration records an applied migration in `schema_migrations`
+type SchemaMigration struct {
+	Id        int64  `gorm:"primaryKey"`
+	Module    string `gorm:"index:idx_schema_module_version,unique"`
+	Version   int    `gorm:"index:idx_schema_module_version,unique"`
+	Name      string
+	AppliedAt int64
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type MigrationStatus struct {
+	Module    string
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt int64
+}
+
+var (
+	migrations   = make(map[string][]Migration)
+	migrationsMu sync.Mutex
+)
+
+// RegisterMigrations appends ordered migrations for module, version of each
+// migration is its position in the registration order (starting from 1).
+// Should be called in the module's init() next to RegisterNamed.
+//
+// Applied migrations are never run again, so a migration must not change
+// once released and must not depend on the current model structs (e.g.
+// AutoMigrate(&Model{})), use explicit DDL instead. Changing the schema of a
+// model means registering a new migration after the existing ones.
+func RegisterMigrations(module string, items ...Migration) {
+	module = strings.ToLower(strings.TrimSpace(module))
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	migrations[module] = append(migrations[module], items...)
+}
+
+func getMigrations(module string) []Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	return migrations[module]
+}
+
+// MigrationModules lists every module that registered migrations
+func MigrationModules() []string {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	result := make([]string, 0, len(migrations))
+	for k := range migrations {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (db *DbCtx) ensureMigrationTable() error {
+	if db == nil || db.Db == nil {
+		return errors.New("database not init")
+	}
+	return db.Db.AutoMigrate(&SchemaMigration{})
+}
+
+func (db *DbCtx) appliedMigrations(module string) (map[int]SchemaMigration, error) {
+	var items []SchemaMigration
+	r := db.Db.Where("module = ?", module).Order("version").Find(&items)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	result := make(map[int]SchemaMigration, len(items))
+	for _, item := range items {
+		result[item.Version] = item
+	}
+	return result, nil
+}
+
+func runMigrationStep(tx *gorm.DB, fn MigrationFunc, sql string) error {
+	if fn != nil {
+		return fn(tx)
+	}
+	if sql != "" {
+		return tx.Exec(sql).Error
+	}
+	return nil
+}
+
+// Migrate applies every pending migration of module in order,
+// each migration runs inside its own transaction.
+func (db *DbCtx) Migrate(module string) error {
+	module = strings.ToLower(strings.TrimSpace(module))
+	items := getMigrations(module)
+	if len(items) == 0 {
+		return nil
+	}
+	if err := db.ensureMigrationTable(); err != nil {
+		return err
+	}
+
+	applied, err := db.appliedMigrations(module)
+	if err != nil {
+		return err
+	}
+
+	for idx, item := range items {
+		version := idx + 1
+		if rec, ok := applied[version]; ok {
+			if rec.Name != item.Name {
+				LogWarn("[Db] migration %s#%d was applied as '%s' but is now registered as '%s'", module, version, rec.Name, item.Name)
+			}
+			continue
+		}
+
+		err := db.Db.Transaction(func(tx *gorm.DB) error {
+			if err := runMigrationStep(tx, item.Up, item.UpSQL); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Module:    module,
+				Version:   version,
+				Name:      item.Name,
+				AppliedAt: time.Now().Unix(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s#%d (%s) failed: %w", module, version, item.Name, err)
+		}
+		LogInfo("[Db] applied migration %s#%d (%s)", module, version, item.Name)
+	}
+	return nil
+}
+
+// Rollback reverts the latest applied migration of module
+func (db *DbCtx) Rollback(module string) (*SchemaMigration, error) {
+	module = strings.ToLower(strings.TrimSpace(module))
+	if err := db.ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+
+	var last SchemaMigration
+	r := db.Db.Where("module = ?", module).Order("version desc").First(&last)
+	if r.Error != nil {
+		if errors.Is(r.Error, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("no applied migration for module %s", module)
+		}
+		return nil, r.Error
+	}
+
+	items := getMigrations(module)
+	if last.Version > len(items) {
+		return nil, fmt.Errorf("migration %s#%d (%s) is not registered", module, last.Version, last.Name)
+	}
+	item := items[last.Version-1]
+	if item.Down == nil && item.DownSQL == "" {
+		return nil, fmt.Errorf("migration %s#%d (%s) is irreversible", module, last.Version, last.Name)
+	}
+
+	err := db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := runMigrationStep(tx, item.Down, item.DownSQL); err != nil {
+			return err
+		}
+		return tx.Delete(&last).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rollback %s#%d (%s) failed: %w", module, last.Version, last.Name, err)
+	}
+	LogInfo("[Db] rolled back migration %s#%d (%s)", module, last.Version, last.Name)
+	return &last, nil
+}
+
+// MigrationStatus returns every registered migration of module with its applied state
+func (db *DbCtx) MigrationStatus(module string) ([]MigrationStatus, error) {
+	module = strings.ToLower(strings.TrimSpace(module))
+	if err := db.ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+	applied, err := db.appliedMigrations(module)
+	if err != nil {
+		return nil, err
+	}
+
+	items := getMigrations(module)
+	result := make([]MigrationStatus, 0, len(items))
+	for idx, item := range items {
+		st := MigrationStatus{
+			Module:  module,
+			Version: idx + 1,
+			Name:    item.Name,
+		}
+		if rec, ok := applied[st.Version]; ok {
+			st.Applied = true
+			st.AppliedAt = rec.AppliedAt
+		}
+		result = append(result, st)
+	}
+	return result, nil
+}
@@ -0,0 +1,241 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	osyaml "gopkg.in/yaml.v3"
+	zero "marmot/onebot"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IValidator is implemented by configs which need checks beyond yaml decoding
+type IValidator interface {
+	Validate() error
+}
+
+type moduleConfig struct {
+	file    string
+	factory func() any
+}
+
+var (
+	moduleConfigs = make(map[string]moduleConfig)
+	reloadLock    sync.Mutex // serializes reloads of modules
+)
+
+var ErrNoModuleConfig = errors.New("module has no registered config")
+
+// RegisterModuleConfig declares the config file of module (relative to bot/),
+// factory returns a pointer to an empty config used for validation
+func RegisterModuleConfig(module string, file string, factory func() any) {
+	module = strings.ToLower(strings.TrimSpace(module))
+	moduleConfigs[module] = moduleConfig{file: file, factory: factory}
+}
+
+// RegisteredModules lists every module known by the registry
+func RegisteredModules() []string {
+	result := make([]string, 0, len(registry))
+	for name := range registry {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func HasModuleConfig(module string) bool {
+	_, ok := moduleConfigs[strings.ToLower(strings.TrimSpace(module))]
+	return ok
+}
+
+// ReadModuleConfig returns the file name and raw yaml of module's config
+func ReadModuleConfig(module string) (string, string, error) {
+	cfg, ok := moduleConfigs[strings.ToLower(strings.TrimSpace(module))]
+	if !ok {
+		return "", "", ErrNoModuleConfig
+	}
+	data, err := os.ReadFile(GetSubDirFilePath(cfg.file))
+	if err != nil && !os.IsNotExist(err) {
+		return cfg.file, "", err
+	}
+	return cfg.file, string(data), nil
+}
+
+// ValidateModuleConfig decodes content into module's config struct, unknown
+// keys are rejected and IValidator is checked when implemented
+func ValidateModuleConfig(module string, content string) error {
+	cfg, ok := moduleConfigs[strings.ToLower(strings.TrimSpace(module))]
+	if !ok {
+		return ErrNoModuleConfig
+	}
+	target := cfg.factory()
+	dec := osyaml.NewDecoder(bytes.NewReader([]byte(content)))
+	dec.KnownFields(true)
+	if err := dec.Decode(target); err != nil {
+		return fmt.Errorf("invalid yaml: %w", err)
+	}
+	if v, ok := target.(IValidator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// UpdateModuleConfig validates and writes the config of module, the module
+// is reloaded so its Stop can not overwrite the new file with stale data
+func (m *ModuleMgr) UpdateModuleConfig(module string, content string) error {
+	if err := ValidateModuleConfig(module, content); err != nil {
+		return err
+	}
+	cfg := moduleConfigs[strings.ToLower(strings.TrimSpace(module))]
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	m.UnloadAll()
+	err := os.WriteFile(GetSubDirFilePath(cfg.file), []byte(content), 0644)
+	m.LoadAll()
+	return err
+}
+
+// Reload unloads and loads every module
+func (m *ModuleMgr) Reload() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	m.UnloadAll()
+	m.LoadAll()
+}
+
+// SetModuleEnabled adds or removes module from `modules` in config.yml and reloads
+func (m *ModuleMgr) SetModuleEnabled(module string, enabled bool) error {
+	module = strings.ToLower(strings.TrimSpace(module))
+	if _, ok := registry[module]; !ok {
+		return fmt.Errorf("module %s not found", module)
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	modules := make([]string, 0, len(AppConfig.Modules)+1)
+	found := false
+	for _, name := range AppConfig.Modules {
+		if strings.ToLower(strings.TrimSpace(name)) == module {
+			found = true
+			if !enabled {
+				continue
+			}
+		}
+		modules = append(modules, name)
+	}
+	if enabled && !found {
+		modules = append(modules, module)
+	}
+	if len(modules) == len(AppConfig.Modules) && found == enabled {
+		return nil
+	}
+
+	m.UnloadAll()
+	AppConfig.Modules = modules
+	err := SaveCustomConfigToFile(GetSubDirFilePath("config.yml"), AppConfig)
+	m.LoadAll()
+	return err
+}
+
+// WriteDefaultModuleConfigs writes the default config of every registered
+// module whose file does not exist yet, the written files are returned
+func WriteDefaultModuleConfigs() ([]string, error) {
+	names := make([]string, 0, len(moduleConfigs))
+	for name := range moduleConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var written []string
+	for _, name := range names {
+		cfg := moduleConfigs[name]
+		if IsSubDirFileExist(cfg.file) {
+			continue
+		}
+		target, ok := cfg.factory().(IConfig)
+		if !ok {
+			continue
+		}
+		data, err := osyaml.Marshal(target.CreateDefaultConfig())
+		if err != nil {
+			return written, fmt.Errorf("failed to encode default config of %s: %w", name, err)
+		}
+		if err := os.WriteFile(GetSubDirFilePath(cfg.file), data, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, cfg.file)
+	}
+	return written, nil
+}
+
+// ValidateConfigs checks config.yml and the configs of enabled modules,
+// one error is returned for every problem found
+func ValidateConfigs() []error {
+	var errs []error
+	data, err := os.ReadFile(GetSubDirFilePath("config.yml"))
+	if err != nil {
+		return append(errs, err)
+	}
+	cfg := &GlobalConfig{}
+	dec := osyaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return append(errs, fmt.Errorf("config.yml: invalid yaml: %w", err))
+	}
+
+	durations := map[string]string{
+		"cmd_cooldown":     cfg.CmdCoolDown,
+		"backup_interval":  cfg.BackupInterval,
+		"shutdown_timeout": cfg.ShutdownTimeout,
+		"event_dedup":      cfg.EventDedup,
+		"max_process_time": cfg.MaxProcessTime,
+		"event_latency":    cfg.EventLatency,
+	}
+	keys := make([]string, 0, len(durations))
+	for key := range durations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if durations[key] == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(durations[key]); err != nil {
+			errs = append(errs, fmt.Errorf("config.yml: %s: %w", key, err))
+		}
+	}
+
+	switch cfg.RingPolicy {
+	case "", zero.RingDropOldest, zero.RingBlock, zero.RingSpill:
+	default:
+		errs = append(errs, fmt.Errorf("config.yml: ring_policy: unknown policy %s", cfg.RingPolicy))
+	}
+
+	for _, module := range cfg.Modules {
+		module = strings.ToLower(strings.TrimSpace(module))
+		if _, ok := registry[module]; !ok {
+			errs = append(errs, fmt.Errorf("config.yml: unknown module %s", module))
+			continue
+		}
+		if !HasModuleConfig(module) {
+			continue
+		}
+		file, content, err := ReadModuleConfig(module)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		if content == "" {
+			continue // created with defaults on first load
+		}
+		if err := ValidateModuleConfig(module, content); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+		}
+	}
+	return errs
+}
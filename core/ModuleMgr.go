@@ -1,25 +1,45 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	zero "marmot/onebot"
 	"marmot/onebot/message"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type IModule interface {
 	Init(mgr *ModuleMgr) bool
-	Stop(mgr *ModuleMgr)
+	// Stop releases the module, ctx is the root context of the bot and is
+	// already cancelled when the bot is shutting down
+	Stop(ctx context.Context, mgr *ModuleMgr)
 	Reload(mgr *ModuleMgr)
 }
 
-var registry = make(map[string]func() IModule)
+var (
+	registry     = make(map[string]func() IModule)
+	descriptions = make(map[string]string)
+)
 
 func RegisterNamed(name string, initFunc func() IModule) {
 	name = strings.ToLower(strings.TrimSpace(name))
 	registry[name] = initFunc
 }
 
+// DescribeModule sets the one line description shown by "marmot modules list"
+func DescribeModule(name string, description string) {
+	descriptions[strings.ToLower(strings.TrimSpace(name))] = description
+}
+
+func ModuleDescription(name string) string {
+	return descriptions[strings.ToLower(strings.TrimSpace(name))]
+}
+
 func createModule(name string) IModule {
 	name = strings.ToLower(strings.TrimSpace(name))
 	if f, ok := registry[name]; ok {
@@ -37,19 +57,90 @@ const (
 	ETGroupQuit
 	ETGroupJoin
 	ETGroupRequestJoin
+	ETBotOffline // heartbeats of the account stopped, its connection dropped or the adapter reports it offline
+	ETBotOnline  // the account is usable again after ETBotOffline
 )
 
+func (t EventType) String() string {
+	switch t {
+	case ETGroupMsg:
+		return "group_msg"
+	case ETPrivateMsg:
+		return "private_msg"
+	case ETGroupQuit:
+		return "group_quit"
+	case ETGroupJoin:
+		return "group_join"
+	case ETGroupRequestJoin:
+		return "group_request_join"
+	case ETBotOffline:
+		return "bot_offline"
+	case ETBotOnline:
+		return "bot_online"
+	default:
+		return "unknown"
+	}
+}
+
 type EventHandler func(ctx *zero.Ctx)
 type Event struct {
 	Type    EventType
 	Handler EventHandler
 	Moduel  *IModule
+	Module  string // name of the registering module
+}
+
+// routes is what HandleEvent dispatches to. LoadAll publishes it once every
+// module registered, so readers never see the maps while they are filled.
+type routes struct {
+	events map[EventType][]Event
+	cmd    *CmdMgr // nil while no module is loaded
+
+	mu      sync.Mutex
+	retired bool
+	running sync.WaitGroup // handlers started from these routes
+}
+
+// begin reports whether a handler of the routes may still start, Done of
+// running must be called once it returned
+func (r *routes) begin() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retired {
+		return false
+	}
+	r.running.Add(1)
+	return true
+}
+
+// retire keeps queued handlers from starting and waits at most timeout for
+// the running ones, so modules are not stopped under them
+func (r *routes) retire(timeout time.Duration) bool {
+	r.mu.Lock()
+	r.retired = true
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 type ModuleMgr struct {
 	loadedModules map[string]IModule
-	events        map[EventType][]Event
+	mu            sync.RWMutex          // guards loadedModules against readers outside the bot loop
+	events        map[EventType][]Event // filled by LoadAll, published through routes
 	cmd           *CmdMgr
+	routes        atomic.Pointer[routes]
+	pool          *workerPool
+	loading       string // name of the module running Init
 }
 
 var sharedInstance *ModuleMgr
@@ -63,14 +154,39 @@ func NewModuleMgr() *ModuleMgr {
 		loadedModules: make(map[string]IModule),
 		events:        make(map[EventType][]Event),
 		cmd:           newCmdMgr(),
+		pool:          sharedWorkerPool(),
 	}
+	sharedInstance.routes.Store(&routes{})
 	return sharedInstance
 }
 
+// commands returns the published commands, nil while modules are reloaded
+func (m *ModuleMgr) commands() *CmdMgr {
+	return m.routes.Load().cmd
+}
+
 func (m *ModuleMgr) RegisterCmd() *CmdMgr {
 	return m.cmd
 }
 
+// Storage returns the kv store isolated to module, the namespace is the
+// module's registered name (or the one being initialized by LoadAll)
+func (m *ModuleMgr) Storage(module IModule) *KvStore {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, loaded := range m.loadedModules {
+		if loaded == module {
+			return GetKvStore(name)
+		}
+	}
+	if m.loading == "" {
+		LogWarn("[Bot] Storage() called by an unknown module, using shared namespace")
+		return GetKvStore("shared")
+	}
+	return GetKvStore(m.loading)
+}
+
+// RegisterEvent adds a handler of tp, it must be called from IModule.Init
 func (m *ModuleMgr) RegisterEvent(tp EventType, handler EventHandler) bool {
 	arr, ok := m.events[tp]
 	if !ok {
@@ -85,25 +201,46 @@ func (m *ModuleMgr) RegisterEvent(tp EventType, handler EventHandler) bool {
 	m.events[tp] = append(arr, Event{
 		Type:    tp,
 		Handler: handler,
+		Module:  m.loading,
 	})
 	return true
 }
 
 func (m *ModuleMgr) UnloadAll() {
 	LogInfo("[Bot] Unloading all modules...")
+	// stopped modules must not get new events or run under handlers
+	if old := m.routes.Swap(&routes{}); !old.retire(shutdownTimeout()) {
+		LogWarn("[Bot] handlers are still running after %s, stopping modules anyway", shutdownTimeout())
+	}
 	for _, module := range m.loadedModules {
-		module.Stop(m)
+		module.Stop(Context(), m)
 	}
 	m.events = make(map[EventType][]Event)
+	m.mu.Lock()
 	m.loadedModules = make(map[string]IModule)
+	m.mu.Unlock()
+	old := m.cmd
 	m.cmd = newCmdMgr()
+	old.close()
 }
 
 func (m *ModuleMgr) HandleEvent(c *zero.Ctx) {
+	if !accepting.Load() {
+		return
+	}
 	var msgType EventType
+	rt := m.routes.Load()
 	if c.Event.PostType == "message" && c.Event.MessageType == "group" {
 		if strings.HasPrefix(c.Event.RawMessage, AppConfig.CmdPrefix) {
-			m.cmd.OnCmd(c)
+			metricEvents.Inc("command")
+			if rt.cmd == nil {
+				return
+			}
+			if AppConfig.SequentialDispatch { // ordered with the other events of the group
+				rt.cmd.OnCmdInOrder(c)
+				return
+			}
+			rt.cmd.OnCmd(c)
 			return
 		} else {
 			msgType = ETGroupMsg
@@ -116,18 +253,51 @@ func (m *ModuleMgr) HandleEvent(c *zero.Ctx) {
 		}
 	} else if c.Event.PostType == "message" && c.Event.MessageType == "private" {
 		msgType = ETPrivateMsg
+	} else if c.Event.PostType == "meta_event" && c.Event.RawEvent.Get("meta_event_type").Str == zero.MetaBotStatus {
+		msgType = ETBotOnline
+		if c.Event.SubType == "offline" {
+			msgType = ETBotOffline
+		}
+		notifyBotStatus(c)
 	} else {
 		msgType = ETUnknown
 	}
 
-	r, ok := m.events[msgType]
+	metricEvents.Inc(msgType.String())
+	r, ok := rt.events[msgType]
 	if ok {
 		for _, event := range r {
-			go event.Handler(c)
+			if !BeginTask() {
+				return
+			}
+			if AppConfig.SequentialDispatch { // the conversation waits for its handlers
+				m.pool.await(event, c, rt)
+				continue
+			}
+			m.pool.submit(event, c, rt)
 		}
 	}
 }
 
+// invokeHandler runs the handler and recovers from its panic, so a broken
+// module can not take the whole bot down, log is the handlerLogger of event
+func (m *ModuleMgr) invokeHandler(event Event, c *zero.Ctx, log *Logger) {
+	begin := time.Now()
+	defer EndTask()
+	defer func() {
+		metricHandlerTime.ObserveDuration(time.Since(begin), event.Module)
+		if r := recover(); r != nil {
+			module := event.Module
+			if module == "" {
+				module = "unknown"
+			}
+			metricPanics.Inc(module)
+			log.Error("[Bot] module %s panicked while handling %s: %v", module, event.Type, r)
+		}
+	}()
+	event.Handler(c)
+}
+
 func (m *ModuleMgr) GetModule(key string) *IModule {
 	key = strings.ToLower(strings.TrimSpace(key))
 	if f, ok := m.loadedModules[key]; ok {
@@ -141,35 +311,204 @@ func (m *ModuleMgr) LoadAll() {
 	m.registerInternalCmds()
 	for _, module := range AppConfig.Modules {
 		LogDebug("[Bot] loading module %v/%v : %s", count, len(AppConfig.Modules), module)
+		// migrate before creating, module constructors may already query their tables
+		if err := Common.Database.Migrate(module); err != nil {
+			LogError("[Bot] failed to load module : %s , %v", module, err)
+			continue
+		}
 		r := createModule(module)
 		if r == nil {
 			LogWarn("[Bot] failed to load module : %s , not found or invalid key", module)
 			continue
 		}
-		if !r.Init(m) {
+		m.loading = strings.ToLower(strings.TrimSpace(module))
+		m.cmd.module = m.loading
+		ok := r.Init(m)
+		m.loading = ""
+		m.cmd.module = ""
+		if !ok {
 			LogError("[Bot] failed to load module : %s , init failed", module)
 			continue
 		}
+		m.mu.Lock()
 		m.loadedModules[module] = r
+		m.mu.Unlock()
 		count++
 	}
+	m.routes.Store(&routes{events: m.events, cmd: m.cmd})
 	LogInfo("[Bot] loaded %d modules", count-1)
 }
 
 func (m *ModuleMgr) registerInternalCmds() {
 	m.cmd.RegisterGroupAdmin("reload", m.reloadCmdInternal)
+	m.cmd.RegisterBotAdmin("migrate", m.migrateCmdInternal)
+	m.cmd.RegisterBotAdmin("backup", m.backupCmdInternal)
+	m.cmd.RegisterBotAdmin("loglevel", m.logLevelCmdInternal)
+	m.cmd.RegisterBotAdmin("status", m.statusCmdInternal)
 }
 
 func (m *ModuleMgr) reloadCmdInternal(_ []string, c *zero.Ctx) {
 	beginTime := time.Now().UnixNano()
-	m.UnloadAll()
-	m.LoadAll()
+	m.Reload()
 	durSecs := time.Now().UnixNano() - beginTime
 	LogInfo("[Bot] Hot reload done in %v seconds", time.Duration(durSecs).Seconds())
 	c.SendGroupMessage(c.Event.GroupID, MakeReply(message.Text("热重载完毕 耗时(s) "), message.Text(time.Duration(durSecs).Seconds())))
 }
 
+func (m *ModuleMgr) migrateCmdInternal(args []string, c *zero.Ctx) {
+	if len(args) == 0 || (args[0] != "status" && args[0] != "rollback") {
+		c.Send("使用方法 migrate status [module] / migrate rollback [module]")
+		return
+	}
+
+	if args[0] == "rollback" {
+		if len(args) != 2 {
+			c.Send("使用方法 migrate rollback [module]")
+			return
+		}
+		r, err := Common.Database.Rollback(args[1])
+		if err != nil {
+			c.Send(fmt.Sprintf("回滚失败 %v", err))
+			return
+		}
+		c.Send(fmt.Sprintf("已回滚 %s#%d (%s)", r.Module, r.Version, r.Name))
+		return
+	}
+
+	modules := MigrationModules()
+	if len(args) > 1 {
+		modules = args[1:]
+	}
+	sb := strings.Builder{}
+	for _, module := range modules {
+		items, err := Common.Database.MigrationStatus(module)
+		if err != nil {
+			sb.WriteString(fmt.Sprintf("%s: 查询失败 %v\n", module, err))
+			continue
+		}
+		if len(items) == 0 {
+			sb.WriteString(fmt.Sprintf("%s: 没有注册的迁移\n", module))
+			continue
+		}
+		for _, item := range items {
+			state := "pending"
+			if item.Applied {
+				state = time.Unix(item.AppliedAt, 0).Format("2006-01-02 15:04:05")
+			}
+			sb.WriteString(fmt.Sprintf("%s#%d %s [%s]\n", item.Module, item.Version, item.Name, state))
+		}
+	}
+	if sb.Len() == 0 {
+		c.Send("没有注册的迁移")
+		return
+	}
+	c.Send(LongText(strings.TrimRight(sb.String(), "\n")))
+}
+
+func (m *ModuleMgr) backupCmdInternal(args []string, c *zero.Ctx) {
+	if len(args) == 0 {
+		r, err := CreateBackup()
+		if err != nil {
+			c.Send(fmt.Sprintf("备份失败 %v", err))
+			return
+		}
+		c.Send(fmt.Sprintf("备份完成 %s", filepath.Base(r)))
+		return
+	}
+
+	switch args[0] {
+	case "list":
+		items, err := ListBackups()
+		if err != nil {
+			c.Send(fmt.Sprintf("读取备份列表失败 %v", err))
+			return
+		}
+		if len(items) == 0 {
+			c.Send("暂无备份")
+			return
+		}
+		c.Send(LongText(strings.Join(items, "\n")))
+	case "export":
+		if len(args) != 2 {
+			c.Send("使用方法 backup export [module]")
+			return
+		}
+		r, err := ExportModule(args[1])
+		if err != nil {
+			c.Send(fmt.Sprintf("导出失败 %v", err))
+			return
+		}
+		c.Send(fmt.Sprintf("导出完成 %s", filepath.Base(r)))
+	case "import":
+		if len(args) != 3 {
+			c.Send("使用方法 backup import [module] [file]")
+			return
+		}
+		if err := ImportModule(args[1], args[2]); err != nil {
+			c.Send(fmt.Sprintf("导入失败 %v", err))
+			return
+		}
+		c.Send("导入完成 请使用 reload 重新加载模块")
+	default:
+		c.Send("使用方法 backup / backup list / backup export [module] / backup import [module] [file]")
+	}
+}
+
+func (m *ModuleMgr) logLevelCmdInternal(args []string, c *zero.Ctx) {
+	switch len(args) {
+	case 0:
+		levels := LogLevels()
+		keys := make([]string, 0, len(levels))
+		for k := range levels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		sb := strings.Builder{}
+		for _, k := range keys {
+			sb.WriteString(fmt.Sprintf("%s: %s\n", k, levels[k]))
+		}
+		c.Send(strings.TrimRight(sb.String(), "\n"))
+	case 2:
+		if args[1] == "reset" {
+			ResetLogLevel(args[0])
+			c.Send(fmt.Sprintf("已重置 %s 的日志等级", args[0]))
+			return
+		}
+		if err := SetLogLevel(args[0], args[1]); err != nil {
+			c.Send(fmt.Sprintf("设置日志等级失败 %v", err))
+			return
+		}
+		c.Send(fmt.Sprintf("已将 %s 的日志等级设置为 %s", args[0], args[1]))
+	default:
+		c.Send("使用方法 loglevel / loglevel [console/file/module] [debug/info/warn/error/reset]")
+	}
+}
+
+func (m *ModuleMgr) statusCmdInternal(_ []string, c *zero.Ctx) {
+	st := CollectStatus()
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("版本 %s 运行时间 %s\n", st.Version, st.Uptime))
+	sb.WriteString(fmt.Sprintf("在线账号 %v\n", st.Accounts))
+	for _, h := range st.Health {
+		sb.WriteString(fmt.Sprintf("账号 %d %s 在线 %v 状态良好 %v\n", h.SelfID, map[bool]string{true: "正常", false: "异常"}[h.Up], h.Online, h.Good))
+	}
+	sb.WriteString(fmt.Sprintf("已加载模块(%d) %s\n", len(st.Modules), strings.Join(st.Modules, ", ")))
+	sb.WriteString(fmt.Sprintf("数据库 %s\n", map[bool]string{true: "正常", false: "异常"}[st.Database]))
+	names := make([]string, 0, len(st.Queues))
+	for name := range st.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		q := st.Queues[name]
+		sb.WriteString(fmt.Sprintf("队列 %s %d/%d 丢弃 %d\n", name, q.Len, q.Cap, q.Dropped))
+	}
+	c.Send(LongText(strings.TrimRight(sb.String(), "\n")))
+}
+
 func (m *ModuleMgr) ListAll() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	result := make([]string, len(m.loadedModules))
 	idx := 0
 	for i := range m.loadedModules {
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/goccy/go-json"
+	zero "marmot/onebot"
+	"os"
+	"time"
+)
+
+const (
+	RecordEvent = "event"
+	RecordCall  = "call"
+
+	latestRecordName = "latest.jsonl"
+	oldRecordPrefix  = "record_"
+)
+
+// Record is a line of a recording, either a raw inbound event or an api
+// call made by a module with its response
+type Record struct {
+	Time     time.Time       `json:"time"`
+	Kind     string          `json:"kind"`
+	Payload  json.RawMessage `json:"payload,omitempty"`  // event
+	Action   string          `json:"action,omitempty"`   // call
+	Params   json.RawMessage `json:"params,omitempty"`   // call
+	Response *RecordResponse `json:"response,omitempty"` // call
+	Error    string          `json:"error,omitempty"`    // call
+}
+
+type RecordResponse struct {
+	Status  string          `json:"status"`
+	RetCode int64           `json:"retcode"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type recorder struct {
+	writer *rotateWriter
+}
+
+// NewRecorder creates the recorder writing bot/records/latest.jsonl, nil is
+// returned when recording is disabled in config
+func NewRecorder() zero.IRecorder {
+	cfg := AppConfig.Record
+	if !cfg.Enabled {
+		return nil
+	}
+	dir, ok := GetSubDir("records")
+	if !ok {
+		LogError("[Record] failed to create records directory")
+		return nil
+	}
+	w, err := (&rotateWriter{
+		dir:      dir,
+		latest:   latestRecordName,
+		prefix:   oldRecordPrefix,
+		ext:      ".jsonl",
+		maxSize:  int64(cfg.MaxSize) * 1024 * 1024,
+		maxFiles: cfg.MaxFiles,
+	}).init()
+	if err != nil {
+		LogError("[Record] failed to open recording: %v", err)
+		return nil
+	}
+	RegisterShutdownHook(func() {
+		_ = w.Close()
+	})
+	LogInfo("[Record] recording events and api calls into %s", w.latestPath())
+	return &recorder{writer: w}
+}
+
+func (r *recorder) write(record *Record) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		LogWarn("[Record] failed to encode %s record: %v", record.Kind, err)
+		return
+	}
+	if _, err := r.writer.Write(append(data, '\n')); err != nil {
+		LogWarn("[Record] failed to write record: %v", err)
+	}
+}
+
+func (r *recorder) RecordEvent(payload []byte) {
+	if !json.Valid(payload) {
+		return
+	}
+	r.write(&Record{
+		Time:    time.Now(),
+		Kind:    RecordEvent,
+		Payload: payload,
+	})
+}
+
+func (r *recorder) RecordCall(request zero.APIRequest, response zero.APIResponse, err error) {
+	record := &Record{
+		Time:   time.Now(),
+		Kind:   RecordCall,
+		Action: request.Action,
+		Response: &RecordResponse{
+			Status:  response.Status,
+			RetCode: response.RetCode,
+			Message: response.Message,
+		},
+	}
+	if params, err := json.Marshal(request.Params); err == nil {
+		record.Params = params
+	}
+	if response.Data.Raw != "" {
+		record.Response.Data = json.RawMessage(response.Data.Raw)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	r.write(record)
+}
+
+// ReadRecording loads every record of a recording file
+func ReadRecording(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid record at line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
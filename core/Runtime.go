@@ -1,23 +1,120 @@
 package core
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 var (
 	hooks     []func()
 	hookMutex sync.Mutex
+
+	rootCtx, rootCancel = context.WithCancel(context.Background())
+	accepting           atomic.Bool
+	inflight            atomic.Int64
 )
 
+func init() {
+	accepting.Store(true)
+}
+
 func RegisterShutdownHook(fn func()) {
 	hookMutex.Lock()
 	hooks = append(hooks, fn)
 	hookMutex.Unlock()
 }
 
+// Context is cancelled once the bot starts shutting down, long running
+// goroutines of modules should exit when it is done
+func Context() context.Context {
+	return rootCtx
+}
+
+// BeginTask marks a handler as in-flight so shutdown waits for it, false
+// is returned when the bot no longer accepts new work
+func BeginTask() bool {
+	if !accepting.Load() {
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+// EndTask must be called once for every successful BeginTask
+func EndTask() {
+	inflight.Add(-1)
+}
+
+// waitInflight blocks until every in-flight task ends or the deadline is reached
+func waitInflight(deadline time.Time) bool {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for inflight.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		<-ticker.C
+	}
+	return true
+}
+
+// WaitIdle blocks until no handler or command is running, false is
+// returned when they are still busy after timeout
+func WaitIdle(timeout time.Duration) bool {
+	return waitInflight(time.Now().Add(timeout))
+}
+
+func shutdownTimeout() time.Duration {
+	dur, err := time.ParseDuration(AppConfig.ShutdownTimeout)
+	if err != nil || dur <= 0 {
+		return 15 * time.Second
+	}
+	return dur
+}
+
+// Shutdown stops accepting events, cancels the root context, waits for
+// in-flight handlers, runs shutdown hooks and flushes pending db writes
+func Shutdown() {
+	deadline := time.Now().Add(shutdownTimeout())
+	accepting.Store(false)
+	rootCancel()
+
+	LogInfo("[shutdown] waiting for %d in-flight handlers", inflight.Load())
+	if !waitInflight(deadline) {
+		LogWarn("[shutdown] deadline exceeded, %d handlers are still running", inflight.Load())
+	}
+
+	hookMutex.Lock()
+	for _, fn := range hooks {
+		safeCall(fn)
+	}
+	hookMutex.Unlock()
+
+	if Common != nil && Common.Database != nil {
+		done := make(chan struct{})
+		go func() {
+			Common.Database.Close()
+			close(done)
+		}()
+		// queued writes get a short grace period even if handlers used up the deadline
+		remaining := time.Until(deadline)
+		if remaining < 2*time.Second {
+			remaining = 2 * time.Second
+		}
+		select {
+		case <-done:
+			LogInfo("[shutdown] pending db writes flushed")
+		case <-time.After(remaining):
+			LogWarn("[shutdown] deadline exceeded before db writes were flushed")
+		}
+	}
+}
+
 func StartHookWatch() {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch,
@@ -29,14 +126,9 @@ func StartHookWatch() {
 
 	go func() {
 		sig := <-ch
-		LogDebug("[shutdown] received signal: %s", sig.String())
-
-		hookMutex.Lock()
-		for _, fn := range hooks {
-			safeCall(fn)
-		}
-		hookMutex.Unlock()
-
+		LogInfo("[shutdown] received signal: %s", sig.String())
+		Shutdown()
+		syncLogger()
 		os.Exit(0)
 	}()
 }
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/goccy/go-json"
+	zero "marmot/onebot"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Version is overridden at build time by -ldflags "-X marmot/core.Version=..."
+var Version = "dev"
+
+var startTime = time.Now()
+
+type QueueDepth struct {
+	Len     int    `json:"len"`
+	Cap     int    `json:"cap"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type BotStatus struct {
+	Version       string                `json:"version"`
+	StartedAt     int64                 `json:"started_at"`
+	Uptime        string                `json:"uptime"`
+	UptimeSeconds int64                 `json:"uptime_seconds"`
+	Accounts      []int64               `json:"accounts"`
+	Modules       []string              `json:"modules"`
+	Database      bool                  `json:"database"`
+	Queues        map[string]QueueDepth `json:"queues"`
+	Health        []AccountHealth       `json:"health"`
+}
+
+// AccountHealth is the heartbeat status of a connected account
+type AccountHealth struct {
+	SelfID        int64 `json:"self_id"`
+	Up            bool  `json:"up"`
+	Online        bool  `json:"online"`
+	Good          bool  `json:"good"`
+	Enabled       bool  `json:"enabled"`
+	Stale         bool  `json:"stale"`
+	IntervalMs    int64 `json:"interval_ms"`
+	LastHeartbeat int64 `json:"last_heartbeat"` // unix seconds, 0 before the first heartbeat
+}
+
+// AccountsHealth lists the heartbeat status of every account reporting one
+func AccountsHealth() []AccountHealth {
+	statuses := zero.HeartbeatStatuses()
+	result := make([]AccountHealth, 0, len(statuses))
+	for _, st := range statuses {
+		h := AccountHealth{
+			SelfID:     st.SelfID,
+			Up:         st.Up(),
+			Online:     st.Online,
+			Good:       st.Good,
+			Enabled:    st.Enabled,
+			Stale:      st.Stale,
+			IntervalMs: st.Interval.Milliseconds(),
+		}
+		if !st.LastHeartbeat.IsZero() {
+			h.LastHeartbeat = st.LastHeartbeat.Unix()
+		}
+		result = append(result, h)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SelfID < result[j].SelfID })
+	return result
+}
+
+// notifyBotStatus tells the bot admins by private message that an account
+// went offline or came back, an offline account is reported through another
+// account that is up when there is one
+func notifyBotStatus(c *zero.Ctx) {
+	if !AppConfig.StatusNotify || len(AppConfig.AdminQQ) == 0 {
+		return
+	}
+	selfID := c.Event.SelfID
+	ctx := c
+	text := fmt.Sprintf("机器人账号 %d 已恢复在线", selfID)
+	if c.Event.SubType == "offline" {
+		reason := c.Event.RawEvent.Get("reason").Str
+		text = fmt.Sprintf("机器人账号 %d 已离线: %s", selfID, reason)
+		for _, h := range AccountsHealth() {
+			if h.Up && h.SelfID != selfID {
+				if other := zero.GetBot(h.SelfID); other != nil {
+					ctx = other
+					break
+				}
+			}
+		}
+		if ctx == c && zero.GetBot(selfID) == nil { // disconnected, nothing can send
+			LogWarn("[Bot] account %d went offline (%s), no other account can tell the admins", selfID, reason)
+			return
+		}
+	}
+
+	if !BeginTask() {
+		return
+	}
+	go func() {
+		defer EndTask()
+		for _, admin := range AppConfig.AdminQQ {
+			ctx.SendPrivateMessage(admin, text)
+		}
+	}()
+}
+
+// ConnectedAccounts lists self ids of every connected APICaller
+func ConnectedAccounts() []int64 {
+	result := make([]int64, 0, 1)
+	zero.APICallers.Range(func(key int64, _ zero.APICaller) bool {
+		result = append(result, key)
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// pingDatabase checks the connection of the bot database within timeout
+func pingDatabase(timeout time.Duration) error {
+	if Common == nil || Common.Database == nil || Common.Database.Db == nil {
+		return ErrNilDbResult
+	}
+	sqlDb, err := Common.Database.Db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return sqlDb.PingContext(ctx)
+}
+
+func CollectStatus() BotStatus {
+	uptime := time.Since(startTime)
+	st := BotStatus{
+		Version:       Version,
+		StartedAt:     startTime.Unix(),
+		Uptime:        uptime.Truncate(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Accounts:      ConnectedAccounts(),
+		Modules:       []string{},
+		Database:      pingDatabase(time.Second) == nil,
+		Queues:        make(map[string]QueueDepth),
+		Health:        AccountsHealth(),
+	}
+	if mgr := GetModuleMgr(); mgr != nil {
+		st.Modules = mgr.ListAll()
+		sort.Strings(st.Modules)
+	}
+	queueStats.Range(func(key, value any) bool {
+		q := value.(QueueStats)
+		st.Queues[key.(string)] = QueueDepth{Len: q.Len(), Cap: q.Cap(), Dropped: q.Dropped()}
+		return true
+	})
+	return st
+}
+
+// checkReady returns the reasons why the bot can not serve events yet
+func checkReady() []string {
+	reasons := make([]string, 0)
+	if len(ConnectedAccounts()) == 0 {
+		reasons = append(reasons, "no onebot connection")
+	}
+	for _, h := range AccountsHealth() {
+		if !h.Up {
+			reasons = append(reasons, fmt.Sprintf("account %d is down", h.SelfID))
+		}
+	}
+	if err := pingDatabase(time.Second); err != nil {
+		reasons = append(reasons, fmt.Sprintf("database unreachable: %v", err))
+	}
+	if mgr := GetModuleMgr(); mgr == nil || (len(mgr.ListAll()) == 0 && len(AppConfig.Modules) > 0) {
+		reasons = append(reasons, "modules not loaded")
+	}
+	return reasons
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	reasons := checkReady()
+	if len(reasons) > 0 {
+		writeJson(w, http.StatusServiceUnavailable, map[string]any{"status": "unavailable", "reasons": reasons})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func statusHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, CollectStatus())
+}
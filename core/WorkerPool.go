@@ -0,0 +1,233 @@
+package core
+
+import (
+	"context"
+	"errors"
+	zero "marmot/onebot"
+	"marmot/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handler priorities, an overloaded pool drops the lowest first
+const (
+	priorityLow    = iota // group messages
+	priorityNormal        // private messages
+	priorityHigh          // membership changes and bot status
+	priorityLevels
+)
+
+func (t EventType) priority() int {
+	switch t {
+	case ETGroupMsg, ETUnknown:
+		return priorityLow
+	case ETPrivateMsg:
+		return priorityNormal
+	default:
+		return priorityHigh
+	}
+}
+
+var (
+	metricHandlerTime     = Metrics.Histogram("marmot_handler_seconds", "Run time of module event handlers.", nil, "module")
+	metricHandlerWait     = Metrics.Histogram("marmot_handler_wait_seconds", "Time event handlers waited in the worker pool queue.", nil, "priority")
+	metricHandlerTimeouts = Metrics.Counter("marmot_handler_timeouts_total", "Handlers still running after max_process_time.", "module")
+	metricHandlerDrops    = Metrics.Counter("marmot_handler_dropped_total", "Handlers dropped by the overloaded worker pool.", "type")
+	metricWorkersBusy     = Metrics.Gauge("marmot_workers_busy", "Workers of the pool running a handler.")
+)
+
+var priorityNames = [priorityLevels]string{"low", "normal", "high"}
+
+type poolTask struct {
+	event    Event
+	c        *zero.Ctx
+	routes   *routes // skip the task once the routes were retired, nil for commands
+	enqueued time.Time
+	done     chan struct{} // closed once the task finished or was dropped, set by await
+}
+
+// workerPool runs event handlers on a fixed number of workers. Tasks wait
+// in one bounded queue per priority sharing the capacity, a full pool makes
+// room by dropping the oldest task of a lower priority or rejects the new
+// one when there is none.
+type workerPool struct {
+	queues   [priorityLevels]*utils.RingQueue[poolTask]
+	capacity int
+	ready    chan struct{} // one token per queued task
+	mu       sync.Mutex    // serializes enqueue against dropping
+	busy     atomic.Int64
+	dropped  atomic.Uint64
+	maxTime  time.Duration
+}
+
+var (
+	handlerPool     *workerPool
+	handlerPoolOnce sync.Once
+)
+
+// sharedWorkerPool creates the pool on first use from AppConfig, it outlives
+// module managers so simulators do not leak workers
+func sharedWorkerPool() *workerPool {
+	handlerPoolOnce.Do(func() {
+		workers := AppConfig.Workers
+		if workers <= 0 {
+			workers = utils.DefaultWorkerNum
+		}
+		size := AppConfig.EventQueueSize
+		if size <= 0 {
+			size = 1000
+		}
+		handlerPool = newWorkerPool(workers, size, MaxProcessTime())
+		RegisterQueueMetrics("events", handlerPool)
+		metricWorkersBusy.Set(func() float64 { return float64(handlerPool.busy.Load()) })
+		LogInfo("[Bot] handling events with %d workers, queue size %d", workers, size)
+	})
+	return handlerPool
+}
+
+func newWorkerPool(workers, capacity int, maxTime time.Duration) *workerPool {
+	p := &workerPool{
+		capacity: capacity,
+		ready:    make(chan struct{}, capacity),
+		maxTime:  maxTime,
+	}
+	for i := range p.queues {
+		p.queues[i] = utils.NewRingQueue[poolTask](capacity)
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) Len() int {
+	n := 0
+	for _, q := range p.queues {
+		n += q.Len()
+	}
+	return n
+}
+
+func (p *workerPool) Cap() int {
+	return p.capacity
+}
+
+func (p *workerPool) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+// submit queues the handler, the caller did BeginTask and the pool calls
+// EndTask once the task finished or was dropped
+func (p *workerPool) submit(event Event, c *zero.Ctx, rt *routes) {
+	p.enqueue(poolTask{event: event, c: c, routes: rt, enqueued: time.Now()})
+}
+
+// await queues the handler like submit and waits until it finished or was
+// dropped, sequential dispatch keeps the order of a conversation with it
+func (p *workerPool) await(event Event, c *zero.Ctx, rt *routes) {
+	done := make(chan struct{})
+	p.enqueue(poolTask{event: event, c: c, routes: rt, enqueued: time.Now(), done: done})
+	<-done
+}
+
+func (p *workerPool) enqueue(task poolTask) {
+	prio := task.event.Type.priority()
+
+	// every queue can hold the whole capacity, so only the total is checked
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Len() < p.capacity {
+		_ = p.queues[prio].Enqueue(task)
+		p.ready <- struct{}{}
+		return
+	}
+
+	// full, the oldest task of the lowest priority below this one makes room
+	for low := 0; low < prio; low++ {
+		if victim, err := p.queues[low].Dequeue(); err == nil {
+			p.drop(victim)
+			_ = p.queues[prio].Enqueue(task) // takes over the token of the victim
+			return
+		}
+	}
+	p.drop(task)
+}
+
+func (p *workerPool) drop(task poolTask) {
+	p.dropped.Add(1)
+	metricHandlerDrops.Inc(task.event.Type.String())
+	LogWarn("[Bot] worker pool is full, dropped %s handler of module %s", task.event.Type, task.event.Module)
+	EndTask()
+	if task.done != nil {
+		close(task.done)
+	}
+}
+
+// next takes the oldest task of the highest priority
+func (p *workerPool) next() (poolTask, bool) {
+	for prio := priorityLevels - 1; prio >= 0; prio-- {
+		if task, err := p.queues[prio].Dequeue(); err == nil {
+			return task, true
+		}
+	}
+	return poolTask{}, false
+}
+
+func (p *workerPool) work() {
+	for range p.ready {
+		task, ok := p.next()
+		if !ok {
+			continue
+		}
+		metricHandlerWait.ObserveDuration(time.Since(task.enqueued), priorityNames[task.event.Type.priority()])
+		p.busy.Add(1)
+		p.run(task)
+		p.busy.Add(-1)
+	}
+}
+
+// run invokes the handler with a Ctx whose Context ends after maxTime or on
+// shutdown. Go can not stop a handler, so the worker keeps its slot until
+// the handler returned and a handler ignoring the context stalls one worker
+// instead of piling up goroutines.
+func (p *workerPool) run(task poolTask) {
+	if task.done != nil {
+		defer close(task.done)
+	}
+	if task.routes != nil {
+		if !task.routes.begin() { // the module was unloaded while it waited
+			EndTask()
+			return
+		}
+		defer task.routes.running.Done()
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if p.maxTime > 0 {
+		ctx, cancel = context.WithTimeout(Context(), p.maxTime)
+	} else {
+		ctx, cancel = context.WithCancel(Context())
+	}
+	defer cancel()
+
+	log := handlerLogger(task.event, task.c)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		GetModuleMgr().invokeHandler(task.event, task.c.WithContext(ctx), log)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		metricHandlerTimeouts.Inc(task.event.Module)
+		log.Warn("[Bot] %s handler of module %s is still running after %s", task.event.Type, task.event.Module, p.maxTime)
+	}
+	<-done
+}
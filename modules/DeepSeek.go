@@ -2,6 +2,7 @@ package modules
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/goccy/go-json"
 	"io"
@@ -60,7 +61,17 @@ type DeepSeekAI struct {
 	config   *DeepSeekConfig
 	reqQueue *utils.RingQueue[AskTsk]
 	ctx      *zero.Ctx
-	msgTmp   []message.Segment
+	log      *core.Logger
+}
+
+func (c *DeepSeekConfig) Validate() error {
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("queue_size must be positive")
+	}
+	if c.Model == "" {
+		return fmt.Errorf("model is empty")
+	}
+	return nil
 }
 
 func (s *DeepSeekAI) request(prompt string) (string, error) {
@@ -77,7 +88,7 @@ func (s *DeepSeekAI) request(prompt string) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", deepseekAPI, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(core.Context(), "POST", deepseekAPI, bytes.NewBuffer(data))
 	if err != nil {
 		return "", err
 	}
@@ -107,25 +118,25 @@ func (s *DeepSeekAI) request(prompt string) (string, error) {
 	return "", fmt.Errorf("no message returned")
 }
 
-func (s *DeepSeekAI) queueListner() {
+func (s *DeepSeekAI) queueListner(queue *utils.RingQueue[AskTsk]) {
 	for {
-		r, ok := s.reqQueue.WaitDequeue()
-		if !ok {
-			continue
+		r, ok := queue.WaitDequeue()
+		if !ok || queue.IsClosed() || core.Context().Err() != nil {
+			return
 		}
 		rq, e := s.request(r.prompt)
+		if core.Context().Err() != nil {
+			return // shutting down, the request was cancelled
+		}
 		if s.ctx == nil {
 			s.ctx = zero.GetBot(core.Common.BotQQ)
 		}
 		if e != nil {
 			s.ctx.SendGroupMessage(r.group, fmt.Sprintf("[Deepseek] 请求deepseek失败，错误信息 %v", e))
-			return
+			continue
 		}
 
-		s.msgTmp[0] = message.At(r.user)
-		s.msgTmp[1] = message.Text(" " + rq)
-
-		s.ctx.SendGroupMessage(r.group, s.msgTmp)
+		s.ctx.SendGroupMessage(r.group, append(message.Message{message.At(r.user), message.Text(" ")}, core.LongText(rq)...))
 	}
 }
 
@@ -134,29 +145,38 @@ func (s *DeepSeekAI) Init(mgr *core.ModuleMgr) bool {
 	s.config = &DeepSeekConfig{}
 	r := core.InitCustomConfig(s.config, cfg)
 	if r != nil {
-		core.LogWarn("[DeepSeek] init config error: %v. Using default instead", r)
+		s.log.Warn("init config error: %v. Using default instead", r)
 		s.config = s.config.CreateDefaultConfig().(*DeepSeekConfig)
 	}
 
 	mgr.RegisterCmd().
 		RegisterMember("deepseek", s.onCmd)
 
+	if s.reqQueue == nil {
+		s.reqQueue = utils.NewRingQueue[AskTsk](100)
+	}
+	core.RegisterQueueMetrics("deepseek", s.reqQueue)
+
 	// start service
-	go s.queueListner()
+	go s.queueListner(s.reqQueue)
 
 	return true
 }
 
-func (s *DeepSeekAI) Stop(_ *core.ModuleMgr) {
-	s.msgTmp = nil
+func (s *DeepSeekAI) Stop(_ context.Context, _ *core.ModuleMgr) {
+	core.RemoveQueueMetrics("deepseek")
+	if s.reqQueue != nil {
+		// pending requests are dropped, the listener exits once the queue is closed
+		s.reqQueue.Close()
+	}
 	s.config = nil
 	s.reqQueue = nil
 	s.ctx = nil
 }
 
 func (s *DeepSeekAI) Reload(mgr *core.ModuleMgr) {
+	s.Stop(core.Context(), mgr)
 	s.Init(mgr)
-	s.Stop(mgr)
 }
 
 func (s *DeepSeekAI) onCmd(args []string, ctx *zero.Ctx) {
@@ -175,10 +195,12 @@ func (s *DeepSeekAI) onCmd(args []string, ctx *zero.Ctx) {
 }
 
 func init() {
+	core.RegisterModuleConfig("deepseek", "deepseek.yml", func() any { return &DeepSeekConfig{} })
+	core.DescribeModule("deepseek", "Answers the deepseek command with the DeepSeek chat api")
 	core.RegisterNamed("deepseek", func() core.IModule {
 		return &DeepSeekAI{
 			reqQueue: utils.NewRingQueue[AskTsk](100),
-			msgTmp:   make([]message.Segment, 2),
+			log:      core.Common.Logger.Named("deepseek"),
 		}
 	})
 }
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"io/fs"
 	"marmot/core"
 	zero "marmot/onebot"
@@ -17,12 +18,13 @@ type EggItem struct {
 
 type EasterEgg struct {
 	eggs map[string]*EggItem
+	log  *core.Logger
 }
 
 func (e *EasterEgg) Init(mgr *core.ModuleMgr) bool {
 	r, b := core.GetSubDir("EasterEgg")
 	if !b {
-		core.LogError("[EasterEgg] subdir not found")
+		e.log.Error("subdir not found")
 		return false
 	}
 
@@ -34,7 +36,7 @@ func (e *EasterEgg) Init(mgr *core.ModuleMgr) bool {
 			return nil
 		}
 		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
-		core.LogDebug("[EasterEgg] loaded %s -> %s", name, path)
+		e.log.Debug("loaded %s -> %s", name, path)
 
 		e.eggs[name] = &EggItem{
 			path:    path,
@@ -43,7 +45,7 @@ func (e *EasterEgg) Init(mgr *core.ModuleMgr) bool {
 		return nil
 	})
 	if err != nil {
-		core.LogError("[EasterEgg] exception occured when walking sub-directory, err:", err)
+		e.log.Error("exception occured when walking sub-directory, err: %v", err)
 		return false
 	}
 
@@ -52,13 +54,13 @@ func (e *EasterEgg) Init(mgr *core.ModuleMgr) bool {
 	return true
 }
 
-func (e *EasterEgg) Stop(_ *core.ModuleMgr) {
+func (e *EasterEgg) Stop(_ context.Context, _ *core.ModuleMgr) {
 	e.eggs = nil
 }
 
 func (e *EasterEgg) Reload(mgr *core.ModuleMgr) {
 	e.Init(mgr)
-	e.Stop(mgr)
+	e.Stop(core.Context(), mgr)
 }
 
 func (e *EasterEgg) onMsg(ctx *zero.Ctx) {
@@ -74,7 +76,7 @@ func (e *EasterEgg) onMsg(ctx *zero.Ctx) {
 	if r.content == nil {
 		dat, err := os.ReadFile(r.path)
 		if err != nil {
-			core.LogError("[EasterEgg] read file %s failed, err:%s", r.path, err)
+			e.log.Error("read file %s failed, err:%s", r.path, err)
 			return
 		}
 		r.content = dat
@@ -83,9 +85,11 @@ func (e *EasterEgg) onMsg(ctx *zero.Ctx) {
 }
 
 func init() {
+	core.DescribeModule("easter_egg", "Replies with images from bot/EasterEgg to \"!name\" messages")
 	core.RegisterNamed("easter_egg", func() core.IModule {
 		return &EasterEgg{
 			eggs: make(map[string]*EggItem),
+			log:  core.Common.Logger.Named("easter_egg"),
 		}
 	})
 }
@@ -2,6 +2,7 @@ package modules
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/RomiChan/syncx"
 	"github.com/cloudflare/ahocorasick"
@@ -28,7 +29,7 @@ type BlockCfg struct {
 	GroupIds []int64       `koanf:"group_ids" yaml:"group_ids"`
 	BanUser  bool          `koanf:"ban_user" yaml:"ban_user"`
 	BanRule  map[int]int64 `koanf:"ban_rule" yaml:"ban_rule"`
-	BanMsg   string        `koanf:"ban_msg" yaml:"ban_msg"`
+	BanMsg   string        `koanf:"ban_msg" yaml:"ban_msg"` // message template, {count} and {duration} of the ban
 }
 
 func (b BlockCfg) CreateDefaultConfig() interface{} {
@@ -40,7 +41,7 @@ func (b BlockCfg) CreateDefaultConfig() interface{} {
 			2: 10 * 60,
 			3: 100 * 60,
 		},
-		BanMsg: "第 %v 次触发群违规词汇，被禁言 %s",
+		BanMsg: "第 {count} 次触发群违规词汇，被禁言 {duration}",
 	}
 }
 
@@ -54,6 +55,8 @@ type FilterEngine struct {
 	db        *gorm.DB
 	plainText []string
 	tempLock  bool
+	kv        *core.KvStore
+	log       *core.Logger
 	matcher   *ahocorasick.Matcher
 	regexList []*regexp.Regexp
 	banMap    *syncx.Map[int64, *atomic.Int32]
@@ -97,10 +100,10 @@ func (m *FilterEngine) loadRules() error {
 				if err != nil {
 					return err
 				}
-				core.LogDebug("[Filter] loaded regx rule %s", pattern)
+				m.log.Debug("loaded regx rule %s", pattern)
 				m.regexList = append(m.regexList, re)
 			} else {
-				core.LogDebug("[Filter] loaded normal rule %s", line)
+				m.log.Debug("loaded normal rule %s", line)
 				m.plainText = append(m.plainText, line)
 			}
 		}
@@ -121,6 +124,9 @@ func (m *FilterEngine) loadRules() error {
 
 func (m *FilterEngine) OnReqStop(_ []string, ctx *zero.Ctx) {
 	m.tempLock = !m.tempLock
+	if err := core.KvSet(m.kv, "temp_lock", m.tempLock, 0); err != nil {
+		m.log.Error("failed to save temp lock state: %v", err)
+	}
 	ctx.Send(fmt.Sprintf("消息审查模式状态: %v 操作人: %s", m.tempLock, ctx.Event.Sender.Name()))
 	return
 }
@@ -141,7 +147,7 @@ func (m *FilterEngine) readBanData(id int64) int32 {
 				Times: 0,
 			})
 			if err != nil {
-				core.LogError("[Filter] failed to insert ban history item: %v", err)
+				m.log.Error("failed to insert ban history item: %v", err)
 			}
 			return 0
 		}
@@ -156,7 +162,7 @@ func (m *FilterEngine) readBanData(id int64) int32 {
 func (m *FilterEngine) updateBanData(id int64, times int32) {
 	rT, ok := m.banMap.Load(id)
 	if !ok {
-		core.LogError("[Filter] invalid operation 'updateBanData'")
+		m.log.Error("invalid operation 'updateBanData'")
 		return
 	}
 	rT.Store(times)
@@ -167,7 +173,7 @@ func (m *FilterEngine) updateBanData(id int64, times int32) {
 		Times: times,
 	})
 	if err != nil {
-		core.LogError("[Filter] failed to update ban history item: %v", err)
+		m.log.Error("failed to update ban history item: %v", err)
 	}
 }
 
@@ -176,35 +182,36 @@ func (m *FilterEngine) Init(mgr *core.ModuleMgr) bool {
 	m.config = &BlockCfg{}
 	r := core.InitCustomConfig[BlockCfg](m.config, path)
 	if r != nil {
-		core.LogWarn("FilterEngine init config error: %v Using default instead.", r)
+		m.log.Warn("init config error: %v Using default instead.", r)
 		m.config = m.config.CreateDefaultConfig().(*BlockCfg)
 	}
 
+	m.kv = mgr.Storage(m)
+	lock, _, err := core.KvGet[bool](m.kv, "temp_lock")
+	if err != nil {
+		m.log.Warn("failed to read temp lock state: %v", err)
+	}
+	m.tempLock = lock
+
 	mgr.RegisterCmd().
 		RegisterGroupAdmin("SwitchBlock", m.OnReqStop)
 	mgr.RegisterEvent(core.ETGroupMsg, m.OnMsg)
 
-	err := m.loadRules()
+	err = m.loadRules()
 	if err != nil {
-		core.LogWarn("FilterEngine load rules error: %v", err)
+		m.log.Warn("load rules error: %v", err)
 		return false
 	}
 
 	if m.config.BanUser {
 		m.banMap = new(syncx.Map[int64, *atomic.Int32])
 		m.db = core.Common.Database.Db
-
-		err := m.db.AutoMigrate(&BanHistoryItem{})
-		if err != nil {
-			core.LogError("[Filter] Database auto-migrate error: %v", err)
-			return false
-		}
 	}
 
 	return true
 }
 
-func (m *FilterEngine) Stop(_ *core.ModuleMgr) {
+func (m *FilterEngine) Stop(_ context.Context, _ *core.ModuleMgr) {
 	m.banMap = nil
 	m.matcher = nil
 	m.tempLock = false
@@ -213,7 +220,7 @@ func (m *FilterEngine) Stop(_ *core.ModuleMgr) {
 
 func (m *FilterEngine) Reload(mg *core.ModuleMgr) {
 	// I'm so lazy to implement this standalone :(
-	m.Stop(mg)
+	m.Stop(core.Context(), mg)
 	m.Init(mg)
 }
 
@@ -303,7 +310,7 @@ func (m *FilterEngine) OnMsg(ctx *zero.Ctx) {
 
 	var a = ctx.Event.RawMessage
 	var b = ctx.Event.Message.ExtractPlainText()
-	core.LogDebug("MsgRaw %s MsgPlain %s", a, b)
+	m.log.WithCtx(ctx).Debug("MsgRaw %s MsgPlain %s", a, b)
 
 	txt := extractPlainText(ctx.Event.Message)
 	isMatched := false
@@ -330,23 +337,64 @@ func (m *FilterEngine) OnMsg(ctx *zero.Ctx) {
 
 		if ok2 && tp > 0 {
 			ctx.SetGroupBan(ctx.Event.GroupID, ctx.Event.Sender.ID, tp)
-			var msg = make([]message.Segment, 2)
-			msg[0] = message.At(ctx.Event.Sender.ID)
-			msg[1] = message.Text(fmt.Sprintf(m.config.BanMsg, rawVal, utils.FormatDuration(tp)))
-			ctx.Send(msg)
+			ctx.Send(m.banMessage(ctx, rawVal, tp))
 		} else {
 			ctx.SetGroupBan(ctx.Event.GroupID, ctx.Event.Sender.ID, TwentyNineFiftyNineFiftyNine)
-			var msg = make([]message.Segment, 2)
-			msg[0] = message.At(ctx.Event.Sender.ID)
-			msg[1] = message.Text(fmt.Sprintf(m.config.BanMsg, rawVal, utils.FormatDuration(TwentyNineFiftyNineFiftyNine)))
-			ctx.Send(msg)
+			ctx.Send(m.banMessage(ctx, rawVal, TwentyNineFiftyNineFiftyNine))
 		}
 	}
 
 }
 
+// banMessage renders ban_msg, configs written before templates still use
+// %v and %s for the count and the duration
+func (m *FilterEngine) banMessage(ctx *zero.Ctx, count int32, duration int64) message.Message {
+	tmpl := m.config.BanMsg
+	if strings.Contains(tmpl, "%v") || strings.Contains(tmpl, "%s") {
+		tmpl = fmt.Sprintf(tmpl, count, utils.FormatDuration(duration))
+	}
+	msg := ctx.Render(tmpl, message.Vars{
+		"count":    int(count),
+		"duration": utils.FormatDuration(duration),
+	})
+	if !strings.Contains(tmpl, "{at:") {
+		msg = append(message.Message{message.At(ctx.Event.Sender.ID)}, msg...)
+	}
+	return msg
+}
+
+// listRules reads every rule file for the admin console
+func listRules() (any, error) {
+	pth, r := core.GetSubDir("rules")
+	if !r {
+		return nil, fmt.Errorf("failed to setup rules's directory at %s", pth)
+	}
+	result := make(map[string][]string)
+	err := filepath.WalkDir(pth, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".txt") {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(pth, path)
+		lines := make([]string, 0)
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+		result[rel] = lines
+		return nil
+	})
+	return result, err
+}
+
 func newMsgBlock() core.IModule {
 	return &FilterEngine{
+		log:       core.Common.Logger.Named("filter"),
 		config:    nil,
 		tempLock:  false,
 		plainText: make([]string, 0),
@@ -356,5 +404,15 @@ func newMsgBlock() core.IModule {
 
 // register for current module
 func init() {
+	core.DescribeModule("filter", "Deletes messages matching banned words and mutes repeat offenders")
 	core.RegisterNamed("filter", newMsgBlock)
+	core.RegisterDataModels("filter", &BanHistoryItem{})
+	core.RegisterModuleConfig("filter", "filter.yaml", func() any { return &BlockCfg{} })
+	core.RegisterAdminView("filter_rules", listRules)
+	core.RegisterMigrations("filter", core.Migration{
+		Name: "create_ban_history_items",
+		// frozen DDL of BanHistoryItem at v1, schema changes go into a new migration
+		UpSQL:   "CREATE TABLE IF NOT EXISTS `ban_history_items` (`id` integer PRIMARY KEY AUTOINCREMENT,`times` integer)",
+		DownSQL: "DROP TABLE IF EXISTS `ban_history_items`",
+	})
 }
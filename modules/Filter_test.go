@@ -0,0 +1,95 @@
+package modules_test
+
+import (
+	"marmot/core"
+	"marmot/modules"
+	"marmot/simulator"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const filterGroup = 20000
+
+func newFilterSim(t *testing.T) *simulator.Simulator {
+	t.Helper()
+	sim, err := simulator.New(simulator.Options{
+		Modules: []string{"filter"},
+		Admins:  []int64{30000},
+		Files: map[string]string{
+			"filter.yaml":    "group_ids: [20000]\nban_user: true\nban_rule:\n  1: 60\n  2: 600\nban_msg: \"第 {count} 次, 禁言 {duration}\"\n",
+			"rules/test.txt": "badword\n",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to boot simulator: %v", err)
+	}
+	t.Cleanup(sim.Close)
+	return sim
+}
+
+func TestFilter(t *testing.T) {
+	sim := newFilterSim(t)
+
+	// in-memory database, nothing is written to the data dir
+	if _, err := os.Stat(filepath.Join(sim.Dir, "marmot_data.db")); !os.IsNotExist(err) {
+		t.Fatalf("expected no database file in the data dir, stat err: %v", err)
+	}
+
+	t.Run("ban", func(t *testing.T) {
+		sim.Caller.Reset()
+		if _, err := sim.GroupMessage(filterGroup, simulator.Member(10001), "bad word"); err != nil {
+			t.Fatal(err)
+		}
+		// GroupMessage already waited, the pool must be idle
+		if !core.WaitIdle(time.Second) {
+			t.Fatal("handlers are still running after the message returned")
+		}
+		if _, ok := sim.Caller.Last("delete_msg"); !ok {
+			t.Fatal("matching message was not deleted")
+		}
+		ban, ok := sim.Caller.Last("set_group_ban")
+		if !ok {
+			t.Fatal("sender was not muted")
+		}
+		if ban.Param("user_id") != int64(10001) || ban.Param("duration") != int64(60) {
+			t.Fatalf("unexpected ban params %v", ban.Request.Params)
+		}
+
+		var item modules.BanHistoryItem
+		if err := core.Common.Database.Db.First(&item, 10001).Error; err != nil || item.Times != 1 {
+			t.Fatalf("ban history not stored, times %d err %v", item.Times, err)
+		}
+
+		if _, err := sim.GroupMessage(filterGroup, simulator.Member(10001), "badword"); err != nil {
+			t.Fatal(err)
+		}
+		if ban, _ = sim.Caller.Last("set_group_ban"); ban.Param("duration") != int64(600) {
+			t.Fatalf("second ban should follow ban_rule, got %v", ban.Param("duration"))
+		}
+	})
+
+	t.Run("other group", func(t *testing.T) {
+		sim.Caller.Reset()
+		if _, err := sim.GroupMessage(filterGroup+1, simulator.Member(10002), "badword"); err != nil {
+			t.Fatal(err)
+		}
+		if calls := sim.Caller.Calls(); len(calls) != 0 {
+			t.Fatalf("group outside group_ids was filtered: %v", calls)
+		}
+	})
+
+	t.Run("switch block", func(t *testing.T) {
+		sim.Caller.Reset()
+		if _, err := sim.GroupMessage(filterGroup, simulator.Admin(30000), ".SwitchBlock"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sim.GroupMessage(filterGroup, simulator.Member(10003), "badword"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sim.Caller.Last("set_group_ban"); ok {
+			t.Fatal("message was filtered while the filter is switched off")
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/goccy/go-json"
@@ -48,7 +49,8 @@ type McSession struct {
 }
 
 type McQuery struct {
-	db *gorm.DB
+	db  *gorm.DB
+	log *core.Logger
 }
 
 func (m *McQuery) onMcSkin(args []string, ctx *zero.Ctx) {
@@ -174,18 +176,18 @@ func (m *McQuery) getSession(userId string) (string, bool) {
 
 	resp, err := http.Get(url)
 	if err != nil {
-		core.LogWarn("[McQuery] Failed to get session info from %s", url)
+		m.log.Warn("Failed to get session info from %s", url)
 		return "", false
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		core.LogWarn("[McQuery] Failed to read session info from %s", url)
+		m.log.Warn("Failed to read session info from %s", url)
 		return "", false
 	}
 	if resp.StatusCode != http.StatusOK {
-		core.LogWarn("[McQuery] Failed to get session info from %s", url)
+		m.log.Warn("Failed to get session info from %s", url)
 		return "", false
 	}
 
@@ -201,7 +203,7 @@ func (m *McQuery) getSession(userId string) (string, bool) {
 	}
 	r := core.Common.Database.Insert(&ses)
 	if r != nil {
-		core.LogError("[McQuery] Failed to insert session info in database: %s", r)
+		m.log.Error("Failed to insert session info in database: %s", r)
 		return "", false
 	}
 
@@ -211,12 +213,7 @@ func (m *McQuery) getSession(userId string) (string, bool) {
 func (m *McQuery) Init(mgr *core.ModuleMgr) bool {
 	m.db = core.Common.Database.Db
 	if m.db == nil {
-		core.LogError("[McQuery] bot database not init!")
-		return false
-	}
-	err := m.db.AutoMigrate(&McSession{})
-	if err != nil {
-		core.LogError("[McQuery] bot database execute mirgate err: %v", err)
+		m.log.Error("bot database not init!")
 		return false
 	}
 
@@ -227,17 +224,25 @@ func (m *McQuery) Init(mgr *core.ModuleMgr) bool {
 	return true
 }
 
-func (m *McQuery) Stop(mgr *core.ModuleMgr) {
+func (m *McQuery) Stop(_ context.Context, mgr *core.ModuleMgr) {
 
 }
 
 func (m *McQuery) Reload(mgr *core.ModuleMgr) {
 	m.Init(mgr)
-	m.Stop(mgr)
+	m.Stop(core.Context(), mgr)
 }
 
 func init() {
+	core.DescribeModule("mcq", "Minecraft skin and cape lookup commands")
 	core.RegisterNamed("mcq", func() core.IModule {
-		return &McQuery{}
+		return &McQuery{log: core.Common.Logger.Named("mcq")}
+	})
+	core.RegisterDataModels("mcq", &McSession{})
+	core.RegisterMigrations("mcq", core.Migration{
+		Name: "create_mc_sessions",
+		// frozen DDL of McSession at v1, schema changes go into a new migration
+		UpSQL:   "CREATE TABLE IF NOT EXISTS `mc_sessions` (`username` text,`session` text,PRIMARY KEY (`username`))",
+		DownSQL: "DROP TABLE IF EXISTS `mc_sessions`",
 	})
 }
@@ -2,10 +2,12 @@ package modules
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 	"marmot/core"
 	zero "marmot/onebot"
 	"marmot/onebot/message"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,18 +35,33 @@ func parseTime(ts string) (int64, error) {
 }
 
 type ScheduleTask struct {
-	ActionTime  string    `koanf:"action_time" yaml:"action_time"`
-	ActionTimes int       `koanf:"action_times" yaml:"action_times"`
-	Interval    string    `koanf:"interval" yaml:"interval"`
-	TaskType    STaskType `koanf:"task_type" yaml:"task_type"`
-	TaskData    string    `koanf:"task_data" yaml:"task_data"`
-	Group       []int64   `koanf:"group" yaml:"group"`
+	ActionTime  string    `koanf:"action_time" yaml:"action_time" json:"action_time"`
+	ActionTimes int       `koanf:"action_times" yaml:"action_times" json:"action_times"`
+	Interval    string    `koanf:"interval" yaml:"interval" json:"interval"`
+	TaskType    STaskType `koanf:"task_type" yaml:"task_type" json:"task_type"`
+	TaskData    string    `koanf:"task_data" yaml:"task_data" json:"task_data"`
+	Group       []int64   `koanf:"group" yaml:"group" json:"group"`
 }
 
 type ScheduleCfg struct {
 	Tasks []ScheduleTask `koanf:"tasks" yaml:"tasks"`
 }
 
+func (s *ScheduleCfg) Validate() error {
+	for i, task := range s.Tasks {
+		if _, err := parseTime(task.ActionTime); err != nil {
+			return fmt.Errorf("task %d: invalid action_time: %w", i, err)
+		}
+		if _, err := time.ParseDuration(task.Interval); err != nil {
+			return fmt.Errorf("task %d: invalid interval: %w", i, err)
+		}
+		if task.TaskType < STUnknown || task.TaskType > STBroadcast {
+			return fmt.Errorf("task %d: unknown task_type %d", i, task.TaskType)
+		}
+	}
+	return nil
+}
+
 func (s ScheduleCfg) CreateDefaultConfig() interface{} {
 	return &ScheduleCfg{
 		Tasks: []ScheduleTask{
@@ -99,14 +116,13 @@ type ScheduleMgr struct {
 	tasks   taskHeap
 	ctx     *zero.Ctx
 	running bool
+	stop    chan struct{} // closed by Stop to end run
+	done    chan struct{} // closed when run returns
+	wake    chan struct{} // wakes run up when tasks are changed
+	log     *core.Logger
 }
 
-func (s *ScheduleMgr) execute(action *taskItem) {
-	if action.index >= len(s.cfg.Tasks) {
-		return
-	}
-	r := s.cfg.Tasks[action.id]
-
+func (s *ScheduleMgr) execute(r ScheduleTask) {
 	if s.ctx == nil {
 		s.ctx = zero.GetBot(core.Common.BotQQ)
 	}
@@ -134,13 +150,27 @@ func (s *ScheduleMgr) execute(action *taskItem) {
 	}
 }
 
-func (s *ScheduleMgr) run() {
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ScheduleMgr) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
 	for {
 		s.lock.Lock()
 
-		for len(s.tasks) == 0 {
+		for len(s.tasks) == 0 && !isClosed(stop) {
 			s.cond.Wait() // wait next task
 		}
+		if isClosed(stop) {
+			s.lock.Unlock()
+			return
+		}
 
 		now := time.Now().UnixNano()
 		item := s.tasks[0]
@@ -148,8 +178,7 @@ func (s *ScheduleMgr) run() {
 
 		if delay <= 0 {
 			heap.Pop(&s.tasks)
-			s.lock.Unlock()
-			go s.execute(item)
+			task := s.cfg.Tasks[item.id]
 
 			if item.ActionTimes == -1 || item.ActionTimes > 1 {
 				// For infinite tasks (ActionTimes = -1), don't decrease ActionTimes
@@ -163,22 +192,18 @@ func (s *ScheduleMgr) run() {
 				s.cfg.Tasks[item.id].ActionTimes = item.ActionTimes
 
 				// Re-add the task back to the queue
-				s.lock.Lock()
 				heap.Push(&s.tasks, item)
-				s.lock.Unlock()
-
 			} else {
-				// Remove the task if it's a one-time task
-				s.lock.Lock()
+				// Remove the task if it's a one-time task, ids of other tasks are shifted
 				s.cfg.Tasks = append(s.cfg.Tasks[:item.id], s.cfg.Tasks[item.id+1:]...)
-				heap.Init(&s.tasks)
-				s.lock.Unlock()
+				s.rebuildLocked()
 			}
-
-			r := core.SaveCustomConfigToFile(core.GetSubDirFilePath("scheduler.yml"), s.cfg)
+			r := s.saveLocked()
+			s.lock.Unlock()
 			if r != nil {
-				core.LogError("[Schedule] failed to update scheduler.yml err: %v", r)
+				s.log.Error("failed to update scheduler.yml err: %v", r)
 			}
+			go s.execute(task)
 
 			continue
 		}
@@ -189,7 +214,52 @@ func (s *ScheduleMgr) run() {
 		select {
 		case <-timer.C:
 			// Prepare to run next turn
+		case <-s.wake:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// rebuildLocked recreates the heap from cfg.Tasks, caller must hold s.lock
+func (s *ScheduleMgr) rebuildLocked() {
+	s.tasks = make(taskHeap, 0, len(s.cfg.Tasks))
+	for i, task := range s.cfg.Tasks {
+		t, e := parseTime(task.ActionTime)
+		if e != nil {
+			s.log.Error("[Task index: %v] failed to parse action time %v", i, e)
+			continue
+		}
+		d, e := time.ParseDuration(task.Interval)
+		if e != nil {
+			s.log.Error("[Task index: %v] failed to parse interval time %v", i, e)
+			continue
 		}
+		s.tasks = append(s.tasks, &taskItem{
+			ActionTime:  t,
+			ActionTimes: task.ActionTimes,
+			Interval:    d.Nanoseconds(),
+			index:       len(s.tasks),
+			id:          int64(i),
+		})
+	}
+	heap.Init(&s.tasks)
+}
+
+// saveLocked writes cfg to scheduler.yml, caller must hold s.lock so the
+// file never gets an older task list than a concurrent change
+func (s *ScheduleMgr) saveLocked() error {
+	return core.SaveCustomConfigToFile(core.GetSubDirFilePath("scheduler.yml"), s.cfg)
+}
+
+// notifyLocked wakes run up to pick the new earliest task, caller must hold s.lock
+func (s *ScheduleMgr) notifyLocked() {
+	s.cond.Signal()
+	select {
+	case s.wake <- struct{}{}:
+	default:
 	}
 }
 
@@ -198,7 +268,7 @@ func (s *ScheduleMgr) Init(mgr *core.ModuleMgr) bool {
 	path := core.GetSubDirFilePath("scheduler.yml")
 	r := core.InitCustomConfig(s.cfg, path)
 	if r != nil {
-		core.LogWarn("[ScheduleMgr] failed to init scheduler config %v", r)
+		s.log.Warn("failed to init scheduler config %v", r)
 		s.cfg = s.cfg.CreateDefaultConfig().(*ScheduleCfg)
 	}
 
@@ -208,18 +278,18 @@ func (s *ScheduleMgr) Init(mgr *core.ModuleMgr) bool {
 	for _, task := range s.cfg.Tasks {
 		t, err := parseTime(task.ActionTime)
 		if err != nil {
-			core.LogError("[ScheduleMgr] failed to parse action time %v", err)
+			s.log.Error("failed to parse action time %v", err)
 			continue
 		}
 
 		if t-currnetTm < 0 {
-			core.LogDebug("[ScheduleMgr] task with negative action time will be removed: %v", task)
+			s.log.Debug("task with negative action time will be removed: %v", task)
 			continue
 		}
 
 		// Special handling for infinite tasks (ActionTimes == -1)
 		if task.ActionTimes == -1 {
-			core.LogDebug("[ScheduleMgr] infinite task detected, will repeat indefinitely: %v", task)
+			s.log.Debug("infinite task detected, will repeat indefinitely: %v", task)
 		}
 
 		validTasks = append(validTasks, task)
@@ -229,37 +299,19 @@ func (s *ScheduleMgr) Init(mgr *core.ModuleMgr) bool {
 	// save to config
 	err := core.SaveCustomConfigToFile(path, s.cfg)
 	if err != nil {
-		core.LogError("[ScheduleMgr] failed to save updated scheduler config %v", err)
+		s.log.Error("failed to save updated scheduler config %v", err)
 	} else {
-		core.LogInfo("[ScheduleMgr] updated scheduler config saved successfully")
+		s.log.Info("updated scheduler config saved successfully")
 	}
 
 	// init scheduler heap
-	s.tasks = make(taskHeap, len(s.cfg.Tasks))
-	for i, task := range s.cfg.Tasks {
-		t, e := parseTime(task.ActionTime)
-		if e != nil {
-			core.LogError("[ScheduleMgr] [Task index: %v] failed to parse action time %v", i, e)
-			continue
-		}
-		d, e := time.ParseDuration(task.Interval)
-		if e != nil {
-			core.LogError("[ScheduleMgr] [Task index: %v] failed to parse interval time %v", i, e)
-			continue
-		}
-		s.tasks[i] = &taskItem{
-			ActionTime:  t,
-			ActionTimes: task.ActionTimes,
-			Interval:    d.Nanoseconds(),
-			index:       i,
-			id:          int64(i),
-		}
-	}
-
 	s.cond = sync.NewCond(&s.lock)
-	heap.Init(&s.tasks)
+	s.rebuildLocked()
 	s.running = true
-	go s.run()
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.wake = make(chan struct{}, 1)
+	go s.run(s.stop, s.done)
 
 	mgr.RegisterCmd().
 		RegisterGroupAdmin("RegTask", s.onRegTask)
@@ -267,18 +319,29 @@ func (s *ScheduleMgr) Init(mgr *core.ModuleMgr) bool {
 	return true
 }
 
-func (s *ScheduleMgr) Stop(_ *core.ModuleMgr) {
-	r := core.SaveCustomConfigToFile(core.GetSubDirFilePath("scheduler.yml"), s.cfg)
+func (s *ScheduleMgr) Stop(_ context.Context, _ *core.ModuleMgr) {
+	if s.running {
+		s.lock.Lock()
+		close(s.stop)
+		s.cond.Broadcast()
+		s.lock.Unlock()
+		<-s.done
+		s.running = false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := s.saveLocked()
 	if r != nil {
-		core.LogError("[ScheduleMgr] failed to save scheduler.yml err: %v", r)
+		s.log.Error("failed to save scheduler.yml err: %v", r)
 	}
 
 	s.cfg = nil
 }
 
 func (s *ScheduleMgr) Reload(mgr *core.ModuleMgr) {
+	s.Stop(core.Context(), mgr)
 	s.Init(mgr)
-	s.Stop(mgr)
 }
 
 func (s *ScheduleMgr) onRegTask(args []string, ctx *zero.Ctx) {
@@ -287,7 +350,8 @@ func (s *ScheduleMgr) onRegTask(args []string, ctx *zero.Ctx) {
 		return
 	}
 
-	t, e := parseTime(strings.ReplaceAll(args[0], "\"", ""))
+	actionTime := strings.ReplaceAll(args[0], "\"", "")
+	_, e := parseTime(actionTime)
 	if e != nil {
 		ctx.SendGroupMessage(ctx.Event.GroupID, message.Text("错误的时间格式! xxxx:xx:xx xx:xx:xx"))
 		return
@@ -299,7 +363,7 @@ func (s *ScheduleMgr) onRegTask(args []string, ctx *zero.Ctx) {
 		return
 	}
 
-	dur, e := time.ParseDuration(args[2])
+	_, e = time.ParseDuration(args[2])
 	if e != nil {
 		ctx.SendGroupMessage(ctx.Event.GroupID, message.Text("错误的间隔时间"))
 		return
@@ -311,35 +375,154 @@ func (s *ScheduleMgr) onRegTask(args []string, ctx *zero.Ctx) {
 		return
 	}
 
-	s.cfg.Tasks = append(s.cfg.Tasks, ScheduleTask{
-		ActionTime:  args[0],
+	task := ScheduleTask{
+		ActionTime:  actionTime,
 		ActionTimes: times,
 		TaskType:    STaskType(types),
 		Interval:    args[2],
 		TaskData:    strings.ReplaceAll(args[4], "\"", ""),
 		Group:       []int64{ctx.Event.GroupID},
-	})
-
-	e = core.SaveCustomConfigToFile(core.GetSubDirFilePath("scheduler.yml"), s.cfg)
+	}
+	s.lock.Lock()
+	s.cfg.Tasks = append(s.cfg.Tasks, task)
+	s.rebuildLocked()
+	s.notifyLocked()
+	e = s.saveLocked()
+	s.lock.Unlock()
 	if e != nil {
-		core.LogError("[ScheduleMgr] failed to save scheduler.yml err: %v", e)
+		s.log.Error("failed to save scheduler.yml err: %v", e)
+	}
+
+	ctx.SendGroupMessage(ctx.Event.GroupID, fmt.Sprintf("成功添加! %v", task))
+}
+
+type ScheduleTaskItem struct {
+	Id int `json:"id"`
+	ScheduleTask
+}
+
+func getScheduleMgr() (*ScheduleMgr, error) {
+	if mgr := core.GetModuleMgr(); mgr != nil {
+		if m := mgr.GetModule("schedule"); m != nil {
+			if s, ok := (*m).(*ScheduleMgr); ok && s.running {
+				return s, nil
+			}
+		}
 	}
+	return nil, core.NewApiError(http.StatusServiceUnavailable, "module schedule is not loaded")
+}
 
+func (s *ScheduleMgr) listTasks() []ScheduleTaskItem {
 	s.lock.Lock()
-	heap.Push(&s.tasks, &taskItem{
-		ActionTime:  t,
-		ActionTimes: times,
-		Interval:    int64(dur),
-		id:          int64(len(s.tasks)),
-		index:       len(s.cfg.Tasks),
+	defer s.lock.Unlock()
+	return s.tasksLocked()
+}
+
+// tasksLocked numbers cfg.Tasks for the api, caller must hold s.lock
+func (s *ScheduleMgr) tasksLocked() []ScheduleTaskItem {
+	result := make([]ScheduleTaskItem, 0, len(s.cfg.Tasks))
+	for i, task := range s.cfg.Tasks {
+		result = append(result, ScheduleTaskItem{Id: i, ScheduleTask: task})
+	}
+	return result
+}
+
+// updateTasks applies fn to the task list, reschedules and saves scheduler.yml
+func (s *ScheduleMgr) updateTasks(fn func(tasks []ScheduleTask) ([]ScheduleTask, error)) ([]ScheduleTaskItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tasks, err := fn(s.cfg.Tasks)
+	if err != nil {
+		return nil, err
+	}
+	s.cfg.Tasks = tasks
+	s.rebuildLocked()
+	s.notifyLocked()
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+	return s.tasksLocked(), nil
+}
+
+func validateTask(task *ScheduleTask) error {
+	if err := (&ScheduleCfg{Tasks: []ScheduleTask{*task}}).Validate(); err != nil {
+		return core.NewApiError(http.StatusBadRequest, "%v", err)
+	}
+	return nil
+}
+
+func apiListTasks(_ *http.Request, _ *core.NoBody) ([]ScheduleTaskItem, error) {
+	s, err := getScheduleMgr()
+	if err != nil {
+		return nil, err
+	}
+	return s.listTasks(), nil
+}
+
+func apiCreateTask(_ *http.Request, req *ScheduleTask) ([]ScheduleTaskItem, error) {
+	s, err := getScheduleMgr()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTask(req); err != nil {
+		return nil, err
+	}
+	return s.updateTasks(func(tasks []ScheduleTask) ([]ScheduleTask, error) {
+		return append(tasks, *req), nil
 	})
-	s.lock.Unlock()
+}
 
-	ctx.SendGroupMessage(ctx.Event.GroupID, fmt.Sprintf("成功添加! %v", s.cfg.Tasks[len(s.cfg.Tasks)-1]))
+func apiUpdateTask(r *http.Request, req *ScheduleTask) ([]ScheduleTaskItem, error) {
+	s, err := getScheduleMgr()
+	if err != nil {
+		return nil, err
+	}
+	id, err := core.PathInt(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTask(req); err != nil {
+		return nil, err
+	}
+	return s.updateTasks(func(tasks []ScheduleTask) ([]ScheduleTask, error) {
+		if id < 0 || int(id) >= len(tasks) {
+			return nil, core.NewApiError(http.StatusNotFound, "task %d not found", id)
+		}
+		tasks[id] = *req
+		return tasks, nil
+	})
+}
+
+func apiDeleteTask(r *http.Request, _ *core.NoBody) ([]ScheduleTaskItem, error) {
+	s, err := getScheduleMgr()
+	if err != nil {
+		return nil, err
+	}
+	id, err := core.PathInt(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	return s.updateTasks(func(tasks []ScheduleTask) ([]ScheduleTask, error) {
+		if id < 0 || int(id) >= len(tasks) {
+			return nil, core.NewApiError(http.StatusNotFound, "task %d not found", id)
+		}
+		return append(tasks[:id], tasks[id+1:]...), nil
+	})
 }
 
 func init() {
+	core.RegisterModuleConfig("schedule", "scheduler.yml", func() any { return &ScheduleCfg{} })
+	core.RegisterAdminView("scheduled_tasks", func() (any, error) {
+		cfg := &ScheduleCfg{}
+		err := core.LoadCustomConfigFromFile(core.GetSubDirFilePath("scheduler.yml"), cfg)
+		return cfg.Tasks, err
+	})
+	core.RegisterApi("GET", "/schedule/tasks", "List scheduled tasks", apiListTasks)
+	core.RegisterApi("POST", "/schedule/tasks", "Create a scheduled task", apiCreateTask)
+	core.RegisterApi("PUT", "/schedule/tasks/{id}", "Replace a scheduled task", apiUpdateTask)
+	core.RegisterApi("DELETE", "/schedule/tasks/{id}", "Delete a scheduled task", apiDeleteTask)
+	core.DescribeModule("schedule", "Sends messages to groups at scheduled times")
 	core.RegisterNamed("schedule", func() core.IModule {
-		return &ScheduleMgr{}
+		return &ScheduleMgr{log: core.Common.Logger.Named("schedule")}
 	})
 }
@@ -1,24 +1,32 @@
 package modules
 
 import (
+	"context"
 	"github.com/derekparker/trie"
 	lru "github.com/hashicorp/golang-lru"
 	"gorm.io/gorm"
 	"marmot/core"
 	zero "marmot/onebot"
+	"net/http"
 )
 
 type Template struct {
-	Id      int64 `gorm:"primaryKey"`
-	Trigger string
-	Content string
-	Removed bool
+	Id      int64  `gorm:"primaryKey" json:"id"`
+	Trigger string `json:"trigger"`
+	Content string `json:"content"`
+	Removed bool   `json:"removed"`
+}
+
+type TemplateReq struct {
+	Trigger string `json:"trigger"`
+	Content string `json:"content"`
 }
 
 type TemplateEngine struct {
 	db      *gorm.DB
 	buffer  *lru.Cache
 	matcher *trie.Trie
+	log     *core.Logger
 }
 
 func (t *TemplateEngine) OnMsg(ctx *zero.Ctx) {
@@ -76,7 +84,7 @@ func (t *TemplateEngine) Init(mgr *core.ModuleMgr) bool {
 	return true
 }
 
-func (t *TemplateEngine) Stop(_ *core.ModuleMgr) {
+func (t *TemplateEngine) Stop(_ context.Context, _ *core.ModuleMgr) {
 	t.close()
 }
 
@@ -86,7 +94,7 @@ func (t *TemplateEngine) Reload(_ *core.ModuleMgr) {
 
 	cache, err := lru.New(core.AppConfig.MessageBufSize)
 	if err != nil {
-		core.LogError("[Template] (Reload) failed to create lru cache for TemplateEngine: %v", err)
+		t.log.Error("(Reload) failed to create lru cache for TemplateEngine: %v", err)
 		return
 	}
 	t.buffer = cache
@@ -97,21 +105,17 @@ func (t *TemplateEngine) Reload(_ *core.ModuleMgr) {
 
 func newTemplateEngine() *TemplateEngine {
 	engine := &TemplateEngine{
-		db: core.Common.Database.Db,
+		db:  core.Common.Database.Db,
+		log: core.Common.Logger.Named("template"),
 	}
 	if engine.db == nil {
-		core.LogError("[TemplateEngine] failed to connect to database")
+		engine.log.Error("failed to connect to database")
 		panic("[TemplateEngine] failed to connect to database")
 	}
-	err := engine.db.AutoMigrate(&Template{})
-	if err != nil {
-		core.LogError("[Template] failed to set auto-migrate: %v", err)
-		return nil
-	}
 
 	cache, err := lru.New(core.AppConfig.MessageBufSize)
 	if err != nil {
-		core.LogError("[Template] failed to create lru cache for TemplateEngine: %v", err)
+		engine.log.Error("failed to create lru cache for TemplateEngine: %v", err)
 		return nil
 	}
 	engine.buffer = cache
@@ -123,21 +127,17 @@ func newTemplateEngine() *TemplateEngine {
 }
 
 func (t *TemplateEngine) loadTriggers() {
-	var triggers []string
+	var items []Template
 	if err := t.db.Model(&Template{}).
+		Select("id", "trigger").
 		Where("removed = ?", false).
-		Pluck("trigger", &triggers).Error; err != nil {
-		core.LogError("[Template] failed to load Triggers: %v", err)
-		return
-	}
-	var ids []int64
-	if err := t.db.Model(&Template{}).Select("id").Pluck("id", &ids).Error; err != nil {
-		core.LogError("[Template] failed to load ids: %v", err)
+		Find(&items).Error; err != nil {
+		t.log.Error("failed to load Triggers: %v", err)
 		return
 	}
 
-	for idx, trig := range triggers {
-		t.matcher.Add(trig, ids[idx])
+	for _, item := range items {
+		t.matcher.Add(item.Trigger, item.Id)
 	}
 }
 
@@ -170,7 +170,7 @@ func (t *TemplateEngine) GetTemplateById(id int64) *Template {
 	var template Template
 	r := t.db.Where("id = ?", id).First(&template)
 	if r.Error != nil {
-		core.LogError("[Template] failed to find template by id: %v", r.Error)
+		t.log.Error("failed to find template by id: %v", r.Error)
 		return nil
 	}
 	return &template
@@ -180,7 +180,7 @@ func (t *TemplateEngine) GetTemplateByName(name string) *Template {
 	var template Template
 	r := t.db.Where("trigger = ?", name).First(&template)
 	if r.Error != nil {
-		core.LogError("[Template] failed to find template by id: %v", r.Error)
+		t.log.Error("failed to find template by id: %v", r.Error)
 		return nil
 	}
 	return &template
@@ -190,7 +190,7 @@ func (t *TemplateEngine) GetTemplateByTrigger(trigger string) *Template {
 	var template Template
 	r := t.db.Where("trigger = ?", trigger).First(&template)
 	if r.Error != nil {
-		core.LogError("[Template] failed to find template by trigger: %v", r.Error)
+		t.log.Error("failed to find template by trigger: %v", r.Error)
 		return nil
 	}
 	return &template
@@ -210,11 +210,11 @@ func (t *TemplateEngine) addTemplate(trigger string, content string) int64 {
 
 	r := core.Common.Database.Insert(&tmp)
 	if r != nil {
-		core.LogError("[Template] failed to insert template: %v", r.Error)
+		t.log.Error("failed to insert template: %v", r)
 		return -1
 	}
 
-	t.buffer.Add(tmp.Id, tmp)
+	t.buffer.Add(trigger, &tmp)
 	t.matcher.Add(trigger, tmp.Id)
 
 	return tmp.Id
@@ -224,10 +224,11 @@ func (t *TemplateEngine) RemoveTemplateById(id int64) {
 	var out Template
 	r := t.db.Where("id = ?", id).First(&out)
 	if r.Error != nil {
-		core.LogError("[Template] failed to find template by id: %v", r.Error)
+		t.log.Error("failed to find template by id: %v", r.Error)
+		return
 	}
 
-	t.buffer.Remove(out.Id)
+	t.buffer.Remove(out.Trigger)
 	t.matcher.Remove(out.Trigger)
 	t.remove(&out)
 }
@@ -240,9 +241,12 @@ func (t *TemplateEngine) remove(tm *Template) {
 	tm.Content = ""
 	tm.Trigger = ""
 
-	r := core.Common.Database.Update(tm)
+	// Updates skips zero values of a struct, use a map to clear the trigger
+	r := core.Common.Database.Transaction(func(tx *gorm.DB) error {
+		return tx.Model(&Template{Id: tm.Id}).Updates(map[string]any{"removed": true, "trigger": "", "content": ""}).Error
+	})
 	if r != nil {
-		core.LogError("[Template] failed to remove template, error %v", r.Error)
+		t.log.Error("failed to remove template, error %v", r)
 	}
 }
 
@@ -250,23 +254,121 @@ func (t *TemplateEngine) Update(tm *Template) {
 	var out Template
 	r := t.db.Where("id = ?", tm.Id).First(&out)
 	if r.Error != nil {
-		core.LogError("[Template] failed to update template: %v", r.Error)
+		t.log.Error("failed to update template: %v", r.Error)
+		return
 	}
 
+	t.buffer.Remove(out.Trigger)
 	if out.Trigger != tm.Trigger {
 		t.matcher.Remove(out.Trigger)
 		t.matcher.Add(tm.Trigger, tm.Id)
 	}
 
-	rt := core.Common.Database.Update(&tm)
+	rt := core.Common.Database.Update(tm)
 	if rt != nil {
-		core.LogError("[Template] failed to update template, error %v", rt.Error)
+		t.log.Error("failed to update template, error %v", rt)
+	}
+}
+
+func getTemplateEngine() (*TemplateEngine, error) {
+	if mgr := core.GetModuleMgr(); mgr != nil {
+		if m := mgr.GetModule("template"); m != nil {
+			if t, ok := (*m).(*TemplateEngine); ok && t.db != nil {
+				return t, nil
+			}
+		}
+	}
+	return nil, core.NewApiError(http.StatusServiceUnavailable, "module template is not loaded")
+}
+
+func listTemplates() ([]Template, error) {
+	var items []Template
+	r := core.Common.Database.Db.Where("removed = ?", false).Order("id").Find(&items)
+	return items, r.Error
+}
+
+func (t *TemplateEngine) findTemplate(r *http.Request) (*Template, error) {
+	id, err := core.PathInt(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	tm := t.GetTemplateById(id)
+	if tm == nil || tm.Removed {
+		return nil, core.NewApiError(http.StatusNotFound, "template %d not found", id)
+	}
+	return tm, nil
+}
+
+func apiListTemplates(_ *http.Request, _ *core.NoBody) ([]Template, error) {
+	return listTemplates()
+}
+
+func apiCreateTemplate(_ *http.Request, req *TemplateReq) (*Template, error) {
+	t, err := getTemplateEngine()
+	if err != nil {
+		return nil, err
+	}
+	if req.Trigger == "" || req.Content == "" {
+		return nil, core.NewApiError(http.StatusBadRequest, "trigger and content are required")
+	}
+	id := t.addTemplate(req.Trigger, req.Content)
+	if id == -1 {
+		return nil, core.NewApiError(http.StatusConflict, "trigger %s already exists", req.Trigger)
+	}
+	return t.GetTemplateById(id), nil
+}
+
+func apiUpdateTemplate(r *http.Request, req *TemplateReq) (*Template, error) {
+	t, err := getTemplateEngine()
+	if err != nil {
+		return nil, err
+	}
+	if req.Trigger == "" || req.Content == "" {
+		return nil, core.NewApiError(http.StatusBadRequest, "trigger and content are required")
 	}
+	tm, err := t.findTemplate(r)
+	if err != nil {
+		return nil, err
+	}
+	if other := t.GetTemplateByTrigger(req.Trigger); other != nil && other.Id != tm.Id {
+		return nil, core.NewApiError(http.StatusConflict, "trigger %s already exists", req.Trigger)
+	}
+	tm.Trigger, tm.Content = req.Trigger, req.Content
+	t.Update(tm)
+	return tm, nil
+}
+
+func apiDeleteTemplate(r *http.Request, _ *core.NoBody) (*Template, error) {
+	t, err := getTemplateEngine()
+	if err != nil {
+		return nil, err
+	}
+	tm, err := t.findTemplate(r)
+	if err != nil {
+		return nil, err
+	}
+	t.RemoveTemplateById(tm.Id)
+	return tm, nil
 }
 
 // register to global map
 func init() {
+	core.RegisterAdminView("templates", func() (any, error) {
+		return listTemplates()
+	})
+	core.RegisterApi("GET", "/templates", "List templates", apiListTemplates)
+	core.RegisterApi("POST", "/templates", "Create a template", apiCreateTemplate)
+	core.RegisterApi("PUT", "/templates/{id}", "Update a template", apiUpdateTemplate)
+	core.RegisterApi("DELETE", "/templates/{id}", "Delete a template", apiDeleteTemplate)
+	core.DescribeModule("template", "Replies with saved templates when a trigger is sent")
 	core.RegisterNamed("template", func() core.IModule {
 		return newTemplateEngine()
 	})
+	core.RegisterDataModels("template", &Template{})
+	core.RegisterMigrations("template", core.Migration{
+		Name: "create_templates",
+		// frozen DDL of Template at v1, schema changes go into a new migration
+		UpSQL:   "CREATE TABLE IF NOT EXISTS `templates` (`id` integer PRIMARY KEY AUTOINCREMENT,`trigger` text,`content` text,`removed` numeric)",
+		DownSQL: "DROP TABLE IF EXISTS `templates`",
+	})
 }
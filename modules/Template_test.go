@@ -0,0 +1,44 @@
+package modules_test
+
+import (
+	"marmot/core"
+	"marmot/modules"
+	"marmot/simulator"
+	"testing"
+)
+
+func TestTemplateExportImport(t *testing.T) {
+	sim, err := simulator.New(simulator.Options{Modules: []string{"template"}})
+	if err != nil {
+		t.Fatalf("failed to boot simulator: %v", err)
+	}
+	t.Cleanup(sim.Close)
+
+	for _, msg := range []string{".AddTem hi hello", ".AddTem bye ciao", ".DelTem bye"} {
+		if _, err := sim.GroupMessage(20000, simulator.Admin(30000), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := core.ExportModule("template")
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if err := core.ImportModule("template", path); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+
+	var items []modules.Template
+	if err := core.Common.Database.Db.Order("id").Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 templates after the round trip, got %v", items)
+	}
+	if items[0].Removed || items[0].Content != "hello" {
+		t.Fatalf("alive template changed by the round trip: %+v", items[0])
+	}
+	if !items[1].Removed {
+		t.Fatalf("removed template came back after the import: %+v", items[1])
+	}
+}
@@ -1,9 +1,11 @@
 package modules
 
 import (
+	"context"
 	"marmot/core"
 	zero "marmot/onebot"
 	"marmot/onebot/message"
+	"strings"
 	"sync"
 )
 
@@ -25,6 +27,7 @@ func (t TriggerConfig) CreateDefaultConfig() interface{} {
 type Trigger struct {
 	cfg *TriggerConfig
 	mtx *sync.Mutex
+	log *core.Logger
 }
 
 func (t *Trigger) Init(mgr *core.ModuleMgr) bool {
@@ -34,7 +37,7 @@ func (t *Trigger) Init(mgr *core.ModuleMgr) bool {
 	pth := core.GetSubDirFilePath("trigger.yml")
 	r := core.InitCustomConfig[TriggerConfig](t.cfg, pth)
 	if r != nil {
-		core.LogError("[Trigger] Failed to load trigger.yml error: %v", r)
+		t.log.Error("Failed to load trigger.yml error: %v", r)
 		return false
 	}
 
@@ -47,17 +50,17 @@ func (t *Trigger) Init(mgr *core.ModuleMgr) bool {
 	return true
 }
 
-func (t *Trigger) Stop(_ *core.ModuleMgr) {
+func (t *Trigger) Stop(_ context.Context, _ *core.ModuleMgr) {
 	r := core.SaveCustomConfigToFile(core.GetSubDirFilePath("trigger.yml"), t.cfg)
 	if r != nil {
-		core.LogError("[Trigger] Failed to save trigger.yml error: %v", r)
+		t.log.Error("Failed to save trigger.yml error: %v", r)
 	}
 	t.cfg = nil
 }
 
 func (t *Trigger) Reload(mgr *core.ModuleMgr) {
 	t.Init(mgr)
-	t.Stop(mgr)
+	t.Stop(core.Context(), mgr)
 }
 
 func (t *Trigger) isGroupInTrigger(id int64) bool {
@@ -76,13 +79,13 @@ func (t *Trigger) onGroupJoin(ctx *zero.Ctx) {
 	}
 	item, ok := t.cfg.ActionGroups[id]
 	if !ok {
-		core.LogError("[Trigger] Failed to get group info for id %v", id)
+		t.log.Error("Failed to get group info for id %v", id)
 		return
 	}
 	if len(item.GroupJoinMsg) == 0 {
 		return
 	}
-	ctx.SendGroupMessage(ctx.Event.GroupID, core.MakeReply(message.At(ctx.Event.UserID), message.Text(item.GroupJoinMsg)))
+	ctx.SendGroupMessage(ctx.Event.GroupID, t.render(ctx, item.GroupJoinMsg))
 }
 
 func (t *Trigger) onGroupQuit(ctx *zero.Ctx) {
@@ -94,12 +97,26 @@ func (t *Trigger) onGroupQuit(ctx *zero.Ctx) {
 	if len(item.GroupLeaveMsg) == 0 {
 		return
 	}
-	ctx.SendGroupMessage(ctx.Event.GroupID, core.MakeReply(message.At(ctx.Event.Sender.ID), message.Text(item.GroupLeaveMsg)))
+	ctx.SendGroupMessage(ctx.Event.GroupID, t.render(ctx, item.GroupLeaveMsg))
+}
+
+// render fills the template of the group, messages without a mention of
+// their own start with one of the user like before templates
+func (t *Trigger) render(ctx *zero.Ctx, tmpl string) message.Message {
+	msg := ctx.Render(tmpl, nil)
+	if !strings.Contains(tmpl, "{at:") {
+		msg = append(core.MakeReply(message.At(ctx.Event.UserID)), msg...)
+	}
+	return msg
 }
 
 func (t *Trigger) onSetGroupTrigger(args []string, ctx *zero.Ctx) {
 	if len(args) != 2 {
-		ctx.SendGroupMessage(ctx.Event.GroupID, message.Text("使用方法 SetGroupTrigger [welcome/leave] [msg]"))
+		ctx.SendGroupMessage(ctx.Event.GroupID, message.Text("使用方法 SetGroupTrigger [welcome/leave] [msg], msg 中可使用 {at:user} {name} {group.name} {face:id} 等模板"))
+		return
+	}
+	if message.UsesLocalFile(args[1]) && !core.CheckIsAdmin(ctx.Event.UserID) {
+		ctx.SendGroupMessage(ctx.Event.GroupID, message.Text("只有机器人管理员可以在模板中使用本地文件"))
 		return
 	}
 	t.mtx.Lock()
@@ -122,7 +139,7 @@ func (t *Trigger) onSetGroupTrigger(args []string, ctx *zero.Ctx) {
 	t.cfg.ActionGroups[id] = item
 	r := core.SaveCustomConfigToFile(core.GetSubDirFilePath("trigger.yml"), t.cfg)
 	if r != nil {
-		core.LogError("[Trigger] Failed to save trigger.yml error: %v", r)
+		t.log.Error("Failed to save trigger.yml error: %v", r)
 	}
 	t.mtx.Unlock()
 }
@@ -154,15 +171,18 @@ func (t *Trigger) onDelGroupTrigger(args []string, ctx *zero.Ctx) {
 	t.cfg.ActionGroups[id] = item
 	r := core.SaveCustomConfigToFile(core.GetSubDirFilePath("trigger.yml"), t.cfg)
 	if r != nil {
-		core.LogError("[Trigger] Failed to save trigger.yml error: %v", r)
+		t.log.Error("Failed to save trigger.yml error: %v", r)
 	}
 	t.mtx.Unlock()
 }
 
 func init() {
+	core.RegisterModuleConfig("trigger", "trigger.yml", func() any { return &TriggerConfig{} })
+	core.DescribeModule("trigger", "Welcome and farewell messages when members join or leave")
 	core.RegisterNamed("trigger", func() core.IModule {
 		return &Trigger{
 			mtx: &sync.Mutex{},
+			log: core.Common.Logger.Named("trigger"),
 		}
 	})
 }
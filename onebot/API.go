@@ -19,6 +19,7 @@ func (ctx *Ctx) CallAction(action string, params Params) APIResponse {
 		Params: params,
 	}
 	rsp, err := ctx.caller.CallAPI(req)
+	recordCall(req, rsp, err)
 	if err != nil {
 		LogError("[api] calling action failed, action type : %s error : %v", action, err)
 	}
@@ -487,9 +488,13 @@ func (ctx *Ctx) SendGuildChannelMessage(guildID, channelID string, message inter
 func (ctx *Ctx) NickName() (name string) {
 	//name = ctx.State["args"].(string)
 	//name = ""
-	if len(ctx.Event.Message) > 1 && ctx.Event.Message[1].Type == "at" {
-		qq, _ := strconv.ParseInt(ctx.Event.Message[1].Data["qq"], 10, 64)
-		name = ctx.GetGroupMemberInfo(ctx.Event.GroupID, qq, false).Get("nickname").Str
+	var at message.AtSeg
+	ok := false
+	if len(ctx.Event.Message) > 1 {
+		at, ok = ctx.Event.Message[1].AsAt()
+	}
+	if ok && !at.All {
+		name = ctx.GetGroupMemberInfo(ctx.Event.GroupID, at.QQ, false).Get("nickname").Str
 	} else { //  if name == ""
 		name = ctx.Event.Sender.NickName
 	}
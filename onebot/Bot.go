@@ -18,9 +18,13 @@ import (
 // Config is config of zero bot
 type Config struct {
 	NickName       []string      `json:"nickname"`         // 机器人名称
-	RingLen        uint          `json:"ring_len"`         // 事件环长度 (默认关闭)
-	Latency        time.Duration `json:"latency"`          // 事件处理延迟 (延迟 latency 再处理事件，在 ring 模式下不可低于 1ms)
+	RingLen        uint          `json:"ring_len"`         // 事件环长度 (默认关闭, 向上取整到 2 的幂)
+	RingPolicy     string        `json:"ring_policy"`      // 事件环满时的处理 (drop_oldest 默认, block, spill)
+	Latency        time.Duration `json:"latency"`          // 事件处理延迟 (ring 模式下为取出间隔, 0 则立即处理)
 	MaxProcessTime time.Duration `json:"max_process_time"` // 事件最大处理时间 (默认4min)
+	DedupWindow    time.Duration `json:"dedup_window"`     // 重复事件的检测窗口 (0 关闭)
+	Sequential     bool          `json:"sequential"`       // 同一会话的事件按顺序处理, 代替事件环
+	SequenceLen    uint          `json:"sequence_len"`     // 每个会话最多排队的事件数 (默认100, 满时丢弃最旧的事件)
 	Driver         Driver        `json:"-"`                // 通信驱动
 }
 
@@ -38,7 +42,9 @@ type Driver interface {
 var BotConfig Config
 
 var (
-	evring    *eventRing // evring 事件环
+	evring    *eventRing  // evring 事件环
+	evdedup   *eventDedup // 重复事件过滤
+	evseq     *sequencer  // 会话内顺序处理
 	isrunning uintptr
 )
 
@@ -47,24 +53,36 @@ func runinit(op *Config) {
 		op.MaxProcessTime = time.Minute * 4
 	}
 	BotConfig = *op
+	if op.DedupWindow > 0 {
+		evdedup = newEventDedup(op.DedupWindow)
+	}
+	if op.Sequential {
+		if op.RingLen != 0 {
+			LogWarn("[bot] sequential dispatch replaces the event ring, ring_len is ignored")
+		}
+		evseq = newSequencer(op.SequenceLen)
+		return
+	}
 	if op.RingLen == 0 {
 		return
 	}
-	evring = newring(op.RingLen)
+	evring = newring(op.RingLen, op.RingPolicy)
 	evring.loop(op.Latency, op.MaxProcessTime, processEventAsync)
 }
 
 func (op *Config) directlink(b []byte, c APICaller) {
-	go func() {
-		if op.Latency != 0 {
-			time.Sleep(op.Latency)
-		}
-		processEventAsync(b, c, op.MaxProcessTime)
-	}()
+	if op.Latency != 0 {
+		time.AfterFunc(op.Latency, func() {
+			processEventAsync(b, c, op.MaxProcessTime)
+		})
+		return
+	}
+	processEventAsync(b, c, op.MaxProcessTime)
 }
 
 var _handler func(ctx *Ctx)
 
+// RunAndBlock 启动驱动并分发事件, handler 在接收事件的协程中调用, 须尽快返回
 func RunAndBlock(op *Config, handler func(ctx *Ctx)) {
 	if handler == nil {
 		LogError("[bot] Handler is nil!")
@@ -76,11 +94,24 @@ func RunAndBlock(op *Config, handler func(ctx *Ctx)) {
 	}
 	runinit(op)
 	linkf := op.directlink
-	if op.RingLen != 0 {
+	switch {
+	case evseq != nil:
+		// parsed in the order of arrival, the sequencer keeps it per conversation
+		linkf = func(b []byte, c APICaller) {
+			processEventAsync(b, c, op.MaxProcessTime)
+		}
+	case op.RingLen != 0:
 		linkf = evring.processEvent
 	}
 	op.Driver.Connect()
-	op.Driver.Listen(linkf)
+	op.Driver.Listen(func(b []byte, c APICaller) {
+		if evdedup != nil && evdedup.duplicate(b) {
+			LogDebug("[bot] dropped duplicated event : %s", b)
+			return
+		}
+		recordEvent(b) // before going async so the recording keeps the order of arrival
+		linkf(b, c)
+	})
 }
 
 var (
@@ -119,8 +150,19 @@ func (m *messageLogger) CallAPI(request APIRequest) (rsp APIResponse, err error)
 	return
 }
 
-// processEventAsync 从池中处理事件, 异步调用匹配 mather
+// processEventAsync 从池中处理事件, handler 在当前协程中被调用, 不能阻塞,
+// 耗时的处理应交给有界的工作池
 func processEventAsync(response []byte, caller APICaller, maxwait time.Duration) {
+	ctx := ParseEvent(response, caller)
+	if evseq != nil {
+		evseq.dispatch(ctx)
+		return
+	}
+	_handler(ctx)
+}
+
+// ParseEvent 解析原始事件并创建上下文, 与驱动收到事件时的处理一致
+func ParseEvent(response []byte, caller APICaller) *Ctx {
 	var event Event
 	_ = json.Unmarshal(response, &event)
 	event.RawEvent = gjson.Parse(utils.BytesToString(response))
@@ -168,11 +210,10 @@ func processEventAsync(response []byte, caller APICaller, maxwait time.Duration)
 	if event.PostType == "message" {
 		preprocessMessageEvent(&event)
 	}
-	ctx := &Ctx{
+	return &Ctx{
 		Event:  &event,
 		caller: &messageLogger{msgid: msgid, caller: caller},
 	}
-	go _handler(ctx)
 }
 
 func preprocessMessageEvent(e *Event) {
@@ -198,9 +239,8 @@ func preprocessMessageEvent(e *Event) {
 			return
 		}
 		for _, m := range e.Message {
-			if m.Type == "at" {
-				qq, _ := strconv.ParseInt(m.Data["qq"], 10, 64)
-				if qq == e.SelfID {
+			if at, ok := m.AsAt(); ok {
+				if at.QQ == e.SelfID {
 					e.IsToMe = true
 					//if !BotConfig.KeepAtMeMessage {
 					//	e.Message = append(e.Message[:i], e.Message[i+1:]...)
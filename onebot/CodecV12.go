@@ -0,0 +1,431 @@
+package onebot
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/goccy/go-json"
+	"marmot/onebot/message"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// OneBot v12 support: frames of a v12 connection are translated to the v11
+// model at the connection level, so Event, Ctx and the modules stay unchanged.
+// https://12.onebot.dev/
+
+const protocolV12Prefix = "12."
+
+// v12 action names of the v11 actions used by Ctx
+var v12Actions = map[string]string{
+	"send_msg":          "send_message",
+	"send_group_msg":    "send_message",
+	"send_private_msg":  "send_message",
+	"delete_msg":        "delete_message",
+	"get_msg":           "get_message",
+	"get_login_info":    "get_self_info",
+	"get_stranger_info": "get_user_info",
+	"set_group_leave":   "leave_group",
+	"get_version_info":  "get_version",
+}
+
+// v12 segment types of v11 media segments, they are sent by file_id
+var v12MediaTypes = map[string]string{
+	"image":  "image",
+	"record": "voice",
+	"video":  "video",
+	"file":   "file",
+}
+
+type cachedRole struct {
+	role    string
+	expires time.Time
+}
+
+// v12Codec translates the frames of one v12 connection, the string ids of
+// v12 are mapped by stringIDs
+type v12Codec struct {
+	*stringIDs
+	caller *WSSCaller
+	roles  *genMap[string, cachedRole]
+}
+
+func newV12Codec(caller *WSSCaller) *v12Codec {
+	return &v12Codec{
+		stringIDs: newStringIDs(),
+		caller:    caller,
+		roles:     newGenMap[string, cachedRole](5000),
+	}
+}
+
+// run converts the events of the connection in order until frames is closed,
+// converting never calls the api, so the read loop feeding frames can always
+// deliver the responses
+func (c *v12Codec) run(frames <-chan []byte, handler func([]byte, APICaller)) {
+	for payload := range frames {
+		if event := c.event(payload); event != nil {
+			handler(event, c.caller)
+		}
+	}
+}
+
+func isV12Frame(payload []byte) bool {
+	frame := gjson.ParseBytes(payload)
+	return frame.Get("type").Exists() && frame.Get("detail_type").Exists()
+}
+
+// v12SelfID finds the bot account in a v12 event, status_update carries it in
+// its bot list and other events in their self object
+func v12SelfID(frame gjson.Result) string {
+	if id := frame.Get("self.user_id").String(); id != "" {
+		return id
+	}
+	return frame.Get("status.bots.0.self.user_id").String()
+}
+
+// event converts a v12 event into a v11 payload, nil drops it
+func (c *v12Codec) event(payload []byte) []byte {
+	frame := gjson.ParseBytes(payload)
+	detail := frame.Get("detail_type").String()
+	event := map[string]any{
+		"time":     int64(frame.Get("time").Float()),
+		"self_id":  c.toInt(v12SelfID(frame)),
+		"sub_type": frame.Get("sub_type").String(),
+	}
+
+	switch frame.Get("type").String() {
+	case "message":
+		if detail == "channel" {
+			return nil // guild channels have no v11 counterpart
+		}
+		c.messageEvent(frame, event)
+	case "notice":
+		c.noticeEvent(frame, event)
+	case "request":
+		event["post_type"] = "request"
+		event["request_type"] = detail
+		event["user_id"] = c.toInt(frame.Get("user_id").String())
+		event["group_id"] = c.toInt(frame.Get("group_id").String())
+		event["comment"] = frame.Get("message").String()
+		event["flag"] = frame.Get("request_id").String()
+	case "meta":
+		event["post_type"] = "meta_event"
+		switch detail {
+		case "heartbeat":
+			event["meta_event_type"] = "heartbeat"
+			event["interval"] = frame.Get("interval").Int()
+		case "connect":
+			event["meta_event_type"] = "lifecycle"
+			event["sub_type"] = "connect"
+		default:
+			event["meta_event_type"] = detail
+			event["status"] = json.RawMessage(frame.Get("status").Raw)
+		}
+	default:
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		LogWarn("[v12] failed to convert event %s: %v", detail, err)
+		return nil
+	}
+	return data
+}
+
+func (c *v12Codec) messageEvent(frame gjson.Result, event map[string]any) {
+	msg := c.toV11Message(frame.Get("message"))
+	userID := c.toInt(frame.Get("user_id").String())
+	event["post_type"] = "message"
+	event["message_id"] = c.toInt(frame.Get("message_id").String())
+	event["user_id"] = userID
+	event["message"] = msg
+	event["raw_message"] = msg.String()
+
+	sender := map[string]any{"user_id": userID}
+	switch detail := frame.Get("detail_type").String(); detail {
+	case "group":
+		groupID := c.toInt(frame.Get("group_id").String())
+		event["message_type"] = "group"
+		event["group_id"] = groupID
+		if event["sub_type"] == "" {
+			event["sub_type"] = "normal"
+		}
+		// v12 events carry no sender role, command permissions rely on it
+		if role := c.memberRole(frame.Get("group_id").String(), frame.Get("user_id").String()); role != "" {
+			sender["role"] = role
+		}
+	default:
+		event["message_type"] = detail
+		if event["sub_type"] == "" {
+			event["sub_type"] = "friend"
+		}
+	}
+	event["sender"] = sender
+}
+
+// memberRole returns the cached role of a member. The codec runs in front of
+// the read loop and must not wait for api responses, unknown roles are left
+// empty and looked up by Ctx.SenderRole on a worker, which fills the cache
+// through rememberRole.
+func (c *v12Codec) memberRole(groupID, userID string) string {
+	if cached, ok := c.roles.Get(groupID + ":" + userID); ok && time.Now().Before(cached.expires) {
+		return cached.role
+	}
+	return ""
+}
+
+// rememberRole caches the role of a get_group_member_info response for a
+// few minutes, so only the first message of a member costs a request
+func (c *v12Codec) rememberRole(params map[string]any, rsp APIResponse) {
+	if rsp.RetCode != 0 {
+		return
+	}
+	role := rsp.Data.Get("role").String() // extended field of most implementations
+	if role == "" {
+		role = "member"
+	}
+	key := fmt.Sprint(params["group_id"]) + ":" + fmt.Sprint(params["user_id"])
+	c.roles.Set(key, cachedRole{role: role, expires: time.Now().Add(5 * time.Minute)})
+}
+
+func (c *v12Codec) noticeEvent(frame gjson.Result, event map[string]any) {
+	event["post_type"] = "notice"
+	event["group_id"] = c.toInt(frame.Get("group_id").String())
+	event["user_id"] = c.toInt(frame.Get("user_id").String())
+	event["operator_id"] = c.toInt(frame.Get("operator_id").String())
+
+	switch detail := frame.Get("detail_type").String(); detail {
+	case "group_member_increase":
+		event["notice_type"] = "group_increase"
+		if event["sub_type"] == "join" || event["sub_type"] == "" {
+			event["sub_type"] = "approve"
+		}
+	case "group_member_decrease":
+		event["notice_type"] = "group_decrease"
+	case "group_message_delete":
+		event["notice_type"] = "group_recall"
+		event["message_id"] = c.toInt(frame.Get("message_id").String())
+	case "private_message_delete":
+		event["notice_type"] = "friend_recall"
+		event["message_id"] = c.toInt(frame.Get("message_id").String())
+	case "friend_increase":
+		event["notice_type"] = "friend_add"
+	default:
+		event["notice_type"] = detail
+	}
+}
+
+// toV11Message converts v12 segments into v11 ones, unknown segments keep
+// their type and stringified data
+func (c *v12Codec) toV11Message(msg gjson.Result) message.Message {
+	if !msg.IsArray() {
+		return message.Message{message.Text(msg.String())}
+	}
+	result := make(message.Message, 0, len(msg.Array()))
+	msg.ForEach(func(_, seg gjson.Result) bool {
+		data := make(map[string]string)
+		seg.Get("data").ForEach(func(k, v gjson.Result) bool {
+			data[k.String()] = v.String()
+			return true
+		})
+		switch tp := seg.Get("type").String(); tp {
+		case "mention":
+			result = append(result, message.At(c.toInt(data["user_id"])))
+		case "mention_all":
+			result = append(result, message.AtAll())
+		case "reply":
+			result = append(result, message.Reply(c.toInt(data["message_id"])))
+		case "voice", "audio":
+			data["file"] = data["file_id"]
+			result = append(result, message.Segment{Type: "record", Data: data})
+		case "image", "video", "file":
+			data["file"] = data["file_id"]
+			result = append(result, message.Segment{Type: tp, Data: data})
+		case "location":
+			data["lat"], data["lon"] = data["latitude"], data["longitude"]
+			result = append(result, message.Segment{Type: tp, Data: data})
+		default:
+			result = append(result, message.Segment{Type: tp, Data: data})
+		}
+		return true
+	})
+	return result
+}
+
+// toV12Message converts a v11 message param (CQ string, Segment or
+// Message) into v12 segments, media is uploaded first to get its file_id
+func (c *v12Codec) toV12Message(v any) ([]map[string]any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if parsed := gjson.ParseBytes(raw); parsed.IsObject() {
+		raw = append(append([]byte{'['}, raw...), ']')
+	}
+
+	msg := message.ParseMessage(raw)
+	result := make([]map[string]any, 0, len(msg))
+	for _, seg := range msg {
+		out := map[string]any{"type": seg.Type}
+		data := make(map[string]any, len(seg.Data))
+		switch seg.Type {
+		case "text":
+			data["text"] = seg.Data["text"]
+		case "at":
+			if seg.Data["qq"] == "all" {
+				out["type"] = "mention_all"
+			} else {
+				out["type"] = "mention"
+				data["user_id"] = c.anyToStr(seg.Data["qq"])
+			}
+		case "reply":
+			data["message_id"] = c.anyToStr(seg.Data["id"])
+		case "location":
+			data["latitude"], _ = strconv.ParseFloat(seg.Data["lat"], 64)
+			data["longitude"], _ = strconv.ParseFloat(seg.Data["lon"], 64)
+			data["title"] = seg.Data["title"]
+			data["content"] = seg.Data["content"]
+		default:
+			if tp, ok := v12MediaTypes[seg.Type]; ok {
+				fileID, err := c.upload(seg.Data["file"], seg.Data["name"])
+				if err != nil {
+					return nil, fmt.Errorf("failed to upload %s: %w", seg.Type, err)
+				}
+				out["type"] = tp
+				data["file_id"] = fileID
+				break
+			}
+			for k, v := range seg.Data {
+				data[k] = v
+			}
+		}
+		out["data"] = data
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+// upload turns a v11 file reference (url, base64:// or file://) into a v12
+// file_id, anything else is assumed to be a file_id already
+func (c *v12Codec) upload(file, name string) (string, error) {
+	params := map[string]any{}
+	switch {
+	case strings.HasPrefix(file, "http://"), strings.HasPrefix(file, "https://"):
+		params["type"], params["url"] = "url", file
+	case strings.HasPrefix(file, "base64://"):
+		if _, err := base64.StdEncoding.DecodeString(file[len("base64://"):]); err != nil {
+			return "", err
+		}
+		params["type"], params["data"] = "data", file[len("base64://"):]
+	case strings.HasPrefix(file, "file://"):
+		path := strings.TrimPrefix(strings.TrimPrefix(file, "file://"), "/")
+		params["type"], params["path"] = "path", "/"+path
+		if name == "" {
+			name = filepath.Base(path)
+		}
+	default:
+		return file, nil
+	}
+	if name == "" {
+		name = "file"
+	}
+	params["name"] = name
+
+	rsp, err := c.caller.callRaw("upload_file", params)
+	if err != nil {
+		return "", err
+	}
+	if rsp.RetCode != 0 {
+		return "", fmt.Errorf("retcode %d: %s", rsp.RetCode, rsp.Message)
+	}
+	return rsp.Data.Get("file_id").String(), nil
+}
+
+// request converts a v11 action into its v12 name and params
+func (c *v12Codec) request(req APIRequest) (string, map[string]any, error) {
+	action := req.Action
+	if name, ok := v12Actions[action]; ok {
+		action = name
+	}
+	params := make(map[string]any, len(req.Params)+1)
+	for k, v := range req.Params {
+		switch k {
+		case "group_id", "user_id", "message_id":
+			params[k] = c.anyToStr(v)
+		case "message":
+			msg, err := c.toV12Message(v)
+			if err != nil {
+				return "", nil, err
+			}
+			params[k] = msg
+		default:
+			params[k] = v
+		}
+	}
+
+	if action == "send_message" {
+		switch {
+		case req.Action == "send_group_msg", req.Params["message_type"] == "group":
+			params["detail_type"] = "group"
+		case req.Action == "send_private_msg", req.Params["message_type"] == "private":
+			params["detail_type"] = "private"
+		case params["group_id"] != nil && params["group_id"] != "0":
+			params["detail_type"] = "group"
+		default:
+			params["detail_type"] = "private"
+		}
+		delete(params, "message_type")
+	}
+	return action, params, nil
+}
+
+// response converts the data of a v12 response into v11 fields
+func (c *v12Codec) response(rsp APIResponse) APIResponse {
+	if !rsp.Data.IsObject() && !rsp.Data.IsArray() {
+		return rsp
+	}
+	var converted any
+	if rsp.Data.IsArray() {
+		items := make([]any, 0, len(rsp.Data.Array()))
+		for _, item := range rsp.Data.Array() {
+			items = append(items, c.responseObject(item))
+		}
+		converted = items
+	} else {
+		converted = c.responseObject(rsp.Data)
+	}
+	if data, err := json.Marshal(converted); err == nil {
+		rsp.Data = gjson.ParseBytes(data)
+	}
+	return rsp
+}
+
+func (c *v12Codec) responseObject(obj gjson.Result) any {
+	if !obj.IsObject() {
+		return json.RawMessage(obj.Raw)
+	}
+	result := make(map[string]any)
+	obj.ForEach(func(k, v gjson.Result) bool {
+		key := k.String()
+		switch key {
+		case "message_id", "user_id", "group_id":
+			result[key] = c.toInt(v.String())
+		case "message":
+			result[key] = c.toV11Message(v)
+		case "user_name":
+			result["nickname"] = v.String()
+			result[key] = v.String()
+		case "user_displayname":
+			result["card"] = v.String()
+			result[key] = v.String()
+		default:
+			result[key] = json.RawMessage(v.Raw)
+		}
+		return true
+	})
+	return result
+}
@@ -0,0 +1,260 @@
+package onebot
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConsoleDriver turns lines of stdin (or a local tcp REPL) into message
+// events and prints every api call, used to develop modules without an
+// OneBot adapter. Lines starting with "/" change the simulated sender,
+// "//" escapes a message that itself starts with "/".
+type ConsoleDriver struct {
+	SelfID     int64
+	UserID     int64
+	GroupID    int64  // 0 sends private messages
+	Role       string // member/admin/owner
+	Nickname   string
+	ListenAddr string // serve a tcp REPL instead of stdin when not empty
+
+	mu  sync.Mutex // guards out and the sender fields
+	out io.Writer
+	seq atomic.Int64
+}
+
+// NewConsoleDriver creates a driver reading stdin as user in group
+func NewConsoleDriver(selfID, userID, groupID int64, role string) *ConsoleDriver {
+	if role == "" {
+		role = "member"
+	}
+	return &ConsoleDriver{
+		SelfID:   selfID,
+		UserID:   userID,
+		GroupID:  groupID,
+		Role:     role,
+		Nickname: "console",
+		out:      os.Stdout,
+	}
+}
+
+func (d *ConsoleDriver) Connect() {
+	APICallers.Store(d.SelfID, d)
+	LogInfo("[console] console driver connected as QQ account : %d", d.SelfID)
+	observeConnect(d.SelfID)
+}
+
+func (d *ConsoleDriver) Listen(handler func([]byte, APICaller)) {
+	if d.ListenAddr == "" {
+		d.serve(os.Stdin, os.Stdout, handler)
+		LogInfo("[console] stdin closed")
+		select {} // keep blocking like other drivers
+	}
+
+	lstn, err := net.Listen("tcp", d.ListenAddr)
+	if err != nil {
+		LogError("[console] failed to listen at %s: %v", d.ListenAddr, err)
+		return
+	}
+	LogInfo("[console] REPL listening at %s", lstn.Addr())
+	for {
+		conn, err := lstn.Accept()
+		if err != nil {
+			LogWarn("[console] failed to accept REPL connection: %v", err)
+			continue
+		}
+		d.serve(conn, conn, handler)
+		_ = conn.Close()
+	}
+}
+
+func (d *ConsoleDriver) printf(format string, args ...interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, _ = fmt.Fprintf(d.out, format, args...)
+}
+
+func (d *ConsoleDriver) serve(in io.Reader, out io.Writer, handler func([]byte, APICaller)) {
+	d.mu.Lock()
+	d.out = out
+	d.mu.Unlock()
+	d.printf("%s", consoleHelp)
+	d.printPrompt()
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			d.printPrompt()
+			continue
+		}
+		if strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "//") {
+			if !d.command(line, handler) {
+				return
+			}
+		} else {
+			handler(d.messageEvent(strings.TrimPrefix(line, "/")), d)
+		}
+		d.printPrompt()
+	}
+}
+
+func (d *ConsoleDriver) printPrompt() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	target := "private"
+	if d.GroupID != 0 {
+		target = "group " + strconv.FormatInt(d.GroupID, 10)
+	}
+	_, _ = fmt.Fprintf(d.out, "[%d %s @%s]> ", d.UserID, d.Role, target)
+}
+
+const consoleHelp = `console driver, type a message to send it or:
+  /user <id>       change sender
+  /group <id>      change group, 0 for private messages
+  /role <role>     member, admin or owner
+  /name <nick>     change nickname
+  /join [id]       user joins the group
+  /leave [id]      user leaves the group
+  /help            show this help
+  /quit            close this session
+  //text           send a message starting with "/"
+`
+
+// command handles a "/" line, false is returned to end the session
+func (d *ConsoleDriver) command(line string, handler func([]byte, APICaller)) bool {
+	args := strings.Fields(line)
+	arg := ""
+	if len(args) > 1 {
+		arg = args[1]
+	}
+
+	d.mu.Lock()
+	switch args[0] {
+	case "/user", "/group", "/join", "/leave":
+		id := d.UserID
+		if arg != "" {
+			v, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				d.mu.Unlock()
+				d.printf("invalid id %s\n", arg)
+				return true
+			}
+			id = v
+		}
+		switch args[0] {
+		case "/user":
+			d.UserID = id
+		case "/group":
+			if arg == "" {
+				id = 0
+			}
+			d.GroupID = id
+		default:
+			d.mu.Unlock()
+			handler(d.noticeEvent(args[0] == "/join", id), d)
+			return true
+		}
+	case "/role":
+		if arg != "member" && arg != "admin" && arg != "owner" {
+			d.mu.Unlock()
+			d.printf("role must be member, admin or owner\n")
+			return true
+		}
+		d.Role = arg
+	case "/name":
+		d.Nickname = strings.TrimSpace(strings.TrimPrefix(line, "/name"))
+	case "/quit":
+		d.mu.Unlock()
+		return false
+	default:
+		_, _ = fmt.Fprint(d.out, consoleHelp)
+	}
+	d.mu.Unlock()
+	return true
+}
+
+func (d *ConsoleDriver) messageEvent(text string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	event := map[string]any{
+		"time":         time.Now().Unix(),
+		"self_id":      d.SelfID,
+		"post_type":    "message",
+		"message_type": "private",
+		"sub_type":     "friend",
+		"message_id":   d.seq.Add(1),
+		"user_id":      d.UserID,
+		"raw_message":  text,
+		"message":      text,
+		"sender": map[string]any{
+			"user_id":  d.UserID,
+			"nickname": d.Nickname,
+			"role":     d.Role,
+		},
+	}
+	if d.GroupID != 0 {
+		event["message_type"] = "group"
+		event["sub_type"] = "normal"
+		event["group_id"] = d.GroupID
+	}
+	data, _ := json.Marshal(event)
+	return data
+}
+
+func (d *ConsoleDriver) noticeEvent(join bool, userID int64) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	event := map[string]any{
+		"time":        time.Now().Unix(),
+		"self_id":     d.SelfID,
+		"post_type":   "notice",
+		"notice_type": "group_decrease",
+		"sub_type":    "leave",
+		"group_id":    d.GroupID,
+		"user_id":     userID,
+		"operator_id": userID,
+	}
+	if join {
+		event["notice_type"] = "group_increase"
+		event["sub_type"] = "approve"
+	}
+	data, _ := json.Marshal(event)
+	return data
+}
+
+// CallAPI prints the request and answers with a plausible response
+func (d *ConsoleDriver) CallAPI(req APIRequest) (rsp APIResponse, err error) {
+	begin := time.Now()
+	defer func() {
+		observeAPICall(req.Action, begin, err)
+	}()
+
+	params, _ := json.Marshal(req.Params)
+	d.printf("\n<< %s %s\n", req.Action, params)
+
+	d.mu.Lock()
+	data := "{}"
+	switch req.Action {
+	case "send_msg", "send_group_msg", "send_private_msg":
+		data = fmt.Sprintf(`{"message_id":%d}`, d.seq.Add(1))
+	case "get_login_info":
+		data = fmt.Sprintf(`{"user_id":%d,"nickname":"console"}`, d.SelfID)
+	case "get_group_member_info":
+		data = fmt.Sprintf(`{"group_id":%d,"user_id":%d,"nickname":%q,"role":%q}`, d.GroupID, d.UserID, d.Nickname, d.Role)
+	case "get_group_list", "get_group_member_list", "get_friend_list":
+		data = "[]"
+	}
+	d.mu.Unlock()
+
+	return APIResponse{Status: "ok", Data: gjson.Parse(data), Echo: req.Echo}, nil
+}
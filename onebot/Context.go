@@ -1,10 +1,13 @@
 package onebot
 
 import (
+	"context"
 	"fmt"
 	"marmot/onebot/message"
 	"reflect"
+	"strconv"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -19,6 +22,29 @@ type Ctx struct {
 	// lazy message
 	once    sync.Once
 	message string
+
+	ctx context.Context
+}
+
+// NewCtx creates a Ctx of event which calls apis through caller, used by
+// drivers and tools which build events by themselves
+func NewCtx(event *Event, caller APICaller) *Ctx {
+	return &Ctx{Event: event, caller: caller}
+}
+
+// Context is done once the handler of the Ctx should give up, e.g. after
+// the max process time. It never ends when no deadline was set
+func (ctx *Ctx) Context() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
+}
+
+// WithContext returns a Ctx of the same event bound to c, the copy shares
+// the State with ctx
+func (ctx *Ctx) WithContext(c context.Context) *Ctx {
+	return &Ctx{Event: ctx.Event, caller: ctx.caller, State: ctx.State, ctx: c}
 }
 
 // ExposeCaller as *T, maybe panic if misused
@@ -116,13 +142,74 @@ func (ctx *Ctx) SendChain(msg ...message.Segment) message.ID {
 
 // Echo 向自身分发虚拟事件
 func (ctx *Ctx) Echo(response []byte) {
-	if BotConfig.RingLen != 0 {
+	if evring != nil { // sequential dispatch replaces the ring even with ring_len set
 		evring.processEvent(response, ctx.caller)
 	} else {
 		processEventAsync(response, ctx.caller, BotConfig.MaxProcessTime)
 	}
 }
 
+// SenderRole 发送者在群内的身份 (owner, admin, member), 事件未携带时
+// (如 OneBot v12 首次发言的成员) 在调用时通过 api 获取
+func (ctx *Ctx) SenderRole() string {
+	event := ctx.Event
+	if event.Sender == nil || event.Sender.Role != "" || event.GroupID == 0 {
+		if event.Sender == nil {
+			return ""
+		}
+		return event.Sender.Role
+	}
+	return ctx.GetThisGroupMemberInfo(event.UserID, false).Get("role").Str
+}
+
+// TemplateVars 由事件构造消息模板的变量, 群名等需要调用 api 的变量在使用时才获取
+func (ctx *Ctx) TemplateVars() message.Vars {
+	event := ctx.Event
+	vars := message.Vars{
+		"user":     event.UserID,
+		"self":     event.SelfID,
+		"group":    event.GroupID,
+		"operator": event.OperatorID,
+		"time":     func() string { return time.Now().Format("15:04:05") },
+		"date":     func() string { return time.Now().Format("2006-01-02") },
+		"nickname": func() string { return ctx.GetStrangerInfo(event.UserID, false).Get("nickname").Str },
+	}
+	if event.MessageID != nil {
+		vars["message_id"] = fmt.Sprint(event.MessageID)
+	}
+	if event.Sender != nil {
+		vars["nickname"] = event.Sender.NickName
+		vars["card"] = event.Sender.Card
+		vars["name"] = event.Sender.Name()
+		vars["role"] = ctx.SenderRole
+		vars["title"] = event.Sender.Title
+	} else {
+		vars["name"] = vars["nickname"]
+	}
+	if event.GroupID != 0 {
+		var (
+			once  sync.Once
+			group Group
+		)
+		info := func() Group {
+			once.Do(func() { group = ctx.GetGroupInfo(event.GroupID, false) })
+			return group
+		}
+		vars["group.name"] = func() string { return info().Name }
+		vars["group.members"] = func() string { return strconv.FormatInt(info().MemberCount, 10) }
+	}
+	return vars
+}
+
+// Render 用事件的变量渲染消息模板, extra 中的变量优先, 语法见 message.Render
+func (ctx *Ctx) Render(tmpl string, extra message.Vars) message.Message {
+	vars := ctx.TemplateVars()
+	for k, v := range extra {
+		vars[k] = v
+	}
+	return message.Render(tmpl, vars)
+}
+
 // ExtractPlainText 提取消息中的纯文本
 func (ctx *Ctx) ExtractPlainText() string {
 	if ctx == nil || ctx.Event == nil || ctx.Event.Message == nil {
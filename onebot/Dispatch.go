@@ -0,0 +1,135 @@
+package onebot
+
+import (
+	"hash/crc64"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// eventDedup drops events seen again within the window, adapters may resend
+// the latest events after a reconnect. Events are keyed by self_id and
+// message_id, events without one by their time and content.
+type eventDedup struct {
+	window time.Duration
+	seen   *genMap[string, time.Time]
+}
+
+func newEventDedup(window time.Duration) *eventDedup {
+	return &eventDedup{window: window, seen: newGenMap[string, time.Time](20000)}
+}
+
+// duplicate reports whether the event was already seen and remembers it
+func (d *eventDedup) duplicate(payload []byte) bool {
+	fields := gjson.GetManyBytes(payload, "self_id", "post_type", "message_id", "time", "notice_type")
+	postType := fields[1].Str
+	if postType == "meta_event" || postType == "" {
+		return false // heartbeats and lifecycle events repeat on purpose
+	}
+
+	// recall notices share the message_id of the message they recall
+	key := fields[0].Raw + ":" + postType + ":" + fields[4].Str + ":"
+	if id := fields[2].Raw; id != "" && postType == "message" {
+		key += id
+	} else {
+		key += fields[3].Raw + ":" + strconv.FormatUint(crc64.Checksum(payload, crcTable), 36)
+	}
+
+	now := time.Now()
+	if at, ok := d.seen.Get(key); ok && now.Sub(at) < d.window {
+		return true
+	}
+	d.seen.Set(key, now)
+	return false
+}
+
+// SequenceOverflow is the policy reported to IObserver when a conversation
+// queue of the sequencer is full and its oldest event is dropped
+const SequenceOverflow = "sequence"
+
+// sequencer hands the events of a conversation to the handler one after
+// another while different conversations run in parallel. Every conversation
+// queues at most limit events, a full one drops its oldest event.
+type sequencer struct {
+	mu     sync.Mutex
+	limit  int
+	queues map[string][]*Ctx // a worker runs while its key is present
+
+	overflow atomic.Uint64
+	lastWarn atomic.Int64
+}
+
+func newSequencer(limit uint) *sequencer {
+	if limit == 0 {
+		limit = 100
+	}
+	return &sequencer{limit: int(limit), queues: make(map[string][]*Ctx)}
+}
+
+// conversationKey is the group, or the user of private events, empty for
+// events without a conversation
+func conversationKey(e *Event) string {
+	self := strconv.FormatInt(e.SelfID, 10)
+	switch {
+	case e.GroupID != 0:
+		return self + ":g" + strconv.FormatInt(e.GroupID, 10)
+	case e.UserID != 0:
+		return self + ":u" + strconv.FormatInt(e.UserID, 10)
+	}
+	return ""
+}
+
+func (s *sequencer) dispatch(ctx *Ctx) {
+	key := conversationKey(ctx.Event)
+	if key == "" {
+		_handler(ctx)
+		return
+	}
+	s.mu.Lock()
+	queue, running := s.queues[key]
+	full := len(queue) >= s.limit
+	if full {
+		LogDebug("[bot] conversation %s is full, dropped event : %s", key, queue[0].Event.RawEvent.Raw)
+		queue[0] = nil
+		queue = queue[1:]
+	}
+	s.queues[key] = append(queue, ctx)
+	s.mu.Unlock()
+	if full {
+		s.overflowed(key)
+	}
+	if !running {
+		go s.run(key)
+	}
+}
+
+// overflowed counts the overflow and warns at most once a second
+func (s *sequencer) overflowed(key string) {
+	total := s.overflow.Add(1)
+	observeEventOverflow(SequenceOverflow)
+	now := time.Now().Unix()
+	if last := s.lastWarn.Load(); last != now && s.lastWarn.CompareAndSwap(last, now) {
+		LogWarn("[bot] queue of conversation %s is full (%d), %d events dropped so far", key, s.limit, total)
+	}
+}
+
+func (s *sequencer) run(key string) {
+	for {
+		s.mu.Lock()
+		queue := s.queues[key]
+		if len(queue) == 0 {
+			delete(s.queues, key)
+			s.mu.Unlock()
+			return
+		}
+		ctx := queue[0]
+		queue[0] = nil
+		s.queues[key] = queue[1:]
+		s.mu.Unlock()
+
+		_handler(ctx)
+	}
+}
@@ -0,0 +1,160 @@
+package onebot
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventDedup(t *testing.T) {
+	d := newEventDedup(time.Minute)
+	msg := []byte(`{"self_id":1,"post_type":"message","message_id":42,"time":1,"raw_message":"hi"}`)
+	if d.duplicate(msg) {
+		t.Fatal("first event reported as duplicate")
+	}
+	if !d.duplicate(msg) {
+		t.Fatal("resent event was not dropped")
+	}
+	if d.duplicate([]byte(`{"self_id":2,"post_type":"message","message_id":42,"time":1}`)) {
+		t.Fatal("same message id of another account reported as duplicate")
+	}
+
+	// a recall notice shares the message_id of the recalled message
+	recall := []byte(`{"self_id":1,"post_type":"notice","notice_type":"group_recall","message_id":42,"time":2}`)
+	if d.duplicate(recall) {
+		t.Fatal("recall notice dropped as a duplicate of its message")
+	}
+	if !d.duplicate(recall) {
+		t.Fatal("resent notice was not dropped")
+	}
+
+	heartbeat := []byte(`{"self_id":1,"post_type":"meta_event","meta_event_type":"heartbeat","time":3}`)
+	if d.duplicate(heartbeat) || d.duplicate(heartbeat) {
+		t.Fatal("meta events must never be dropped")
+	}
+}
+
+func TestEventDedupWindow(t *testing.T) {
+	d := newEventDedup(20 * time.Millisecond)
+	msg := []byte(`{"self_id":1,"post_type":"message","message_id":7,"time":1}`)
+	d.duplicate(msg)
+	time.Sleep(40 * time.Millisecond)
+	if d.duplicate(msg) {
+		t.Fatal("event outside the window reported as duplicate")
+	}
+}
+
+// withHandler swaps the global handler of the sequencer for the test
+func withHandler(t *testing.T, fn func(ctx *Ctx)) {
+	old := _handler
+	_handler = fn
+	t.Cleanup(func() { _handler = old })
+}
+
+func groupCtx(group int64, id int64) *Ctx {
+	return &Ctx{Event: &Event{SelfID: 1, GroupID: group, UserID: 10001, MessageID: id}}
+}
+
+func TestSequencerOrder(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []int64
+		wg  sync.WaitGroup
+	)
+	withHandler(t, func(ctx *Ctx) {
+		time.Sleep(time.Millisecond) // let later events pile up behind this one
+		mu.Lock()
+		got = append(got, ctx.Event.MessageID.(int64))
+		mu.Unlock()
+		wg.Done()
+	})
+
+	s := newSequencer(0)
+	wg.Add(20)
+	for i := int64(0); i < 20; i++ {
+		s.dispatch(groupCtx(20000, i))
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, id := range got {
+		if id != int64(i) {
+			t.Fatalf("events of a group ran out of order: %v", got)
+		}
+	}
+}
+
+func TestSequencerParallel(t *testing.T) {
+	release := make(chan struct{})
+	other := make(chan struct{})
+	var wg sync.WaitGroup
+	withHandler(t, func(ctx *Ctx) {
+		defer wg.Done()
+		if ctx.Event.GroupID == 20000 {
+			<-release // blocks its own group only
+			return
+		}
+		close(other)
+	})
+	// both handlers must return before the handler is restored
+	defer wg.Wait()
+	defer close(release)
+
+	s := newSequencer(0)
+	wg.Add(2)
+	s.dispatch(groupCtx(20000, 1))
+	s.dispatch(groupCtx(20001, 2))
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		t.Fatal("a busy group held up another group")
+	}
+}
+
+func TestSequencerBound(t *testing.T) {
+	release := make(chan struct{})
+	var (
+		mu  sync.Mutex
+		got []int64
+		wg  sync.WaitGroup
+	)
+	withHandler(t, func(ctx *Ctx) {
+		<-release
+		mu.Lock()
+		got = append(got, ctx.Event.MessageID.(int64))
+		mu.Unlock()
+		wg.Done()
+	})
+
+	s := newSequencer(3)
+	// the first event is taken by the worker, 3 more fit in the queue
+	wg.Add(1)
+	s.dispatch(groupCtx(20000, 0))
+	for !s.running(groupCtx(20000, 0)) {
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(3)
+	for i := int64(1); i <= 10; i++ {
+		s.dispatch(groupCtx(20000, i))
+	}
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 4 || got[0] != 0 || got[1] != 8 || got[3] != 10 {
+		t.Fatalf("expected the running event and the newest 3, got %v", got)
+	}
+	if n := s.overflow.Load(); n != 7 {
+		t.Fatalf("expected 7 dropped events, got %d", n)
+	}
+}
+
+// running reports whether the worker of the conversation took its first event
+func (s *sequencer) running(ctx *Ctx) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue, ok := s.queues[conversationKey(ctx.Event)]
+	return ok && len(queue) == 0
+}
@@ -0,0 +1,206 @@
+package onebot
+
+import (
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	"sync"
+	"time"
+)
+
+// A connection is stale when no heartbeat came for staleBeats intervals
+const staleBeats = 3
+
+// MetaBotStatus is the meta_event_type of the events fired when an account
+// goes offline or comes back online, the sub_type is "offline" or "online"
+const MetaBotStatus = "bot_status"
+
+// HeartbeatStatus is the health of a connection as reported by the heartbeat
+// and lifecycle meta events of its adapter
+type HeartbeatStatus struct {
+	SelfID        int64
+	Online        bool          // status.online of the adapter, the account is logged in
+	Good          bool          // status.good of the adapter
+	Enabled       bool          // false after a lifecycle disable event
+	Stale         bool          // heartbeats stopped
+	Interval      time.Duration // announced by the adapter, 0 before the first heartbeat
+	LastHeartbeat time.Time
+}
+
+// Up reports whether the account can be used
+func (s HeartbeatStatus) Up() bool {
+	return s.Online && s.Enabled && !s.Stale
+}
+
+// reason names why the account is down
+func (s HeartbeatStatus) reason() string {
+	switch {
+	case s.Stale:
+		return "heartbeat timeout"
+	case !s.Enabled:
+		return "disabled"
+	case !s.Online:
+		return "account offline"
+	default:
+		return ""
+	}
+}
+
+// HeartbeatReporter is implemented by callers tracking heartbeats
+type HeartbeatReporter interface {
+	HeartbeatStatus() HeartbeatStatus
+}
+
+// HeartbeatStatuses returns the health of every connection tracking heartbeats
+func HeartbeatStatuses() []HeartbeatStatus {
+	var result []HeartbeatStatus
+	APICallers.Range(func(_ int64, caller APICaller) bool {
+		if r, ok := caller.(HeartbeatReporter); ok {
+			result = append(result, r.HeartbeatStatus())
+		}
+		return true
+	})
+	return result
+}
+
+type heartbeat struct {
+	mu     sync.Mutex
+	status HeartbeatStatus
+	up     bool // state of the last bot_status event
+}
+
+func newHeartbeat(selfID int64) *heartbeat {
+	return &heartbeat{
+		status: HeartbeatStatus{SelfID: selfID, Online: true, Good: true, Enabled: true},
+		up:     true,
+	}
+}
+
+// update applies a v11 or v12 meta event, heartbeats are consumed and
+// reported as such, lifecycle and status events are still dispatched
+func (h *heartbeat) update(frame gjson.Result) (isHeartbeat bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	meta := frame.Get("meta_event_type").Str
+	if frame.Get("type").Str == "meta" {
+		meta = frame.Get("detail_type").Str // v12
+	}
+	switch meta {
+	case "heartbeat":
+		h.status.Stale = false
+		h.status.LastHeartbeat = time.Now()
+		h.status.Interval = time.Duration(frame.Get("interval").Int()) * time.Millisecond
+		h.applyStatus(frame.Get("status"))
+		return true
+	case "lifecycle":
+		switch frame.Get("sub_type").Str {
+		case "disable":
+			h.status.Enabled = false
+		case "enable", "connect":
+			h.status.Enabled = true
+		}
+	case "status_update": // v12
+		h.applyStatus(frame.Get("status"))
+	}
+	return false
+}
+
+func (h *heartbeat) applyStatus(status gjson.Result) {
+	if good := status.Get("good"); good.Exists() {
+		h.status.Good = good.Bool()
+	}
+	if online := status.Get("online"); online.Exists() {
+		h.status.Online = online.Bool()
+	} else if online := status.Get("bots.0.online"); online.Exists() { // v12
+		h.status.Online = online.Bool()
+	}
+}
+
+// check marks the connection stale when heartbeats stopped
+func (h *heartbeat) check(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status.Interval > 0 && now.Sub(h.status.LastHeartbeat) > staleBeats*h.status.Interval {
+		h.status.Stale = true
+	}
+}
+
+func (h *heartbeat) snapshot() HeartbeatStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// transition returns a bot_status event when the account went down or up
+// since the last call, nil otherwise
+func (h *heartbeat) transition() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	up := h.status.Up()
+	if up == h.up {
+		return nil
+	}
+	h.up = up
+
+	if !up {
+		LogWarn("[wss] QQ account %d went offline: %s", h.status.SelfID, h.status.reason())
+	} else {
+		LogInfo("[wss] QQ account %d is back online", h.status.SelfID)
+	}
+	return h.statusEvent(up, h.status.reason())
+}
+
+// disconnect returns the offline event when the connection of an account
+// that was up is lost, nil when it was reported offline already
+func (h *heartbeat) disconnect() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.up {
+		return nil
+	}
+	h.up = false
+	return h.statusEvent(false, "disconnected")
+}
+
+// reconnect returns the online event of an account connecting again
+func (h *heartbeat) reconnect() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.statusEvent(true, "")
+}
+
+// statusEvent builds a bot_status event, h.mu must be held
+func (h *heartbeat) statusEvent(up bool, reason string) []byte {
+	subType := "online"
+	if !up {
+		subType = "offline"
+	}
+	event, _ := json.Marshal(map[string]any{
+		"time":            time.Now().Unix(),
+		"self_id":         h.status.SelfID,
+		"post_type":       "meta_event",
+		"meta_event_type": MetaBotStatus,
+		"sub_type":        subType,
+		"reason":          reason,
+		"status":          map[string]bool{"online": h.status.Online && up, "good": h.status.Good},
+	})
+	return event
+}
+
+// watch checks the heartbeats every second and fires bot_status events
+// until stop is closed
+func (h *heartbeat) watch(stop <-chan struct{}, fire func([]byte)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			h.check(now)
+			if event := h.transition(); event != nil {
+				fire(event)
+			}
+		}
+	}
+}
@@ -11,12 +11,20 @@ type ILogger interface {
 	Warn(msg string)
 }
 
-var botLogger ILogger
+var (
+	botLogger ILogger
+	debugLog  bool
+)
 
 func SetLogger(logger ILogger) {
 	botLogger = logger
 }
 
+// SetDebug enables protocol level debug logs (every event / api frame)
+func SetDebug(enable bool) {
+	debugLog = enable
+}
+
 func LogInfo(tmp string, args ...interface{}) {
 	botLogger.Info(fmt.Sprintf(tmp, args...))
 }
@@ -29,6 +37,9 @@ func LogError(tmp string, args ...interface{}) {
 	botLogger.Error(fmt.Sprintf(tmp, args...))
 }
 
-func LogDebug(_ string, _ ...interface{}) {
-	//botLogger.Debug(fmt.Sprintf(tmp, args...))
+func LogDebug(tmp string, args ...interface{}) {
+	if !debugLog {
+		return
+	}
+	botLogger.Debug(fmt.Sprintf(tmp, args...))
 }
@@ -0,0 +1,41 @@
+package onebot
+
+import "time"
+
+// IObserver receives api call, connection and event ring events, used for metrics
+type IObserver interface {
+	OnAPICall(action string, elapsed time.Duration, err error)
+	OnConnect(selfID int64)
+	OnDisconnect(selfID int64)
+	OnEventOverflow(policy string) // the event ring was full
+}
+
+var botObserver IObserver
+
+func SetObserver(observer IObserver) {
+	botObserver = observer
+}
+
+func observeAPICall(action string, begin time.Time, err error) {
+	if botObserver != nil {
+		botObserver.OnAPICall(action, time.Since(begin), err)
+	}
+}
+
+func observeConnect(selfID int64) {
+	if botObserver != nil {
+		botObserver.OnConnect(selfID)
+	}
+}
+
+func observeDisconnect(selfID int64) {
+	if botObserver != nil {
+		botObserver.OnDisconnect(selfID)
+	}
+}
+
+func observeEventOverflow(policy string) {
+	if botObserver != nil {
+		botObserver.OnEventOverflow(policy)
+	}
+}
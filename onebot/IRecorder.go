@@ -0,0 +1,26 @@
+package onebot
+
+// IRecorder receives every raw inbound event and every api call made
+// through a Ctx, used to record traffic for replaying it later
+type IRecorder interface {
+	RecordEvent(payload []byte)
+	RecordCall(request APIRequest, response APIResponse, err error)
+}
+
+var botRecorder IRecorder
+
+func SetRecorder(recorder IRecorder) {
+	botRecorder = recorder
+}
+
+func recordEvent(payload []byte) {
+	if botRecorder != nil {
+		botRecorder.RecordEvent(payload)
+	}
+}
+
+func recordCall(request APIRequest, response APIResponse, err error) {
+	if botRecorder != nil {
+		botRecorder.RecordCall(request, response, err)
+	}
+}
@@ -1,6 +1,7 @@
 package onebot
 
 import (
+	"errors"
 	"github.com/goccy/go-json"
 	"marmot/utils"
 
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,7 +22,8 @@ import (
 )
 
 var (
-	nullResponse = APIResponse{}
+	nullResponse  = APIResponse{}
+	errAPIRetCode = errors.New("api returned non-zero retcode")
 )
 
 // WSServer ...
@@ -30,10 +33,29 @@ type WSServer struct {
 	lstn        net.Listener
 	caller      chan *WSSCaller
 	hook        ConnectHook
+	closed      atomic.Bool
+
+	mu     sync.Mutex             // guards active, halves and lost
+	active map[int64]*WSSCaller   // current caller of every account
+	halves map[int64]*splitHalves // split mode sockets waiting for their pair
+	lost   map[int64]bool         // accounts whose connection dropped, they are online again on register
 
 	json.Unmarshaler
 }
 
+// splitHalves are the sockets of an account connecting in split mode, the
+// caller is created once both arrived
+type splitHalves struct {
+	api, event *websocket.Conn
+}
+
+// client roles of the X-Client-Role header
+const (
+	roleUniversal = "universal"
+	roleAPI       = "api"
+	roleEvent     = "event"
+)
+
 // UnmarshalJSON init WSServer with waitn=16
 func (wss *WSServer) UnmarshalJSON(data []byte) error {
 	type jsoncfg struct {
@@ -64,11 +86,17 @@ func NewWebSocketServer(waitn int, url, accessToken string, hook ConnectHook) *W
 
 // WSSCaller ...
 type WSSCaller struct {
-	mu     sync.Mutex // 写锁
-	seqMap SeqSyncMap
-	conn   *websocket.Conn
-	selfID int64
-	seq    uint64
+	mu       sync.Mutex // 写锁
+	seqMap   SeqSyncMap
+	conn     *websocket.Conn // api requests, and events in universal mode
+	events   *websocket.Conn // events in split mode, nil in universal mode
+	server   *WSServer
+	selfID   int64
+	seq      uint64
+	v12      *v12Codec // nil on OneBot v11 connections
+	pending  [][]byte  // events read during the handshake
+	health   *heartbeat
+	returned bool // the account connects again after its connection dropped
 }
 
 var upgrader = websocket.Upgrader{
@@ -120,6 +148,22 @@ func checkAuth(req *http.Request, token string) int {
 	}
 }
 
+// clientRole tells the role of a connection by its path (/api, /event) or
+// its X-Client-Role header, universal by default
+func clientRole(r *http.Request) string {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api"):
+		return roleAPI
+	case strings.HasSuffix(r.URL.Path, "/event"):
+		return roleEvent
+	}
+	switch role := strings.ToLower(r.Header.Get("X-Client-Role")); role {
+	case roleAPI, roleEvent:
+		return role
+	}
+	return roleUniversal
+}
+
 func (wss *WSServer) any(w http.ResponseWriter, r *http.Request) {
 	status := checkAuth(r, wss.AccessToken)
 	if status != http.StatusOK {
@@ -128,38 +172,184 @@ func (wss *WSServer) any(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	role := clientRole(r)
+	selfID, _ := strconv.ParseInt(r.Header.Get("X-Self-ID"), 10, 64)
+	if role != roleUniversal && selfID == 0 {
+		LogWarn("[wss] refused %s connection of %v : missing X-Self-ID", role, r.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// v12 implementations ask for a "12.<impl>" sub protocol
+	var header http.Header
+	v12 := false
+	for _, protocol := range websocket.Subprotocols(r) {
+		if role == roleUniversal && strings.HasPrefix(protocol, protocolV12Prefix) {
+			header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+			v12 = true
+			break
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		LogWarn("[wss] error occured when handling webSocket request: %v", err)
 		return
 	}
 
-	var rsp struct {
-		SelfID int64 `json:"self_id"`
+	if role != roleUniversal {
+		wss.pair(selfID, role, conn)
+		return
 	}
-	err = conn.ReadJSON(&rsp)
-	if err != nil {
-		LogWarn("[wss] handshake with websocket server %v failed: %v", wss.URL, err)
+
+	c := &WSSCaller{conn: conn, selfID: selfID}
+	if selfID == 0 || v12 {
+		if err := c.handshake(v12); err != nil {
+			LogWarn("[wss] handshake with websocket server %v failed: %v", wss.URL, err)
+			_ = conn.Close()
+			return
+		}
+	}
+	wss.register(c)
+}
+
+// pair keeps a split mode socket until the other one of the account comes,
+// a second socket of the same role replaces the waiting one
+func (wss *WSServer) pair(selfID int64, role string, conn *websocket.Conn) {
+	wss.mu.Lock()
+	if wss.halves == nil {
+		wss.halves = make(map[int64]*splitHalves)
+	}
+	h := wss.halves[selfID]
+	if h == nil {
+		h = &splitHalves{}
+		wss.halves[selfID] = h
+	}
+	old := &h.api
+	if role == roleEvent {
+		old = &h.event
+	}
+	if *old != nil {
+		LogWarn("[wss] QQ account %d opened another %s connection, closing the waiting one", selfID, role)
+		_ = (*old).Close()
+	}
+	*old = conn
+	complete := h.api != nil && h.event != nil
+	if complete {
+		delete(wss.halves, selfID)
+	}
+	wss.mu.Unlock()
+
+	if !complete {
+		LogInfo("[wss] QQ account %d connected its %s socket, waiting for the other one", selfID, role)
 		return
 	}
+	wss.register(&WSSCaller{conn: h.api, events: h.event, selfID: selfID})
+}
+
+// register makes c the caller of its account, an older connection of the
+// same account is closed and its pending api calls fail
+func (wss *WSServer) register(c *WSSCaller) {
+	c.server = wss
+	c.health = newHeartbeat(c.selfID)
 
-	c := &WSSCaller{
-		conn:   conn,
-		selfID: rsp.SelfID,
+	wss.mu.Lock()
+	if wss.active == nil {
+		wss.active = make(map[int64]*WSSCaller)
 	}
-	APICallers.Store(rsp.SelfID, c) // add Caller to APICaller list...
+	old := wss.active[c.selfID]
+	wss.active[c.selfID] = c
+	APICallers.Store(c.selfID, c) // add Caller to APICaller list...
+	c.returned = wss.lost[c.selfID]
+	delete(wss.lost, c.selfID)
+	wss.mu.Unlock()
+	if old != nil {
+		LogWarn("[wss] QQ account %d connected again, replacing the old connection", c.selfID)
+		old.closeWith("replaced by a new connection")
+	}
+
 	if wss.hook != nil {
-		wss.hook(rsp.SelfID)
+		wss.hook(c.selfID)
+	}
+	mode := "universal"
+	switch {
+	case c.events != nil:
+		mode = "split"
+	case c.v12 != nil:
+		mode = "v12"
 	}
-	LogInfo("[wss] connected to websocket server: %s QQ account : %d", wss.URL, rsp.SelfID)
+	LogInfo("[wss] connected to websocket server: %s QQ account : %d (%s)", wss.URL, c.selfID, mode)
+	observeConnect(c.selfID)
 	wss.caller <- c
 }
 
+// release removes c from the callers unless it was replaced already, the
+// bot_status offline event of the account is returned when it went down
+func (wss *WSServer) release(c *WSSCaller) []byte {
+	wss.mu.Lock()
+	current := wss.active[c.selfID] == c
+	if current {
+		delete(wss.active, c.selfID)
+		APICallers.Delete(c.selfID) // remove from caller map when disconnect
+		if wss.lost == nil {
+			wss.lost = make(map[int64]bool)
+		}
+		wss.lost[c.selfID] = true
+	}
+	wss.mu.Unlock()
+	LogWarn("[wss] disconnected from websocket server, QQ account : %v", c.selfID)
+	observeDisconnect(c.selfID)
+	if !current || wss.closed.Load() { // replaced, or the bot is shutting down
+		return nil
+	}
+	return c.health.disconnect()
+}
+
+// handshake reads the bot account from the first frames, a v12 connection
+// is also recognized by its first event when the sub protocol is missing
+func (wssc *WSSCaller) handshake(v12 bool) error {
+	_, payload, err := wssc.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if !v12 && !isV12Frame(payload) {
+		var rsp struct {
+			SelfID int64 `json:"self_id"`
+		}
+		if err := json.Unmarshal(payload, &rsp); err != nil {
+			return err
+		}
+		wssc.selfID = rsp.SelfID
+		return nil
+	}
+
+	// v12 starts with a connect event, the account comes with status_update
+	wssc.v12 = newV12Codec(wssc)
+	for i := 0; ; i++ {
+		frame := gjson.ParseBytes(payload)
+		if id := v12SelfID(frame); id != "" {
+			wssc.selfID = wssc.v12.toInt(id)
+		}
+		if frame.Get("type").Str != "meta" {
+			wssc.pending = append(wssc.pending, payload)
+		}
+		if wssc.selfID != 0 {
+			return nil
+		}
+		if i >= 16 {
+			return errors.New("no bot account in the first v12 events")
+		}
+		if _, payload, err = wssc.conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
 func (wss *WSServer) Listen(handler func([]byte, APICaller)) {
 	mux := http.ServeMux{}
 	mux.HandleFunc("/", wss.any)
 	go func() {
-		for {
+		for !wss.closed.Load() {
 			if wss.lstn == nil {
 				time.Sleep(time.Millisecond * time.Duration(3))
 				wss.Connect()
@@ -167,7 +357,7 @@ func (wss *WSServer) Listen(handler func([]byte, APICaller)) {
 			}
 			LogInfo("[wss] webSocket server handling : %v", wss.lstn.Addr())
 			err := http.Serve(wss.lstn, &mux)
-			if err != nil {
+			if err != nil && !wss.closed.Load() {
 				LogWarn("[wss] websocket server occured an error at end point : %s with error : %v", wss.lstn.Addr(), err)
 				wss.lstn = nil
 			}
@@ -178,12 +368,117 @@ func (wss *WSServer) Listen(handler func([]byte, APICaller)) {
 	}
 }
 
+// Close stops accepting connections and closes every connected websocket
+// with a normal closure frame
+func (wss *WSServer) Close() {
+	if !wss.closed.CompareAndSwap(false, true) {
+		return
+	}
+	if wss.lstn != nil {
+		_ = wss.lstn.Close()
+	}
+	wss.mu.Lock()
+	callers := make([]*WSSCaller, 0, len(wss.active))
+	for _, c := range wss.active {
+		callers = append(callers, c)
+	}
+	for _, h := range wss.halves {
+		for _, conn := range []*websocket.Conn{h.api, h.event} {
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+	}
+	wss.halves = nil
+	wss.mu.Unlock()
+	for _, c := range callers {
+		c.Close()
+	}
+	LogInfo("[wss] websocket server closed")
+}
+
+// Close sends a close frame and closes the connection
+func (wssc *WSSCaller) Close() {
+	wssc.closeWith("shutdown")
+}
+
+func (wssc *WSSCaller) closeWith(reason string) {
+	wssc.mu.Lock()
+	for _, conn := range []*websocket.Conn{wssc.conn, wssc.events} {
+		if conn == nil {
+			continue
+		}
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+			time.Now().Add(time.Second))
+		_ = conn.Close()
+	}
+	wssc.mu.Unlock()
+}
+
 func (wssc *WSSCaller) listen(handler func([]byte, APICaller)) {
+	dispatch := func(payload []byte) {
+		handler(payload, wssc)
+	}
+	if wssc.v12 != nil {
+		// converting runs beside the read loop, api responses are matched by
+		// the read loop before events are queued
+		frames := make(chan []byte, 64)
+		defer close(frames)
+		go wssc.v12.run(frames, handler)
+		dispatch = func(payload []byte) {
+			frames <- payload
+		}
+	}
+	for _, payload := range wssc.pending {
+		dispatch(payload)
+	}
+	wssc.pending = nil
+
+	// bot_status events are built in the v11 model, they skip the codec
+	if wssc.returned {
+		handler(wssc.health.reconnect(), wssc)
+	}
+	stop := make(chan struct{})
+	go wssc.health.watch(stop, func(event []byte) {
+		handler(event, wssc)
+	})
+
+	if wssc.events == nil {
+		wssc.read(wssc.conn, dispatch)
+		_ = wssc.conn.Close() // later api calls fail at once instead of waiting for a response
+	} else {
+		// split mode, losing either socket closes the other one
+		done := make(chan struct{})
+		go func() {
+			wssc.read(wssc.events, dispatch)
+			_ = wssc.conn.Close()
+			close(done)
+		}()
+		wssc.read(wssc.conn, dispatch)
+		_ = wssc.events.Close()
+		<-done
+	}
+
+	// fail the api calls still waiting for a response
+	wssc.seqMap.Range(func(key uint64, _ chan<- APIResponse) bool {
+		if c, ok := wssc.seqMap.LoadAndDelete(key); ok {
+			close(c)
+		}
+		return true
+	})
+	close(stop)
+	if event := wssc.server.release(wssc); event != nil {
+		handler(event, wssc)
+	}
+}
+
+// read handles the frames of conn until it is closed, api responses are
+// matched by echo and events go to dispatch
+func (wssc *WSSCaller) read(conn *websocket.Conn, dispatch func([]byte)) {
 	for {
-		t, payload, err := wssc.conn.ReadMessage()
+		t, payload, err := conn.ReadMessage()
 		if err != nil { // reconnect
-			APICallers.Delete(wssc.selfID) // remove from caller map when disconnect
-			LogWarn("[wss] disconnected from websocket server, QQ account : %v", wssc.selfID)
 			return
 		}
 		if t != websocket.TextMessage {
@@ -209,19 +504,59 @@ func (wssc *WSSCaller) listen(handler func([]byte, APICaller)) {
 			}
 			continue
 		}
-		if rsp.Get("meta_event_type").Str == "heartbeat" { // ignore heartbeat packet
+		if wssc.health.update(rsp) { // heartbeats only feed the health
 			continue
 		}
 		LogDebug("[wss] received event : %v", utils.BytesToString(payload))
-		handler(payload, wssc)
+		dispatch(payload)
 	}
 }
 
+// HeartbeatStatus returns the health of the connection
+func (wssc *WSSCaller) HeartbeatStatus() HeartbeatStatus {
+	return wssc.health.snapshot()
+}
+
 func (wssc *WSSCaller) nextSeq() uint64 {
 	return atomic.AddUint64(&wssc.seq, 1)
 }
 
-func (wssc *WSSCaller) CallAPI(req APIRequest) (APIResponse, error) {
+func (wssc *WSSCaller) CallAPI(req APIRequest) (rsp APIResponse, err error) {
+	begin := time.Now()
+	defer func() {
+		if err == nil && rsp.RetCode != 0 {
+			err = errAPIRetCode
+		}
+		observeAPICall(req.Action, begin, err)
+		if err == errAPIRetCode {
+			err = nil
+		}
+	}()
+
+	if wssc.v12 == nil {
+		return wssc.roundTrip(req)
+	}
+	action, params, err := wssc.v12.request(req)
+	if err != nil {
+		return nullResponse, err
+	}
+	rsp, err = wssc.roundTrip(APIRequest{Action: action, Params: params})
+	if err != nil {
+		return rsp, err
+	}
+	if action == "get_group_member_info" {
+		wssc.v12.rememberRole(params, rsp)
+	}
+	return wssc.v12.response(rsp), nil
+}
+
+// callRaw sends an action as is, used by the v12 codec for its own requests
+func (wssc *WSSCaller) callRaw(action string, params Params) (APIResponse, error) {
+	return wssc.roundTrip(APIRequest{Action: action, Params: params})
+}
+
+// roundTrip writes the request and waits for the response with the same echo
+func (wssc *WSSCaller) roundTrip(req APIRequest) (APIResponse, error) {
 	ch := make(chan APIResponse, 1)
 	req.Echo = wssc.nextSeq()
 	wssc.seqMap.Store(req.Echo, ch)
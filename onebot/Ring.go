@@ -1,69 +1,185 @@
 package onebot
 
 import (
-	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Policies of a full event ring
+const (
+	RingDropOldest = "drop_oldest" // the oldest unread event makes room
+	RingBlock      = "block"       // the connection waits until the ring is drained
+	RingSpill      = "spill"       // the event is handled by its own goroutine
+)
+
 type eventRingItem struct {
 	response []byte
 	caller   APICaller
 }
 
+type ringCell struct {
+	seq  atomic.Uintptr
+	item eventRingItem
+}
+
+// eventRing is a bounded lock-free queue fed by the connections and drained
+// by one loop. Cells carry a sequence number so a writer never overwrites an
+// unread event, a full ring is handled by the policy instead. Writers only
+// take events out with RingDropOldest.
 type eventRing struct {
-	ring []*atomic.Pointer[eventRingItem]
-	size uintptr
-	head uintptr // atomic
+	cells  []ringCell
+	mask   uintptr
+	_      [64]byte // keep head and tail on their own cache lines
+	head   atomic.Uintptr
+	_      [64]byte
+	tail   atomic.Uintptr
+	_      [64]byte
+	policy string
+
+	notify chan struct{} // wakes the loop without latency
+	space  chan struct{} // wakes blocked writers after a drain
+
+	overflow atomic.Uint64
+	lastWarn atomic.Int64
+	process  func([]byte, APICaller, time.Duration)
+	maxwait  time.Duration
 }
 
-func newring(ringLen uint) *eventRing {
-	ring := make([]*atomic.Pointer[eventRingItem], ringLen)
-	for i := range ring {
-		ring[i] = &atomic.Pointer[eventRingItem]{}
+// newring rounds ringLen up to a power of two
+func newring(ringLen uint, policy string) *eventRing {
+	size := uintptr(2)
+	for size < uintptr(ringLen) {
+		size <<= 1
+	}
+	switch policy {
+	case RingDropOldest, RingBlock, RingSpill:
+	case "":
+		policy = RingDropOldest
+	default:
+		LogWarn("[bot] unknown ring policy %s, using %s", policy, RingDropOldest)
+		policy = RingDropOldest
 	}
-	return &eventRing{
-		ring: ring,
-		size: uintptr(ringLen),
+	evr := &eventRing{
+		cells:  make([]ringCell, size),
+		mask:   size - 1,
+		policy: policy,
+		notify: make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
 	}
+	for i := range evr.cells {
+		evr.cells[i].seq.Store(uintptr(i))
+	}
+	return evr
 }
 
-var itemPool = sync.Pool{
-	New: func() any {
-		return &eventRingItem{}
-	},
+func (evr *eventRing) enqueue(item eventRingItem) bool {
+	pos := evr.head.Load()
+	for {
+		cell := &evr.cells[pos&evr.mask]
+		switch dif := int(cell.seq.Load() - pos); {
+		case dif == 0:
+			if evr.head.CompareAndSwap(pos, pos+1) {
+				cell.item = item
+				cell.seq.Store(pos + 1)
+				return true
+			}
+			pos = evr.head.Load()
+		case dif < 0:
+			return false // the cell is still unread, full
+		default:
+			pos = evr.head.Load()
+		}
+	}
 }
 
-// non-blocking write
-func (evr *eventRing) processEvent(response []byte, caller APICaller) {
-	idx := atomic.AddUintptr(&evr.head, 1) - 1
-	slot := evr.ring[idx%evr.size]
+func (evr *eventRing) dequeue() (eventRingItem, bool) {
+	pos := evr.tail.Load()
+	for {
+		cell := &evr.cells[pos&evr.mask]
+		switch dif := int(cell.seq.Load() - (pos + 1)); {
+		case dif == 0:
+			if evr.tail.CompareAndSwap(pos, pos+1) {
+				item := cell.item
+				cell.item = eventRingItem{}
+				cell.seq.Store(pos + evr.mask + 1)
+				return item, true
+			}
+			pos = evr.tail.Load()
+		case dif < 0:
+			return eventRingItem{}, false // empty
+		default:
+			pos = evr.tail.Load()
+		}
+	}
+}
 
-	item := itemPool.Get().(*eventRingItem)
-	item.response = response
-	item.caller = caller
+// processEvent queues the event, a full ring is handled by the policy
+func (evr *eventRing) processEvent(response []byte, caller APICaller) {
+	item := eventRingItem{response: response, caller: caller}
+	for !evr.enqueue(item) {
+		evr.overflowed()
+		switch evr.policy {
+		case RingBlock:
+			<-evr.space
+		case RingSpill:
+			go evr.process(response, caller, evr.maxwait)
+			return
+		default:
+			if old, ok := evr.dequeue(); ok {
+				LogDebug("[bot] event ring is full, dropped event : %s", old.response)
+			}
+		}
+	}
+	select {
+	case evr.notify <- struct{}{}:
+	default:
+	}
+}
 
-	slot.Store(item)
+// overflowed counts the overflow and warns at most once a second
+func (evr *eventRing) overflowed() {
+	total := evr.overflow.Add(1)
+	observeEventOverflow(evr.policy)
+	now := time.Now().Unix()
+	if last := evr.lastWarn.Load(); last != now && evr.lastWarn.CompareAndSwap(last, now) {
+		LogWarn("[bot] event ring of %d is full, %d overflows so far (policy %s)", len(evr.cells), total, evr.policy)
+	}
 }
 
+// loop drains the whole ring every interval, or as soon as events arrive
+// when interval is 0
 func (evr *eventRing) loop(interval time.Duration, maxwait time.Duration, process func([]byte, APICaller, time.Duration)) {
+	evr.process = process
+	evr.maxwait = maxwait
 	go func() {
-		var tail uintptr
+		if interval <= 0 {
+			for range evr.notify {
+				evr.drain()
+			}
+			return
+		}
 		timer := time.NewTicker(interval)
 		defer timer.Stop()
-
 		for range timer.C {
-			idx := tail % evr.size
-			slot := evr.ring[idx]
-			item := slot.Swap(nil)
-			if item != nil {
-				process(item.response, item.caller, maxwait)
-				// dispose
-				item.response = nil
-				item.caller = nil
-				itemPool.Put(item)
-			}
-			tail++
+			evr.drain()
 		}
 	}()
 }
+
+func (evr *eventRing) drain() {
+	drained := false
+	for {
+		item, ok := evr.dequeue()
+		if !ok {
+			break
+		}
+		evr.process(item.response, item.caller, evr.maxwait)
+		drained = true
+	}
+	if drained {
+		select {
+		case evr.space <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package onebot
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct{}
+
+func (testLogger) Info(string)  {}
+func (testLogger) Error(string) {}
+func (testLogger) Debug(string) {}
+func (testLogger) Warn(string)  {}
+
+func TestMain(m *testing.M) {
+	SetLogger(testLogger{})
+	os.Exit(m.Run())
+}
+
+func ringItem(i int) eventRingItem {
+	return eventRingItem{response: []byte(strconv.Itoa(i))}
+}
+
+func ringValues(evr *eventRing) []string {
+	var out []string
+	for {
+		item, ok := evr.dequeue()
+		if !ok {
+			return out
+		}
+		out = append(out, string(item.response))
+	}
+}
+
+func TestRingWrap(t *testing.T) {
+	evr := newring(3, RingDropOldest)
+	if len(evr.cells) != 4 {
+		t.Fatalf("ring_len 3 should round up to 4 cells, got %d", len(evr.cells))
+	}
+	// cycle through the cells many times so the sequence numbers wrap around
+	for round := 0; round < 100; round++ {
+		for i := 0; i < 4; i++ {
+			if !evr.enqueue(ringItem(round*4 + i)) {
+				t.Fatalf("round %d: enqueue %d failed on a ring with room", round, i)
+			}
+		}
+		if evr.enqueue(ringItem(-1)) {
+			t.Fatalf("round %d: enqueue succeeded on a full ring", round)
+		}
+		got := ringValues(evr)
+		want := []string{strconv.Itoa(round * 4), strconv.Itoa(round*4 + 1), strconv.Itoa(round*4 + 2), strconv.Itoa(round*4 + 3)}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("round %d: got %v, want %v", round, got, want)
+		}
+	}
+	if _, ok := evr.dequeue(); ok {
+		t.Fatal("dequeue succeeded on an empty ring")
+	}
+}
+
+func TestRingDropOldest(t *testing.T) {
+	evr := newring(4, RingDropOldest)
+	for i := 0; i < 10; i++ {
+		evr.processEvent(ringItem(i).response, nil)
+	}
+	if got := strings.Join(ringValues(evr), ","); got != "6,7,8,9" {
+		t.Fatalf("the newest events should be kept, got %s", got)
+	}
+	if n := evr.overflow.Load(); n != 6 {
+		t.Fatalf("expected 6 overflows, got %d", n)
+	}
+}
+
+func TestRingBlock(t *testing.T) {
+	evr := newring(2, RingBlock)
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	evr.process = func(b []byte, _ APICaller, _ time.Duration) {
+		mu.Lock()
+		got = append(got, string(b))
+		mu.Unlock()
+	}
+	evr.processEvent([]byte("0"), nil)
+	evr.processEvent([]byte("1"), nil)
+
+	done := make(chan struct{})
+	go func() {
+		evr.processEvent([]byte("2"), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("writer did not block on a full ring")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	evr.drain()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer is still blocked after the ring was drained")
+	}
+	evr.drain()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(got, ",") != "0,1,2" {
+		t.Fatalf("blocked event lost or reordered: %v", got)
+	}
+	if n := evr.overflow.Load(); n != 1 {
+		t.Fatalf("expected 1 overflow, got %d", n)
+	}
+}
+
+func TestRingSpill(t *testing.T) {
+	evr := newring(2, RingSpill)
+	spilled := make(chan string, 1)
+	evr.process = func(b []byte, _ APICaller, _ time.Duration) {
+		spilled <- string(b)
+	}
+	for i := 0; i < 3; i++ {
+		evr.processEvent(ringItem(i).response, nil)
+	}
+	select {
+	case v := <-spilled:
+		if v != "2" {
+			t.Fatalf("expected the overflowing event to spill, got %s", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overflowing event was not handled")
+	}
+	if got := strings.Join(ringValues(evr), ","); got != "0,1" {
+		t.Fatalf("queued events changed by the spill: %s", got)
+	}
+	if n := evr.overflow.Load(); n != 1 {
+		t.Fatalf("expected 1 overflow, got %d", n)
+	}
+}
+
+func TestRingConcurrentProducers(t *testing.T) {
+	const producers, events = 8, 2000
+	evr := newring(64, RingBlock)
+
+	var (
+		mu   sync.Mutex
+		next = make(map[string]int, producers)
+		seen int
+	)
+	all := make(chan struct{})
+	evr.loop(0, 0, func(b []byte, _ APICaller, _ time.Duration) {
+		producer, idx, _ := strings.Cut(string(b), ":")
+		i, _ := strconv.Atoi(idx)
+		mu.Lock()
+		defer mu.Unlock()
+		if i != next[producer] {
+			t.Errorf("producer %s: got event %d, want %d", producer, i, next[producer])
+		}
+		next[producer] = i + 1
+		if seen++; seen == producers*events {
+			close(all)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				evr.processEvent([]byte(fmt.Sprintf("%d:%d", p, i)), nil)
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-all:
+	case <-time.After(10 * time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("only %d of %d events were handled", seen, producers*events)
+	}
+}
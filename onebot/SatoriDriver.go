@@ -0,0 +1,556 @@
+package onebot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/RomiChan/websocket"
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnsupported is returned for actions the adapter has no counterpart of
+var ErrUnsupported = errors.New("unsupported action")
+
+// Satori signaling ops https://satori.chat/zh-CN/protocol/events.html
+const (
+	satoriOpEvent    = 0
+	satoriOpPing     = 1
+	satoriOpIdentify = 3
+	satoriOpReady    = 4
+
+	satoriChannelDirect = 1
+	satoriRetry         = 5 * time.Second
+	satoriPing          = 10 * time.Second
+)
+
+// SatoriDriver connects to a Satori gateway, events come from its websocket
+// and actions go to its http api. Events and message elements are converted
+// to the v11 model so modules run unchanged, only sending, deleting, member
+// info, kick and mute are mapped, other actions fail with ErrUnsupported.
+// Groups are the channels messages came from, string ids are mapped by
+// stringIDs.
+type SatoriDriver struct {
+	URL      string // http base of the gateway, e.g. http://127.0.0.1:5140
+	Token    string
+	Platform string // login to use on a gateway serving several, empty picks the first
+
+	*stringIDs
+	hook     ConnectHook
+	client   *http.Client
+	channels *genMap[int64, string] // message id -> channel id
+	guilds   *genMap[int64, string] // group id -> guild id
+	directs  *genMap[int64, string] // user id -> direct channel id
+
+	mu       sync.Mutex // guards conn and the login fields
+	conn     *websocket.Conn
+	selfID   int64
+	self     string
+	nickname string
+	platform string
+	sn       atomic.Int64
+	closed   atomic.Bool
+}
+
+// NewSatoriDriver creates a driver for the gateway at url, hook is called
+// with the bot account after every (re)connection
+func NewSatoriDriver(url, token, platform string, hook ConnectHook) *SatoriDriver {
+	return &SatoriDriver{
+		URL:       strings.TrimRight(url, "/"),
+		Token:     token,
+		Platform:  platform,
+		stringIDs: newStringIDs(),
+		hook:      hook,
+		client:    &http.Client{Timeout: time.Minute},
+		channels:  newGenMap[int64, string](50000),
+		guilds:    newGenMap[int64, string](5000),
+		directs:   newGenMap[int64, string](5000),
+	}
+}
+
+// Connect blocks until the gateway accepted the identify
+func (d *SatoriDriver) Connect() {
+	for !d.closed.Load() {
+		if err := d.dial(); err != nil {
+			LogWarn("[satori] failed to connect to %s: %v, retrying in %v", d.URL, err, satoriRetry)
+			time.Sleep(satoriRetry)
+			continue
+		}
+		APICallers.Store(d.selfID, d)
+		if d.hook != nil {
+			d.hook(d.selfID)
+		}
+		LogInfo("[satori] connected to %s as %s account : %s", d.URL, d.platform, d.self)
+		observeConnect(d.selfID)
+		return
+	}
+}
+
+func (d *SatoriDriver) dial() error {
+	url := d.URL + "/v1/events"
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://"):
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+
+	identify := map[string]any{"op": satoriOpIdentify, "body": map[string]any{"token": d.Token, "sn": d.sn.Load()}}
+	if err := conn.WriteJSON(identify); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	ready := gjson.ParseBytes(payload)
+	if ready.Get("op").Int() != satoriOpReady {
+		_ = conn.Close()
+		return fmt.Errorf("expected READY, got %s", payload)
+	}
+	var login gjson.Result
+	for _, l := range ready.Get("body.logins").Array() {
+		if d.Platform == "" || l.Get("platform").String() == d.Platform {
+			login = l
+			break
+		}
+	}
+	self := login.Get("user.id").String()
+	if self == "" {
+		self = login.Get("self_id").String() // before Satori 1.1
+	}
+	if self == "" {
+		_ = conn.Close()
+		return fmt.Errorf("no login of platform %q in READY", d.Platform)
+	}
+
+	d.mu.Lock()
+	d.conn = conn
+	d.self = self
+	d.selfID = d.toInt(self)
+	d.nickname = login.Get("user.name").String()
+	d.platform = login.Get("platform").String()
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *SatoriDriver) Listen(handler func([]byte, APICaller)) {
+	go d.ping()
+	for {
+		d.listen(handler)
+		APICallers.Delete(d.selfID)
+		observeDisconnect(d.selfID)
+		if d.closed.Load() {
+			return
+		}
+		LogWarn("[satori] disconnected from %s, account : %s", d.URL, d.self)
+		d.Connect()
+	}
+}
+
+func (d *SatoriDriver) listen(handler func([]byte, APICaller)) {
+	for {
+		t, payload, err := d.conn.ReadMessage()
+		if err != nil {
+			_ = d.conn.Close()
+			return
+		}
+		if t != websocket.TextMessage {
+			continue
+		}
+		frame := gjson.ParseBytes(payload)
+		if frame.Get("op").Int() != satoriOpEvent {
+			continue // pong and meta
+		}
+		LogDebug("[satori] received event : %s", payload)
+		body := frame.Get("body")
+		if sn := body.Get("sn"); sn.Exists() {
+			d.sn.Store(sn.Int())
+		} else if id := body.Get("id"); id.Exists() { // before Satori 1.1
+			d.sn.Store(id.Int())
+		}
+		if event := d.event(body); event != nil {
+			handler(event, d)
+		}
+	}
+}
+
+// ping keeps the connection alive as the gateway expects a ping every 10s
+func (d *SatoriDriver) ping() {
+	ticker := time.NewTicker(satoriPing)
+	defer ticker.Stop()
+	for range ticker.C {
+		if d.closed.Load() {
+			return
+		}
+		d.mu.Lock()
+		if d.conn != nil {
+			_ = d.conn.WriteJSON(map[string]any{"op": satoriOpPing})
+		}
+		d.mu.Unlock()
+	}
+}
+
+// Close closes the connection and stops reconnecting
+func (d *SatoriDriver) Close() {
+	if !d.closed.CompareAndSwap(false, true) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return
+	}
+	_ = d.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shutdown"),
+		time.Now().Add(time.Second))
+	_ = d.conn.Close()
+}
+
+// event converts a Satori event into a v11 payload, nil drops it
+func (d *SatoriDriver) event(body gjson.Result) []byte {
+	if self := body.Get("login.user.id").String(); self != "" && self != d.self {
+		return nil // another login of the gateway
+	}
+	if self := body.Get("self_id").String(); self != "" && self != d.self {
+		return nil
+	}
+
+	event := map[string]any{
+		"time":    body.Get("timestamp").Int() / 1000,
+		"self_id": d.selfID,
+	}
+	userID := d.toInt(body.Get("user.id").String())
+	switch body.Get("type").String() {
+	case "message-created":
+		if body.Get("user.id").String() == d.self {
+			return nil
+		}
+		d.messageEvent(body, event)
+	case "message-deleted":
+		event["post_type"] = "notice"
+		event["user_id"] = userID
+		event["message_id"] = d.toInt(body.Get("message.id").String())
+		if d.isDirect(body) {
+			event["notice_type"] = "friend_recall"
+			break
+		}
+		event["notice_type"] = "group_recall"
+		event["group_id"] = d.groupID(body)
+		event["operator_id"] = d.operatorID(body, userID)
+	case "guild-member-added":
+		event["post_type"] = "notice"
+		event["notice_type"] = "group_increase"
+		event["sub_type"] = "approve"
+		event["group_id"] = d.groupID(body)
+		event["user_id"] = userID
+		event["operator_id"] = d.operatorID(body, userID)
+	case "guild-member-removed":
+		operatorID := d.operatorID(body, userID)
+		event["post_type"] = "notice"
+		event["notice_type"] = "group_decrease"
+		event["group_id"] = d.groupID(body)
+		event["user_id"] = userID
+		event["operator_id"] = operatorID
+		switch {
+		case userID == d.selfID:
+			event["sub_type"] = "kick_me"
+		case operatorID != userID:
+			event["sub_type"] = "kick"
+		default:
+			event["sub_type"] = "leave"
+		}
+	default:
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		LogWarn("[satori] failed to encode %s event: %v", body.Get("type").String(), err)
+		return nil
+	}
+	return payload
+}
+
+func (d *SatoriDriver) messageEvent(body gjson.Result, event map[string]any) {
+	var msg []satoriElement
+	if quote := body.Get("message.quote.id").String(); quote != "" {
+		msg = append(msg, satoriElement{Type: "quote", Attrs: map[string]string{"id": quote}})
+	}
+	msg = append(msg, parseSatoriContent(body.Get("message.content").String())...)
+	v11 := d.toMessage(msg, nil)
+
+	userID := d.toInt(body.Get("user.id").String())
+	messageID := d.toInt(body.Get("message.id").String())
+	channel := body.Get("channel.id").String()
+	d.channels.Set(messageID, channel)
+
+	nickname := body.Get("user.name").String()
+	if nickname == "" {
+		nickname = body.Get("user.nick").String()
+	}
+	event["post_type"] = "message"
+	event["message_id"] = messageID
+	event["user_id"] = userID
+	event["message"] = v11
+	event["raw_message"] = v11.String()
+	event["font"] = 0
+
+	sender := map[string]any{"user_id": userID, "nickname": nickname}
+	if d.isDirect(body) {
+		d.directs.Set(userID, channel)
+		event["message_type"] = "private"
+		event["sub_type"] = "friend"
+	} else {
+		event["message_type"] = "group"
+		event["sub_type"] = "normal"
+		event["group_id"] = d.groupID(body)
+		sender["card"] = body.Get("member.nick").String()
+		sender["role"] = satoriRole(body.Get("member"))
+	}
+	event["sender"] = sender
+}
+
+func (d *SatoriDriver) isDirect(body gjson.Result) bool {
+	return body.Get("channel.type").Int() == satoriChannelDirect || !body.Get("guild.id").Exists()
+}
+
+// groupID maps the channel of an event to a group and remembers its guild
+// for member actions, member events without a channel use the guild
+func (d *SatoriDriver) groupID(body gjson.Result) int64 {
+	guild := body.Get("guild.id").String()
+	channel := body.Get("channel.id").String()
+	if channel == "" {
+		channel = guild
+	}
+	id := d.toInt(channel)
+	if guild != "" {
+		d.guilds.Set(id, guild)
+	}
+	return id
+}
+
+func (d *SatoriDriver) operatorID(body gjson.Result, fallback int64) int64 {
+	if id := body.Get("operator.id").String(); id != "" {
+		return d.toInt(id)
+	}
+	return fallback
+}
+
+// satoriRole maps the roles of a guild member to the role of OneBot. Satori
+// has no standard role names, gateways bridging QQ (e.g. Koishi) fill roles
+// with "owner"/"admin", others leave it out and every member is a "member",
+// so group admin checks only pass for bot admins there.
+func satoriRole(member gjson.Result) string {
+	role := "member"
+	for _, r := range member.Get("roles").Array() {
+		name := r.String()
+		if r.IsObject() {
+			name = r.Get("name").String()
+			if name == "" {
+				name = r.Get("id").String()
+			}
+		}
+		switch strings.ToLower(name) {
+		case "owner":
+			return "owner"
+		case "admin", "administrator":
+			role = "admin"
+		}
+	}
+	return role
+}
+
+func (d *SatoriDriver) guildOf(groupID any) string {
+	if guild, ok := d.guilds.Get(d.toInt(d.anyToStr(groupID))); ok {
+		return guild
+	}
+	return d.anyToStr(groupID) // platforms like QQ use the same id for both
+}
+
+func (d *SatoriDriver) CallAPI(req APIRequest) (rsp APIResponse, err error) {
+	begin := time.Now()
+	defer func() {
+		observeAPICall(req.Action, begin, err)
+	}()
+
+	var data any
+	switch req.Action {
+	case "send_msg", "send_group_msg", "send_private_msg":
+		data, err = d.sendMessage(req)
+	case "delete_msg":
+		data, err = d.deleteMessage(req)
+	case "get_group_member_info":
+		data, err = d.getMember(req)
+	case "set_group_kick":
+		_, err = d.post("guild.member.kick", map[string]any{
+			"guild_id":  d.guildOf(req.Params["group_id"]),
+			"user_id":   d.anyToStr(req.Params["user_id"]),
+			"permanent": req.Params["reject_add_request"] == true,
+		})
+	case "set_group_ban":
+		_, err = d.post("guild.member.mute", map[string]any{
+			"guild_id": d.guildOf(req.Params["group_id"]),
+			"user_id":  d.anyToStr(req.Params["user_id"]),
+			"duration": paramInt(req.Params["duration"]) * 1000,
+		})
+	case "get_login_info":
+		d.mu.Lock()
+		data = map[string]any{"user_id": d.selfID, "nickname": d.nickname}
+		d.mu.Unlock()
+	default:
+		err = fmt.Errorf("%w %s on satori", ErrUnsupported, req.Action)
+		return APIResponse{Status: "failed", RetCode: 1404, Message: err.Error(), Echo: req.Echo}, err
+	}
+	if err != nil {
+		return APIResponse{Status: "failed", RetCode: 100, Message: err.Error(), Echo: req.Echo}, err
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nullResponse, err
+	}
+	return APIResponse{Status: "ok", Data: gjson.ParseBytes(raw), Echo: req.Echo}, nil
+}
+
+func (d *SatoriDriver) sendMessage(req APIRequest) (any, error) {
+	group := req.Action == "send_group_msg" || req.Params["message_type"] == "group" ||
+		req.Action == "send_msg" && req.Params["message_type"] == nil && paramInt(req.Params["group_id"]) != 0
+
+	var channel string
+	if group {
+		channel = d.anyToStr(req.Params["group_id"])
+	} else {
+		var err error
+		if channel, err = d.directChannel(req.Params["user_id"]); err != nil {
+			return nil, err
+		}
+	}
+	content, err := d.toContent(req.Params["message"])
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := d.post("message.create", map[string]any{"channel_id": channel, "content": content})
+	if err != nil {
+		return nil, err
+	}
+	messageID := d.toInt(res.Get("0.id").String())
+	d.channels.Set(messageID, channel)
+	return map[string]any{"message_id": messageID}, nil
+}
+
+// directChannel returns the private channel of a user, creating it if the
+// user has not written to the bot yet
+func (d *SatoriDriver) directChannel(userID any) (string, error) {
+	user := d.anyToStr(userID)
+	if channel, ok := d.directs.Get(d.toInt(user)); ok {
+		return channel, nil
+	}
+	res, err := d.post("user.channel.create", map[string]any{"user_id": user})
+	if err != nil {
+		return "", err
+	}
+	channel := res.Get("id").String()
+	d.directs.Set(d.toInt(user), channel)
+	return channel, nil
+}
+
+func (d *SatoriDriver) deleteMessage(req APIRequest) (any, error) {
+	id := d.anyToStr(req.Params["message_id"])
+	channel, ok := d.channels.Get(d.toInt(id))
+	if !ok {
+		return nil, fmt.Errorf("channel of message %s is unknown", id)
+	}
+	_, err := d.post("message.delete", map[string]any{"channel_id": channel, "message_id": id})
+	return map[string]any{}, err
+}
+
+func (d *SatoriDriver) getMember(req APIRequest) (any, error) {
+	res, err := d.post("guild.member.get", map[string]any{
+		"guild_id": d.guildOf(req.Params["group_id"]),
+		"user_id":  d.anyToStr(req.Params["user_id"]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"group_id":  paramInt(req.Params["group_id"]),
+		"user_id":   d.toInt(res.Get("user.id").String()),
+		"nickname":  res.Get("user.name").String(),
+		"card":      res.Get("nick").String(),
+		"role":      satoriRole(res),
+		"join_time": res.Get("joined_at").Int() / 1000,
+	}, nil
+}
+
+// post calls a method of the http api, e.g. message.create
+func (d *SatoriDriver) post(method string, params map[string]any) (gjson.Result, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.URL+"/v1/"+method, bytes.NewReader(raw))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	d.mu.Lock()
+	req.Header.Set("Satori-Platform", d.platform)
+	req.Header.Set("Satori-User-ID", d.self)
+	req.Header.Set("X-Platform", d.platform) // before Satori 1.1
+	req.Header.Set("X-Self-ID", d.self)
+	d.mu.Unlock()
+	req.Header.Set("Content-Type", "application/json")
+	if d.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.Token)
+	}
+
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 16<<20))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if rsp.StatusCode/100 != 2 {
+		return gjson.Result{}, fmt.Errorf("%s: %s %s", method, rsp.Status, strings.TrimSpace(string(body)))
+	}
+	LogDebug("[satori] %s returned : %s", method, body)
+	return gjson.ParseBytes(body), nil
+}
+
+// paramInt reads an integer api param of any numeric type
+func paramInt(v any) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,272 @@
+package onebot
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	"html"
+	"marmot/onebot/message"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// satoriElement is a node of Satori message content, text nodes have no type
+// https://satori.chat/zh-CN/protocol/elements.html
+type satoriElement struct {
+	Type     string
+	Attrs    map[string]string
+	Text     string
+	Children []satoriElement
+}
+
+// parseSatoriContent parses the xml-like content of a Satori message. It is
+// lenient: broken tags are kept as text and unclosed ones end with the content.
+func parseSatoriContent(content string) []satoriElement {
+	p := &satoriParser{s: content}
+	return p.nodes("")
+}
+
+type satoriParser struct {
+	s string
+	i int
+}
+
+func (p *satoriParser) nodes(parent string) []satoriElement {
+	var out []satoriElement
+	for p.i < len(p.s) {
+		lt := strings.IndexByte(p.s[p.i:], '<')
+		if lt < 0 {
+			out = appendSatoriText(out, p.s[p.i:])
+			p.i = len(p.s)
+			break
+		}
+		out = appendSatoriText(out, p.s[p.i:p.i+lt])
+		p.i += lt
+
+		if strings.HasPrefix(p.s[p.i:], "</") {
+			end := strings.IndexByte(p.s[p.i:], '>')
+			if end < 0 {
+				out = appendSatoriText(out, p.s[p.i:])
+				p.i = len(p.s)
+				break
+			}
+			p.i += end + 1
+			if parent != "" {
+				return out // a mismatched closing tag also ends the parent
+			}
+			continue
+		}
+
+		el, ok := p.tag()
+		if !ok {
+			out = appendSatoriText(out, "<")
+			p.i++
+			continue
+		}
+		out = append(out, el)
+	}
+	return out
+}
+
+// tag parses the element starting at '<', ok is false when it is not a tag
+func (p *satoriParser) tag() (el satoriElement, ok bool) {
+	start := p.i
+	i := p.i + 1
+	for i < len(p.s) && isSatoriNameChar(p.s[i]) {
+		i++
+	}
+	if i == p.i+1 {
+		return el, false
+	}
+	el.Type = strings.ToLower(p.s[p.i+1 : i])
+	el.Attrs = make(map[string]string)
+
+	for {
+		for i < len(p.s) && isSatoriSpace(p.s[i]) {
+			i++
+		}
+		if i >= len(p.s) {
+			p.i = start
+			return el, false
+		}
+		switch {
+		case strings.HasPrefix(p.s[i:], "/>"):
+			p.i = i + 2
+			return el, true
+		case p.s[i] == '>':
+			p.i = i + 1
+			if el.Type != "br" {
+				el.Children = p.nodes(el.Type)
+			}
+			return el, true
+		}
+
+		nameStart := i
+		for i < len(p.s) && !isSatoriSpace(p.s[i]) && !strings.ContainsRune("=/>", rune(p.s[i])) {
+			i++
+		}
+		name := p.s[nameStart:i]
+		if name == "" {
+			i++ // stray character
+			continue
+		}
+		if i >= len(p.s) || p.s[i] != '=' {
+			el.Attrs[name] = "true"
+			continue
+		}
+		i++
+
+		var value string
+		if i < len(p.s) && (p.s[i] == '"' || p.s[i] == '\'') {
+			end := strings.IndexByte(p.s[i+1:], p.s[i])
+			if end < 0 {
+				p.i = start
+				return el, false
+			}
+			value = p.s[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			valueStart := i
+			for i < len(p.s) && !isSatoriSpace(p.s[i]) && p.s[i] != '>' {
+				i++
+			}
+			value = p.s[valueStart:i]
+		}
+		el.Attrs[name] = html.UnescapeString(value)
+	}
+}
+
+func appendSatoriText(out []satoriElement, text string) []satoriElement {
+	if text == "" {
+		return out
+	}
+	return append(out, satoriElement{Text: html.UnescapeString(text)})
+}
+
+func isSatoriNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':'
+}
+
+func isSatoriSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// toMessage converts Satori elements into v11 segments, formatting elements
+// keep their text and unknown ones are flattened into their children
+func (d *SatoriDriver) toMessage(elements []satoriElement, msg message.Message) message.Message {
+	text := func(s string) {
+		if s == "" {
+			return
+		}
+		if n := len(msg); n > 0 && msg[n-1].Type == "text" {
+			msg[n-1] = message.Text(msg[n-1].Data["text"] + s)
+			return
+		}
+		msg = append(msg, message.Text(s))
+	}
+
+	for _, el := range elements {
+		switch el.Type {
+		case "":
+			text(el.Text)
+		case "at":
+			if tp := el.Attrs["type"]; tp == "all" || tp == "here" {
+				msg = append(msg, message.AtAll())
+			} else if id := el.Attrs["id"]; id != "" {
+				msg = append(msg, message.At(d.toInt(id)))
+			} else if name := el.Attrs["name"]; name != "" {
+				text("@" + name)
+			}
+		case "sharp":
+			text("#" + el.Attrs["name"])
+		case "img", "image":
+			msg = append(msg, message.Image(el.Attrs["src"]))
+		case "audio":
+			msg = append(msg, message.Record(el.Attrs["src"]))
+		case "video":
+			msg = append(msg, message.Video(el.Attrs["src"]))
+		case "file":
+			msg = append(msg, message.File(el.Attrs["src"], el.Attrs["title"]))
+		case "quote":
+			if id := el.Attrs["id"]; id != "" {
+				msg = append(msg, message.Reply(d.toInt(id)))
+			}
+		case "br":
+			text("\n")
+		case "p":
+			msg = d.toMessage(el.Children, msg)
+			text("\n")
+		default:
+			msg = d.toMessage(el.Children, msg)
+		}
+	}
+	return msg
+}
+
+// toContent encodes a v11 message param (string, segment or array) as Satori
+// content, segments without a Satori element are dropped
+func (d *SatoriDriver) toContent(v any) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	if parsed := gjson.ParseBytes(raw); parsed.IsObject() {
+		raw = append(append([]byte{'['}, raw...), ']')
+	}
+
+	var sb strings.Builder
+	for _, seg := range message.ParseMessage(raw) {
+		switch seg.Type {
+		case "text":
+			sb.WriteString(html.EscapeString(seg.Data["text"]))
+		case "at":
+			if seg.Data["qq"] == "all" {
+				sb.WriteString(`<at type="all"/>`)
+			} else {
+				fmt.Fprintf(&sb, `<at id="%s"/>`, html.EscapeString(d.anyToStr(seg.Data["qq"])))
+			}
+		case "reply":
+			fmt.Fprintf(&sb, `<quote id="%s"/>`, html.EscapeString(d.anyToStr(seg.Data["id"])))
+		case "image", "record", "video", "file":
+			src, err := satoriSrc(seg.Data["file"])
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %w", seg.Type, err)
+			}
+			switch seg.Type {
+			case "image":
+				fmt.Fprintf(&sb, `<img src="%s"/>`, html.EscapeString(src))
+			case "record":
+				fmt.Fprintf(&sb, `<audio src="%s"/>`, html.EscapeString(src))
+			case "video":
+				fmt.Fprintf(&sb, `<video src="%s"/>`, html.EscapeString(src))
+			default:
+				fmt.Fprintf(&sb, `<file src="%s" title="%s"/>`, html.EscapeString(src), html.EscapeString(seg.Data["name"]))
+			}
+		default:
+			LogDebug("[satori] dropped %s segment without a Satori element", seg.Type)
+		}
+	}
+	return sb.String(), nil
+}
+
+// satoriSrc turns the file of a v11 media segment into a src attribute,
+// local files and base64 data are sent inline as data urls
+func satoriSrc(file string) (string, error) {
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(file, "base64://"):
+		data, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(file, "base64://"))
+	case strings.HasPrefix(file, "file://"):
+		data, err = os.ReadFile(strings.TrimPrefix(file, "file://"))
+	default:
+		return file, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	mime, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
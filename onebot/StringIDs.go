@@ -0,0 +1,149 @@
+package onebot
+
+import (
+	"fmt"
+	"hash/crc64"
+	"marmot/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var crcTable = crc64.MakeTable(crc64.ISO)
+
+// genMap is a bounded map keeping the entries of the current and the
+// previous generation, older entries are dropped as new ones come in
+type genMap[K comparable, V any] struct {
+	mu       sync.Mutex
+	cur, old map[K]V
+	limit    int
+}
+
+func newGenMap[K comparable, V any](limit int) *genMap[K, V] {
+	return &genMap[K, V]{cur: make(map[K]V), old: make(map[K]V), limit: limit}
+}
+
+func (m *genMap[K, V]) Get(key K) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.cur[key]; ok {
+		return v, true
+	}
+	v, ok := m.old[key]
+	return v, ok
+}
+
+func (m *genMap[K, V]) Set(key K, val V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.cur) >= m.limit {
+		m.old, m.cur = m.cur, make(map[K]V)
+	}
+	m.cur[key] = val
+}
+
+// IDStore persists the reverse table of hashed ids, so ids handed out
+// before a restart or evicted from memory can still be sent back. SaveID is
+// called on the event path and should not block, it's called again every
+// idResave for ids still in use, so stores may expire ids not saved longer.
+type IDStore interface {
+	LoadID(n int64) (string, bool)
+	SaveID(n int64, id string) error
+}
+
+var idStore IDStore
+
+// idResave is how often the ids still in use are saved again
+const idResave = 24 * time.Hour
+
+func SetIDStore(store IDStore) {
+	idStore = store
+}
+
+// stringIDs maps the string ids of other protocols to the int64 ids of the
+// v11 model. Numeric ids are kept as is, others are hashed with a reverse
+// table so they can be sent back.
+type stringIDs struct {
+	ids *genMap[int64, string]
+	// saved is when a hashed id was last passed to idStore, unix seconds
+	saved *genMap[int64, int64]
+}
+
+// hashedIDMin is the lowest id toInt hashes to
+const hashedIDMin = 0x1_0000_0000
+
+func newStringIDs() *stringIDs {
+	return &stringIDs{ids: newGenMap[int64, string](50000), saved: newGenMap[int64, int64](50000)}
+}
+
+func (m *stringIDs) toInt(id string) int64 {
+	if id == "" {
+		return 0
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil && strconv.FormatInt(n, 10) == id {
+		return n
+	}
+	n := int64(crc64.Checksum(utils.StringToBytes(id), crcTable) & 0x7fff_ffff_ffff_ffff)
+	if n < hashedIDMin {
+		n |= hashedIDMin // keep clear of real numeric ids
+	}
+	known, ok := m.ids.Get(n)
+	if !ok || known != id {
+		m.ids.Set(n, id)
+	}
+	m.save(n, id, ok && known == id)
+	return n
+}
+
+// save passes a hashed id to idStore, ids already known are only saved
+// again once per idResave
+func (m *stringIDs) save(n int64, id string, known bool) {
+	if idStore == nil {
+		return
+	}
+	now := time.Now().Unix()
+	if last, ok := m.saved.Get(n); known && ok && now-last < int64(idResave/time.Second) {
+		return
+	}
+	m.saved.Set(n, now)
+	if err := idStore.SaveID(n, id); err != nil {
+		LogWarn("[bot] failed to persist id %s: %v", id, err)
+	}
+}
+
+func (m *stringIDs) toStr(id int64) string {
+	if s, ok := m.ids.Get(id); ok {
+		return s
+	}
+	if idStore != nil {
+		if s, ok := idStore.LoadID(id); ok {
+			m.ids.Set(id, s)
+			return s
+		}
+	}
+	str := strconv.FormatInt(id, 10)
+	if id >= hashedIDMin {
+		// numeric ids this large exist, but it may also be a hashed id whose
+		// string was lost, sending the number then targets the wrong user
+		LogWarn("[bot] no string id known for %d, sending it as a number", id)
+		m.ids.Set(id, str) // warn and look it up once
+	}
+	return str
+}
+
+// anyToStr converts a v11 id param (int64, string...) into a string id
+func (m *stringIDs) anyToStr(v any) string {
+	switch id := v.(type) {
+	case int64:
+		return m.toStr(id)
+	case int:
+		return m.toStr(int64(id))
+	case string:
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+			return m.toStr(n)
+		}
+		return id
+	default:
+		return fmt.Sprint(v)
+	}
+}
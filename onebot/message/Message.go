@@ -488,6 +488,147 @@ func TTS(text string) Segment {
 	}
 }
 
+// Shake 窗口抖动
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func Shake() Segment {
+	return Segment{
+		Type: "shake",
+		Data: map[string]string{},
+	}
+}
+
+// Anonymous 匿名发消息
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func Anonymous() Segment {
+	return Segment{
+		Type: "anonymous",
+		Data: map[string]string{},
+	}
+}
+
+// Dice 骰子
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func Dice() Segment {
+	return Segment{
+		Type: "dice",
+		Data: map[string]string{},
+	}
+}
+
+// Rps 猜拳
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func Rps() Segment {
+	return Segment{
+		Type: "rps",
+		Data: map[string]string{},
+	}
+}
+
+// ContactUser 推荐好友
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func ContactUser(userID int64) Segment {
+	return Segment{
+		Type: "contact",
+		Data: map[string]string{
+			"type": "qq",
+			"id":   strconv.FormatInt(userID, 10),
+		},
+	}
+}
+
+// ContactGroup 推荐群
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func ContactGroup(groupID int64) Segment {
+	return Segment{
+		Type: "contact",
+		Data: map[string]string{
+			"type": "group",
+			"id":   strconv.FormatInt(groupID, 10),
+		},
+	}
+}
+
+// Location 位置
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func Location(lat, lon float64, title, content string) Segment {
+	return Segment{
+		Type: "location",
+		Data: map[string]string{
+			"lat":     strconv.FormatFloat(lat, 'f', -1, 64),
+			"lon":     strconv.FormatFloat(lon, 'f', -1, 64),
+			"title":   title,
+			"content": content,
+		},
+	}
+}
+
+// Share 链接分享
+// https://github.com/botuniverse/onebot-11/tree/master/message/segment.md
+func Share(url, title, content, image string) Segment {
+	return Segment{
+		Type: "share",
+		Data: map[string]string{
+			"url":     url,
+			"title":   title,
+			"content": content,
+			"image":   image,
+		},
+	}
+}
+
+// Markdown markdown 消息 (NapCat/LLOneBot 扩展)
+func Markdown(content string) Segment {
+	return Segment{
+		Type: "markdown",
+		Data: map[string]string{
+			"content": content,
+		},
+	}
+}
+
+// MFace 商城表情 (NapCat 扩展)
+func MFace(packageID int64, emojiID, key, summary string) Segment {
+	return Segment{
+		Type: "mface",
+		Data: map[string]string{
+			"emoji_package_id": strconv.FormatInt(packageID, 10),
+			"emoji_id":         emojiID,
+			"key":              key,
+			"summary":          summary,
+		},
+	}
+}
+
+// LongMsg 长消息, id 为上传长消息后得到的 res_id (Lagrange 扩展)
+func LongMsg(id string) Segment {
+	return Segment{
+		Type: "longmsg",
+		Data: map[string]string{
+			"id": id,
+		},
+	}
+}
+
+// Keyboard 按钮, content 为按钮的 json (Lagrange 扩展)
+func Keyboard(content string) Segment {
+	return Segment{
+		Type: "keyboard",
+		Data: map[string]string{
+			"content": content,
+		},
+	}
+}
+
+// LightApp 小程序卡片, content 为卡片的 json (Lagrange 扩展)
+func LightApp(content string) Segment {
+	return Segment{
+		Type: "lightapp",
+		Data: map[string]string{
+			"content": content,
+		},
+	}
+}
+
 // Add 为 MessageSegment 的 Data 增加一个字段
 func (m Segment) Add(key string, val interface{}) Segment {
 	switch val := val.(type) {
@@ -0,0 +1,93 @@
+package message
+
+import (
+	"strconv"
+)
+
+// ImageSeg 图片消息段的数据
+type ImageSeg struct {
+	File    string
+	URL     string
+	Summary string // 图片预览文字
+	SubType int    // 0 普通图片, 1 表情包
+	Flash   bool   // 闪照
+}
+
+// ReplySeg 回复消息段的数据
+type ReplySeg struct {
+	ID string
+}
+
+// MessageID 被回复的消息 id
+func (r ReplySeg) MessageID() ID {
+	return NewMessageIDFromString(r.ID)
+}
+
+// AtSeg @ 消息段的数据
+type AtSeg struct {
+	QQ   int64 // @全体成员 时为 0
+	All  bool
+	Name string // 部分实现会带上被 @ 的名称
+}
+
+// FileSeg 文件消息段的数据
+type FileSeg struct {
+	File   string
+	Name   string
+	URL    string
+	FileID string
+	Size   int64
+}
+
+// AsImage 解析图片消息段
+func (m Segment) AsImage() (ImageSeg, bool) {
+	if m.Type != "image" {
+		return ImageSeg{}, false
+	}
+	subType, _ := strconv.Atoi(m.Data["sub_type"])
+	return ImageSeg{
+		File:    m.Data["file"],
+		URL:     m.Data["url"],
+		Summary: m.Data["summary"],
+		SubType: subType,
+		Flash:   m.Data["type"] == "flash",
+	}, true
+}
+
+// AsReply 解析回复消息段
+func (m Segment) AsReply() (ReplySeg, bool) {
+	if m.Type != "reply" {
+		return ReplySeg{}, false
+	}
+	return ReplySeg{ID: m.Data["id"]}, true
+}
+
+// AsAt 解析 @ 消息段
+func (m Segment) AsAt() (AtSeg, bool) {
+	if m.Type != "at" {
+		return AtSeg{}, false
+	}
+	if m.Data["qq"] == "all" {
+		return AtSeg{All: true, Name: m.Data["name"]}, true
+	}
+	qq, err := strconv.ParseInt(m.Data["qq"], 10, 64)
+	return AtSeg{QQ: qq, Name: m.Data["name"]}, err == nil
+}
+
+// AsFile 解析文件消息段
+func (m Segment) AsFile() (FileSeg, bool) {
+	if m.Type != "file" {
+		return FileSeg{}, false
+	}
+	size, _ := strconv.ParseInt(m.Data["file_size"], 10, 64)
+	if size == 0 {
+		size, _ = strconv.ParseInt(m.Data["size"], 10, 64)
+	}
+	return FileSeg{
+		File:   m.Data["file"],
+		Name:   m.Data["name"],
+		URL:    m.Data["url"],
+		FileID: m.Data["file_id"],
+		Size:   size,
+	}, true
+}
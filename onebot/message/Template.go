@@ -0,0 +1,135 @@
+package message
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Vars are the values of template placeholders. A value is a string, an
+// integer, a fmt.Stringer or a func() string which is only called when the
+// template uses it (e.g. names looked up through the api).
+type Vars map[string]any
+
+// Lookup returns the text of the variable
+func (v Vars) Lookup(name string) (string, bool) {
+	val, ok := v[name]
+	if !ok {
+		return "", false
+	}
+	switch val := val.(type) {
+	case string:
+		return val, true
+	case int64:
+		return strconv.FormatInt(val, 10), true
+	case int:
+		return strconv.Itoa(val), true
+	case func() string:
+		return val(), true
+	case fmt.Stringer:
+		return val.String(), true
+	default:
+		return fmt.Sprint(val), true
+	}
+}
+
+// templateSegments builds the segment of a {kind:arg} placeholder
+var templateSegments = map[string]func(arg string) (Segment, bool){
+	"at": func(arg string) (Segment, bool) {
+		if arg == "all" {
+			return AtAll(), true
+		}
+		qq, err := strconv.ParseInt(arg, 10, 64)
+		return At(qq), err == nil && qq != 0
+	},
+	"face": func(arg string) (Segment, bool) {
+		id, err := strconv.Atoi(arg)
+		return Face(id), err == nil
+	},
+	"image":  func(arg string) (Segment, bool) { return Image(arg), arg != "" },
+	"record": func(arg string) (Segment, bool) { return Record(arg), arg != "" },
+	"video":  func(arg string) (Segment, bool) { return Video(arg), arg != "" },
+	"reply":  func(arg string) (Segment, bool) { return Reply(arg), arg != "" && arg != "0" },
+}
+
+// mediaPlaceholders take their source literally, a variable holding a
+// user supplied text must not become a file path
+var mediaPlaceholders = map[string]bool{"image": true, "record": true, "video": true}
+
+// Render turns a template into a message. Placeholders are
+//
+//	{name}         the text of a variable
+//	{at:name}      mention the user id in a variable, a literal id or "all"
+//	{face:id}      a QQ face
+//	{image:src}    an image, src is a url, file:// or base64://
+//	{record:src}   a voice message
+//	{video:src}    a video
+//	{reply:name}   reply to the message id in a variable
+//
+// {{ and }} write literal braces. Values of variables always end up as plain
+// text, so a nickname can not inject segments. Unknown placeholders are kept
+// as they are.
+func Render(tmpl string, vars Vars) Message {
+	m := Message{}
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			m = append(m, Text(text.String()))
+			text.Reset()
+		}
+	}
+
+	for tmpl != "" {
+		i := strings.IndexAny(tmpl, "{}")
+		if i < 0 {
+			text.WriteString(tmpl)
+			break
+		}
+		text.WriteString(tmpl[:i])
+		brace := tmpl[i]
+		tmpl = tmpl[i+1:]
+		if tmpl != "" && tmpl[0] == brace { // escaped {{ or }}
+			text.WriteByte(brace)
+			tmpl = tmpl[1:]
+			continue
+		}
+		end := strings.IndexByte(tmpl, '}')
+		if brace == '}' || end < 0 {
+			text.WriteByte(brace)
+			continue
+		}
+
+		placeholder := tmpl[:end]
+		tmpl = tmpl[end+1:]
+		kind, arg, isSegment := strings.Cut(placeholder, ":")
+		if !isSegment {
+			if val, ok := vars.Lookup(placeholder); ok {
+				text.WriteString(val)
+				continue
+			}
+		} else if build, ok := templateSegments[kind]; ok {
+			if val, ok := vars.Lookup(arg); ok && !mediaPlaceholders[kind] {
+				arg = val
+			}
+			if seg, ok := build(arg); ok {
+				flush()
+				m = append(m, seg)
+				continue
+			}
+		}
+		text.WriteString("{" + placeholder + "}")
+	}
+	flush()
+	return m
+}
+
+// UsesLocalFile reports whether the template sends a file:// path, templates
+// set by untrusted users should not read files of the bot host
+func UsesLocalFile(tmpl string) bool {
+	for kind := range mediaPlaceholders {
+		if strings.Contains(strings.ToLower(tmpl), "{"+kind+":file:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	vars := Vars{
+		"name":  "{at:123}",
+		"user":  int64(10001),
+		"count": 3,
+		"msg":   "42",
+		"lazy":  func() string { return "lazy" },
+	}
+	tests := []struct {
+		name string
+		tmpl string
+		want Message
+	}{
+		{"plain", "hello", Message{Text("hello")}},
+		{"variables", "{count} by {lazy}", Message{Text("3 by lazy")}},
+		{"escaped braces", "{{name}} }} {{", Message{Text("{name} } {")}},
+		{"escaped around placeholder", "{{{count}}}", Message{Text("{3}")}},
+		{"unknown variable", "hi {nobody}", Message{Text("hi {nobody}")}},
+		{"unknown segment", "{poke:1}", Message{Text("{poke:1}")}},
+		{"invalid segment argument", "{at:bob} {face:x}", Message{Text("{at:bob} {face:x}")}},
+		{"unclosed brace", "a { b", Message{Text("a { b")}},
+		{"lone closing brace", "a } b", Message{Text("a } b")}},
+		{"value injecting a segment", "hi {name}", Message{Text("hi {at:123}")}},
+		{"at variable", "{at:user} hi", Message{At(10001), Text(" hi")}},
+		{"at literal", "{at:all}{at:20000}", Message{AtAll(), At(20000)}},
+		{"reply variable", "{reply:msg}ok", Message{Reply("42"), Text("ok")}},
+		{"media is literal", "{image:msg}", Message{Image("msg")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.tmpl, vars); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Render(%q) = %v, want %v", tt.tmpl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsesLocalFile(t *testing.T) {
+	if !UsesLocalFile("{IMAGE:file:///etc/passwd}") {
+		t.Fatal("file:// image not detected")
+	}
+	if UsesLocalFile("{image:https://example.com/a.png} file:") {
+		t.Fatal("remote image reported as a local file")
+	}
+}
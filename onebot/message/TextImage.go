@@ -0,0 +1,415 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// TextImageOptions 文字转图片的排版参数, 零值使用默认值
+type TextImageOptions struct {
+	Width    int     // 图片宽度 (默认 800)
+	FontSize float64 // 正文字号 (默认 24)
+	Padding  int     // 边距 (默认 FontSize)
+}
+
+// cjkFontPaths are tried when no font was set, the bundled Go fonts have no
+// CJK glyphs
+var cjkFontPaths = []string{
+	"/usr/share/fonts/opentype/noto/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/noto-cjk/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/google-noto-cjk/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/truetype/wqy/wqy-microhei.ttc",
+	"/usr/share/fonts/wenquanyi/wqy-microhei/wqy-microhei.ttc",
+	"/usr/share/fonts/truetype/wqy/wqy-zenhei.ttc",
+	"/System/Library/Fonts/PingFang.ttc",
+	"/System/Library/Fonts/STHeiti Light.ttc",
+	"C:\\Windows\\Fonts\\msyh.ttc",
+	"C:\\Windows\\Fonts\\simhei.ttf",
+}
+
+var textFonts struct {
+	sync.Mutex
+	loaded  bool
+	text    []*opentype.Font // tried in order for every rune
+	mono    []*opentype.Font
+	bundled [2]*opentype.Font // go regular and go mono
+}
+
+// SetTextImageFont 设置文字转图片使用的字体 (ttf/otf/ttc), 缺少的字形由内置字体补充
+func SetTextImageFont(path string) error {
+	f, err := loadFontFile(path)
+	if err != nil {
+		return err
+	}
+	textFonts.Lock()
+	defer textFonts.Unlock()
+	loadBundledFonts()
+	textFonts.text = []*opentype.Font{f, textFonts.bundled[0]}
+	textFonts.mono = []*opentype.Font{textFonts.bundled[1], f}
+	textFonts.loaded = true
+	return nil
+}
+
+// loadFontFile loads the first font of a ttf, otf or ttc file
+func loadFontFile(path string) (*opentype.Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := opentype.ParseCollection(data) // also parses single fonts
+	if err != nil {
+		return nil, err
+	}
+	if collection.NumFonts() == 0 {
+		return nil, errors.New("no font in " + path)
+	}
+	return collection.Font(0)
+}
+
+func loadBundledFonts() {
+	if textFonts.bundled[0] != nil {
+		return
+	}
+	textFonts.bundled[0], _ = opentype.Parse(goregular.TTF)
+	textFonts.bundled[1], _ = opentype.Parse(gomono.TTF)
+}
+
+// fonts returns the text and code fonts, the first call without
+// SetTextImageFont looks for a CJK font of the system
+func fonts() (text, mono []*opentype.Font) {
+	textFonts.Lock()
+	defer textFonts.Unlock()
+	if !textFonts.loaded {
+		loadBundledFonts()
+		textFonts.text = []*opentype.Font{textFonts.bundled[0]}
+		textFonts.mono = []*opentype.Font{textFonts.bundled[1]}
+		for _, path := range cjkFontPaths {
+			if cjk, err := loadFontFile(path); err == nil {
+				textFonts.text = []*opentype.Font{cjk, textFonts.bundled[0]}
+				textFonts.mono = append(textFonts.mono, cjk)
+				break
+			}
+		}
+		textFonts.loaded = true
+	}
+	return textFonts.text, textFonts.mono
+}
+
+// faceChain draws every rune with the first face having its glyph
+type faceChain []font.Face
+
+func newFaceChain(fonts []*opentype.Font, size float64) faceChain {
+	chain := make(faceChain, 0, len(fonts))
+	for _, f := range fonts {
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err == nil {
+			chain = append(chain, face)
+		}
+	}
+	return chain
+}
+
+func (c faceChain) pick(r rune) (font.Face, fixed.Int26_6) {
+	for _, face := range c {
+		if adv, ok := face.GlyphAdvance(r); ok {
+			return face, adv
+		}
+	}
+	adv, _ := c[0].GlyphAdvance(r)
+	return c[0], adv
+}
+
+func (c faceChain) width(s string) fixed.Int26_6 {
+	var w fixed.Int26_6
+	for _, r := range s {
+		_, adv := c.pick(r)
+		w += adv
+	}
+	return w
+}
+
+func (c faceChain) close() {
+	for _, face := range c {
+		_ = face.Close()
+	}
+}
+
+type blockKind int
+
+const (
+	blockText blockKind = iota
+	blockHeading
+	blockList
+	blockQuote
+	blockCode
+	blockRule
+)
+
+type textBlock struct {
+	kind   blockKind
+	level  int    // heading level
+	bullet string // list marker
+	text   string
+}
+
+// parseMarkdown splits the text into blocks, only headings, lists, quotes,
+// rules and fenced code are understood
+func parseMarkdown(text string) []textBlock {
+	var blocks []textBlock
+	inCode := false
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			blocks = append(blocks, textBlock{kind: blockCode, text: strings.ReplaceAll(line, "\t", "    ")})
+			continue
+		}
+		switch {
+		case trimmed == "---" || trimmed == "***" || trimmed == "___":
+			blocks = append(blocks, textBlock{kind: blockRule})
+		case strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level <= 6 && strings.HasPrefix(trimmed[level:], " ") {
+				blocks = append(blocks, textBlock{kind: blockHeading, level: level, text: stripInline(trimmed[level+1:])})
+			} else {
+				blocks = append(blocks, textBlock{kind: blockText, text: stripInline(line)})
+			}
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+			blocks = append(blocks, textBlock{kind: blockList, bullet: "•", text: stripInline(trimmed[2:])})
+		case orderedMarker(trimmed) != "":
+			marker := orderedMarker(trimmed)
+			blocks = append(blocks, textBlock{kind: blockList, bullet: marker, text: stripInline(strings.TrimSpace(trimmed[len(marker):]))})
+		case strings.HasPrefix(trimmed, ">"):
+			blocks = append(blocks, textBlock{kind: blockQuote, text: stripInline(strings.TrimSpace(trimmed[1:]))})
+		default:
+			blocks = append(blocks, textBlock{kind: blockText, text: stripInline(line)})
+		}
+	}
+	return blocks
+}
+
+// orderedMarker returns "1." of "1. item", empty for other lines
+func orderedMarker(line string) string {
+	i := 0
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if i == 0 || i+1 >= len(line) || (line[i] != '.' && line[i] != ')') || line[i+1] != ' ' {
+		return ""
+	}
+	return line[:i+1]
+}
+
+var inlineMarks = strings.NewReplacer("**", "", "__", "", "`", "")
+
+func stripInline(s string) string {
+	return inlineMarks.Replace(s)
+}
+
+// wrap breaks the text into lines of at most max, latin words are kept
+// together when possible
+func wrap(c faceChain, text string, max fixed.Int26_6) []string {
+	if text == "" {
+		return []string{""}
+	}
+	var lines []string
+	var line []rune
+	var width fixed.Int26_6
+	lastSpace := -1
+	for _, r := range text {
+		_, adv := c.pick(r)
+		if width+adv > max && len(line) > 0 {
+			if lastSpace > 0 && !unicode.Is(unicode.Han, r) && r != ' ' {
+				lines = append(lines, string(line[:lastSpace]))
+				line = append([]rune{}, line[lastSpace+1:]...)
+			} else {
+				lines = append(lines, string(line))
+				line = line[:0]
+			}
+			width = c.width(string(line))
+			lastSpace = -1
+			if r == ' ' && len(line) == 0 {
+				continue
+			}
+		}
+		if r == ' ' {
+			lastSpace = len(line)
+		}
+		line = append(line, r)
+		width += adv
+	}
+	return append(lines, string(line))
+}
+
+type textLine struct {
+	block  *textBlock
+	text   string
+	first  bool // first line of its block, draws the bullet
+	chain  faceChain
+	height int
+}
+
+// headingScale is the font size of heading levels 1 to 6 relative to the text
+var headingScale = [6]float64{1.8, 1.5, 1.3, 1.15, 1.05, 1}
+
+// maxTextImageHeight keeps huge outputs from producing images QQ rejects
+const maxTextImageHeight = 16000
+
+var (
+	colorText  = color.RGBA{R: 0x24, G: 0x29, B: 0x2f, A: 0xff}
+	colorMuted = color.RGBA{R: 0x65, G: 0x6d, B: 0x76, A: 0xff}
+	colorCode  = color.RGBA{R: 0xf6, G: 0xf8, B: 0xfa, A: 0xff}
+	colorRule  = color.RGBA{R: 0xd0, G: 0xd7, B: 0xde, A: 0xff}
+)
+
+// RenderTextImage 将文字 (支持标题, 列表, 引用, 分割线与代码块的 markdown) 绘制为 png
+func RenderTextImage(text string, opt TextImageOptions) ([]byte, error) {
+	if opt.Width <= 0 {
+		opt.Width = 800
+	}
+	if opt.FontSize <= 0 {
+		opt.FontSize = 24
+	}
+	if opt.Padding <= 0 {
+		opt.Padding = int(opt.FontSize)
+	}
+	textSet, monoSet := fonts()
+	if textSet[0] == nil {
+		return nil, errors.New("no font to render text")
+	}
+
+	body := newFaceChain(textSet, opt.FontSize)
+	defer body.close()
+	mono := newFaceChain(monoSet, opt.FontSize*0.9)
+	defer mono.close()
+	headings := map[int]faceChain{}
+	defer func() {
+		for _, c := range headings {
+			c.close()
+		}
+	}()
+	heading := func(level int) faceChain {
+		if c, ok := headings[level]; ok {
+			return c
+		}
+		c := newFaceChain(textSet, opt.FontSize*headingScale[level-1])
+		headings[level] = c
+		return c
+	}
+
+	indent := int(opt.FontSize * 1.5)
+	content := fixed.I(opt.Width - 2*opt.Padding)
+	blocks := parseMarkdown(text)
+	var lines []textLine
+	height := 2 * opt.Padding
+	for i := range blocks {
+		b := &blocks[i]
+		chain, max, size := body, content, opt.FontSize
+		switch b.kind {
+		case blockHeading:
+			chain = heading(b.level)
+			size = opt.FontSize * headingScale[b.level-1]
+		case blockList, blockQuote:
+			max -= fixed.I(indent)
+		case blockCode:
+			chain, size = mono, opt.FontSize*0.9
+			max -= fixed.I(indent / 2)
+		case blockRule:
+			lines = append(lines, textLine{block: b, height: int(opt.FontSize)})
+			height += int(opt.FontSize)
+			continue
+		}
+		for j, s := range wrap(chain, b.text, max) {
+			h := int(size * 1.5)
+			lines = append(lines, textLine{block: b, text: s, first: j == 0, chain: chain, height: h})
+			height += h
+		}
+	}
+	if height > maxTextImageHeight {
+		height = maxTextImageHeight
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opt.Width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	y := opt.Padding
+	for _, l := range lines {
+		if y+l.height > height-opt.Padding {
+			break // truncated at maxTextImageHeight
+		}
+		x := opt.Padding
+		switch l.block.kind {
+		case blockRule:
+			draw.Draw(img, image.Rect(x, y+l.height/2, opt.Width-opt.Padding, y+l.height/2+2), image.NewUniform(colorRule), image.Point{}, draw.Src)
+			y += l.height
+			continue
+		case blockCode:
+			draw.Draw(img, image.Rect(x, y, opt.Width-opt.Padding, y+l.height), image.NewUniform(colorCode), image.Point{}, draw.Src)
+			x += indent / 4
+		case blockQuote:
+			draw.Draw(img, image.Rect(x, y, x+4, y+l.height), image.NewUniform(colorRule), image.Point{}, draw.Src)
+			x += indent
+		case blockList:
+			if l.first {
+				drawText(img, body, colorText, x+indent/4, y, l.height, l.block.bullet, false)
+			}
+			x += indent
+		}
+		col := color.Color(colorText)
+		if l.block.kind == blockQuote {
+			col = colorMuted
+		}
+		drawText(img, l.chain, col, x, y, l.height, l.text, l.block.kind == blockHeading)
+		y += l.height
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawText draws a line vertically centered in its height, bold draws it
+// twice since no bold font is loaded
+func drawText(img draw.Image, chain faceChain, col color.Color, x, y, height int, text string, bold bool) {
+	metrics := chain[0].Metrics()
+	baseline := y + (height+metrics.Ascent.Ceil()-metrics.Descent.Ceil())/2
+	d := font.Drawer{Dst: img, Src: image.NewUniform(col)}
+	passes := 1
+	if bold {
+		passes = 2
+	}
+	for p := 0; p < passes; p++ {
+		d.Dot = fixed.P(x+p, baseline)
+		for _, r := range text {
+			d.Face, _ = chain.pick(r)
+			d.DrawString(string(r))
+		}
+	}
+}
+
+// TextImage 将文字绘制为图片消息段
+func TextImage(text string, opt TextImageOptions) (Segment, error) {
+	data, err := RenderTextImage(text, opt)
+	if err != nil {
+		return Segment{}, err
+	}
+	return ImageBytes(data), nil
+}
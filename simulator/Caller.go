@@ -0,0 +1,164 @@
+package simulator
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	zero "marmot/onebot"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Call is an api request made by a module together with the answer it got
+type Call struct {
+	Time     time.Time
+	Request  zero.APIRequest
+	Response zero.APIResponse
+}
+
+// Param returns a parameter of the request, nil if it is missing
+func (c Call) Param(name string) any {
+	return c.Request.Params[name]
+}
+
+// Responder scripts the answer of an action, the returned data is encoded
+// as the "data" field, an error becomes a failed response with retcode 100
+type Responder func(req zero.APIRequest) (any, error)
+
+// Caller is an APICaller recording every request instead of talking to an adapter
+type Caller struct {
+	SelfID int64
+	OnCall func(call Call) // optional, called after each request is recorded
+
+	mu         sync.Mutex
+	calls      []Call
+	responders map[string]Responder
+	seq        atomic.Int64
+}
+
+func NewCaller(selfID int64) *Caller {
+	return &Caller{
+		SelfID:     selfID,
+		responders: make(map[string]Responder),
+	}
+}
+
+// Reply scripts the response of action, replacing the default one
+func (c *Caller) Reply(action string, fn Responder) {
+	c.mu.Lock()
+	c.responders[action] = fn
+	c.mu.Unlock()
+}
+
+// swapResponder replaces the responder of action and returns the previous
+// one, a nil fn restores the default response
+func (c *Caller) swapResponder(action string, fn Responder) (Responder, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.responders[action]
+	if fn == nil {
+		delete(c.responders, action)
+	} else {
+		c.responders[action] = fn
+	}
+	return old, ok
+}
+
+// ReplyData makes action always answer with data
+func (c *Caller) ReplyData(action string, data any) {
+	c.Reply(action, func(_ zero.APIRequest) (any, error) {
+		return data, nil
+	})
+}
+
+// ReplyError makes action always fail with err
+func (c *Caller) ReplyError(action string, err error) {
+	c.Reply(action, func(_ zero.APIRequest) (any, error) {
+		return nil, err
+	})
+}
+
+func (c *Caller) CallAPI(req zero.APIRequest) (zero.APIResponse, error) {
+	c.mu.Lock()
+	fn, ok := c.responders[req.Action]
+	c.mu.Unlock()
+	if !ok {
+		fn = c.defaultResponse
+	}
+
+	rsp := zero.APIResponse{Status: "ok", Echo: req.Echo}
+	data, err := fn(req)
+	if err != nil {
+		rsp.Status = "failed"
+		rsp.RetCode = 100
+		rsp.Message = err.Error()
+	} else {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return rsp, fmt.Errorf("failed to encode response of %s: %w", req.Action, err)
+		}
+		rsp.Data = gjson.ParseBytes(raw)
+	}
+
+	call := Call{Time: time.Now(), Request: req, Response: rsp}
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	c.mu.Unlock()
+	if c.OnCall != nil {
+		c.OnCall(call)
+	}
+	return rsp, nil
+}
+
+func (c *Caller) defaultResponse(req zero.APIRequest) (any, error) {
+	switch req.Action {
+	case "send_msg", "send_group_msg", "send_private_msg", "send_group_forward_msg", "send_private_forward_msg":
+		return map[string]int64{"message_id": c.nextID()}, nil
+	case "get_login_info":
+		return map[string]any{"user_id": c.SelfID, "nickname": "simulator"}, nil
+	case "get_group_list", "get_group_member_list", "get_friend_list":
+		return []any{}, nil
+	}
+	return map[string]any{}, nil
+}
+
+func (c *Caller) nextID() int64 {
+	return c.seq.Add(1)
+}
+
+// Calls returns every request recorded so far
+func (c *Caller) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// Find returns the recorded requests of action
+func (c *Caller) Find(action string) []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result []Call
+	for _, call := range c.calls {
+		if call.Request.Action == action {
+			result = append(result, call)
+		}
+	}
+	return result
+}
+
+// Last returns the latest request of action
+func (c *Caller) Last(action string) (Call, bool) {
+	calls := c.Find(action)
+	if len(calls) == 0 {
+		return Call{}, false
+	}
+	return calls[len(calls)-1], true
+}
+
+// Reset forgets the recorded requests, scripted responses are kept
+func (c *Caller) Reset() {
+	c.mu.Lock()
+	c.calls = nil
+	c.mu.Unlock()
+}
@@ -0,0 +1,138 @@
+package simulator
+
+import (
+	"errors"
+	"github.com/goccy/go-json"
+	"marmot/core"
+	zero "marmot/onebot"
+	"sync"
+	"time"
+)
+
+// ReplayResult counts the api calls per action of the recording and of the
+// replay, a difference usually points at the changed behavior
+type ReplayResult struct {
+	Events   int
+	Failed   int // events whose handlers did not finish in time
+	Recorded map[string]int
+	Replayed map[string]int
+}
+
+// FirstSelfID returns the bot account of the first recorded event, 0 if
+// there is none
+func FirstSelfID(records []core.Record) int64 {
+	for _, record := range records {
+		if record.Kind != core.RecordEvent {
+			continue
+		}
+		var head struct {
+			SelfID int64 `json:"self_id"`
+		}
+		if err := json.Unmarshal(record.Payload, &head); err == nil && head.SelfID != 0 {
+			return head.SelfID
+		}
+	}
+	return 0
+}
+
+// replyRecorded answers every recorded action with its recorded responses
+// in order, calls beyond the recording get the default response. The
+// returned func puts the previous responders back.
+func (s *Simulator) replyRecorded(records []core.Record) func() {
+	responses := make(map[string][]core.Record)
+	for _, record := range records {
+		if record.Kind == core.RecordCall && record.Action != "" {
+			responses[record.Action] = append(responses[record.Action], record)
+		}
+	}
+
+	var mu sync.Mutex
+	restore := make([]func(), 0, len(responses))
+	for action := range responses {
+		old, ok := s.Caller.swapResponder(action, func(req zero.APIRequest) (any, error) {
+			mu.Lock()
+			queue := responses[req.Action]
+			if len(queue) == 0 {
+				mu.Unlock()
+				return s.Caller.defaultResponse(req)
+			}
+			record := queue[0]
+			responses[req.Action] = queue[1:]
+			mu.Unlock()
+			return recordedResponse(record)
+		})
+		restore = append(restore, func() {
+			if ok {
+				s.Caller.swapResponder(action, old)
+			} else {
+				s.Caller.swapResponder(action, nil)
+			}
+		})
+	}
+	return func() {
+		for _, fn := range restore {
+			fn()
+		}
+	}
+}
+
+// recordedResponse turns a recorded call back into the answer of a Responder
+func recordedResponse(record core.Record) (any, error) {
+	if record.Error != "" {
+		return nil, errors.New(record.Error)
+	}
+	rsp := record.Response
+	if rsp == nil {
+		return map[string]any{}, nil
+	}
+	if rsp.Status == "failed" {
+		return nil, errors.New(rsp.Message)
+	}
+	if len(rsp.Data) == 0 {
+		return nil, nil
+	}
+	return rsp.Data, nil
+}
+
+// Replay feeds the recorded events through ModuleMgr.HandleEvent, speed 1
+// keeps the original pace, 10 is ten times faster and 0 sends them back to
+// back. Each event waits for its handlers before the next one is sent, the
+// api calls they make get the recorded responses of their action in order.
+func (s *Simulator) Replay(records []core.Record, speed float64) ReplayResult {
+	result := ReplayResult{
+		Recorded: make(map[string]int),
+		Replayed: make(map[string]int),
+	}
+	before := len(s.Caller.Calls())
+	defer s.replyRecorded(records)()
+
+	var last time.Time
+	for _, record := range records {
+		switch record.Kind {
+		case core.RecordCall:
+			result.Recorded[record.Action]++
+			continue
+		case core.RecordEvent:
+		default:
+			continue
+		}
+
+		if speed > 0 && !last.IsZero() {
+			if gap := record.Time.Sub(last); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / speed))
+			}
+		}
+		last = record.Time
+
+		result.Events++
+		if err := s.EmitRaw(record.Payload); err != nil {
+			result.Failed++
+			core.LogWarn("[Replay] event recorded at %s: %v", record.Time.Format(time.RFC3339Nano), err)
+		}
+	}
+
+	for _, call := range s.Caller.Calls()[before:] {
+		result.Replayed[call.Request.Action]++
+	}
+	return result
+}
@@ -0,0 +1,307 @@
+// Package simulator runs the bot in-process against a fake OneBot adapter,
+// so module behavior can be asserted in go test:
+//
+//	sim, err := simulator.New(simulator.Options{
+//		Modules: []string{"filter"},
+//		Files: map[string]string{
+//			"filter.yaml":    "group_ids: [20000]\nban_user: true\n...",
+//			"rules/test.txt": "badword",
+//		},
+//	})
+//	defer sim.Close()
+//	sim.GroupMessage(20000, simulator.Member(10001), "badword")
+//	if _, ok := sim.Caller.Last("set_group_ban"); !ok { ... }
+package simulator
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"io/fs"
+	"marmot/core"
+	_ "marmot/modules"
+	zero "marmot/onebot"
+	"marmot/onebot/message"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Sender is the user a fabricated message comes from
+type Sender struct {
+	UserID   int64
+	Nickname string
+	Role     string // member, admin or owner
+}
+
+func Member(id int64) Sender {
+	return Sender{UserID: id, Nickname: fmt.Sprintf("user%d", id), Role: "member"}
+}
+
+func Admin(id int64) Sender {
+	return Sender{UserID: id, Nickname: fmt.Sprintf("admin%d", id), Role: "admin"}
+}
+
+func Owner(id int64) Sender {
+	return Sender{UserID: id, Nickname: fmt.Sprintf("owner%d", id), Role: "owner"}
+}
+
+type Options struct {
+	Modules []string          // modules to load in order, defaults to the ones of config.yml
+	Admins  []int64           // bot admins, see core.CheckIsAdmin
+	Seed    string            // directory whose config files (not databases) are copied into the data dir
+	SelfID  int64             // QQ account of the bot, defaults to 10000
+	Files   map[string]string // written into the data dir before booting, e.g. "filter.yaml"
+	Timeout time.Duration     // how long injected events may run, defaults to 5s
+}
+
+// Simulator owns a booted core with its own temp data dir and in-memory
+// database. core keeps global state, so only one may be alive at a time.
+type Simulator struct {
+	Caller  *Caller
+	Mgr     *core.ModuleMgr
+	Dir     string
+	SelfID  int64
+	Timeout time.Duration
+}
+
+var alive atomic.Bool
+
+// New boots core and loads opt.Modules
+func New(opt Options) (*Simulator, error) {
+	if !alive.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("another simulator is still running")
+	}
+	sim, err := boot(opt)
+	if err != nil {
+		alive.Store(false)
+		return nil, err
+	}
+	return sim, nil
+}
+
+func boot(opt Options) (*Simulator, error) {
+	dir, err := os.MkdirTemp("", "marmot-sim-*")
+	if err != nil {
+		return nil, err
+	}
+	if opt.Seed != "" {
+		if err := copySeed(opt.Seed, dir); err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	for name, content := range opt.Files {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0777); err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+		if err := os.WriteFile(pth, []byte(content), 0644); err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	if opt.SelfID == 0 {
+		opt.SelfID = 10000
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Second
+	}
+
+	core.InitCommonWith(core.CommonOptions{DataDir: dir, InMemoryDb: true})
+	if opt.Modules != nil {
+		core.AppConfig.Modules = opt.Modules
+	}
+	if opt.Admins != nil {
+		core.AppConfig.AdminQQ = opt.Admins
+	}
+	core.AppConfig.CmdCoolDown = "0s"
+	core.Common.BotQQ = opt.SelfID
+
+	sim := &Simulator{
+		Caller:  NewCaller(opt.SelfID),
+		Dir:     dir,
+		SelfID:  opt.SelfID,
+		Timeout: opt.Timeout,
+	}
+	zero.APICallers.Store(opt.SelfID, sim.Caller)
+
+	sim.Mgr = core.NewModuleMgr()
+	if sim.Mgr == nil {
+		sim.Close()
+		return nil, fmt.Errorf("failed to create module manager")
+	}
+	sim.Mgr.LoadAll()
+	return sim, nil
+}
+
+// copySeed copies the yaml configs and rules of a data dir, skipping
+// databases, logs, backups and recordings
+func copySeed(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			switch rel {
+			case "logs", "backups", "records":
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		switch filepath.Ext(path) {
+		case ".yml", ".yaml", ".txt", ".json":
+		default:
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+}
+
+// Close unloads the modules and removes the data dir
+func (s *Simulator) Close() {
+	if s.Mgr != nil {
+		s.Mgr.UnloadAll()
+	}
+	zero.APICallers.Delete(s.SelfID)
+	if core.Common != nil && core.Common.Database != nil {
+		core.Common.Database.Close()
+	}
+	_ = os.RemoveAll(s.Dir)
+	alive.Store(false)
+}
+
+// Wait blocks until every handler and command started by injected events
+// returned, false is returned after Timeout
+func (s *Simulator) Wait() bool {
+	return core.WaitIdle(s.Timeout)
+}
+
+// Emit injects a raw OneBot v11 event, time and self_id are filled when
+// missing. It returns once the handlers finished.
+func (s *Simulator) Emit(event map[string]any) error {
+	if _, ok := event["time"]; !ok {
+		event["time"] = time.Now().Unix()
+	}
+	if _, ok := event["self_id"]; !ok {
+		event["self_id"] = s.SelfID
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.EmitRaw(payload)
+}
+
+// EmitRaw injects an event payload exactly as an adapter would send it
+func (s *Simulator) EmitRaw(payload []byte) error {
+	s.Mgr.HandleEvent(zero.ParseEvent(payload, s.Caller))
+	if !s.Wait() {
+		return fmt.Errorf("handlers are still running after %s", s.Timeout)
+	}
+	return nil
+}
+
+func (s *Simulator) messageEvent(sender Sender, msg any) (map[string]any, int64) {
+	raw, ok := msg.(string)
+	if !ok {
+		if m, isMsg := msg.(message.Message); isMsg {
+			raw = m.String()
+		}
+	}
+	id := s.Caller.nextID()
+	return map[string]any{
+		"post_type":   "message",
+		"sub_type":    "normal",
+		"message_id":  id,
+		"user_id":     sender.UserID,
+		"raw_message": raw,
+		"message":     msg,
+		"sender": map[string]any{
+			"user_id":  sender.UserID,
+			"nickname": sender.Nickname,
+			"role":     sender.Role,
+		},
+	}, id
+}
+
+// GroupMessage sends msg (a CQ string or message.Message) to group as
+// sender and returns its message id
+func (s *Simulator) GroupMessage(groupID int64, sender Sender, msg any) (int64, error) {
+	event, id := s.messageEvent(sender, msg)
+	event["message_type"] = "group"
+	event["group_id"] = groupID
+	return id, s.Emit(event)
+}
+
+// PrivateMessage sends msg to the bot as sender and returns its message id
+func (s *Simulator) PrivateMessage(sender Sender, msg any) (int64, error) {
+	event, id := s.messageEvent(sender, msg)
+	event["message_type"] = "private"
+	event["sub_type"] = "friend"
+	return id, s.Emit(event)
+}
+
+// GroupJoin reports userID joined the group, approved by operatorID
+func (s *Simulator) GroupJoin(groupID, userID, operatorID int64) error {
+	return s.Emit(map[string]any{
+		"post_type":   "notice",
+		"notice_type": "group_increase",
+		"sub_type":    "approve",
+		"group_id":    groupID,
+		"user_id":     userID,
+		"operator_id": operatorID,
+	})
+}
+
+// GroupLeave reports userID left the group, or was kicked when operatorID
+// is someone else
+func (s *Simulator) GroupLeave(groupID, userID, operatorID int64) error {
+	subType := "leave"
+	if operatorID != userID {
+		subType = "kick"
+	}
+	return s.Emit(map[string]any{
+		"post_type":   "notice",
+		"notice_type": "group_decrease",
+		"sub_type":    subType,
+		"group_id":    groupID,
+		"user_id":     userID,
+		"operator_id": operatorID,
+	})
+}
+
+// GroupRecall reports operatorID recalled a message of userID
+func (s *Simulator) GroupRecall(groupID, userID, operatorID, messageID int64) error {
+	return s.Emit(map[string]any{
+		"post_type":   "notice",
+		"notice_type": "group_recall",
+		"group_id":    groupID,
+		"user_id":     userID,
+		"operator_id": operatorID,
+		"message_id":  messageID,
+	})
+}
+
+// GroupRequest reports userID asks to join the group
+func (s *Simulator) GroupRequest(groupID, userID int64, comment string) error {
+	return s.Emit(map[string]any{
+		"post_type":    "request",
+		"request_type": "group",
+		"sub_type":     "add",
+		"group_id":     groupID,
+		"user_id":      userID,
+		"comment":      comment,
+		"flag":         fmt.Sprintf("sim-%d", s.Caller.nextID()),
+	})
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -22,6 +23,7 @@ type RingQueue[T any] struct {
 	notEmpty *sync.Cond
 	notFull  *sync.Cond
 	closed   bool
+	dropped  atomic.Uint64
 }
 
 func NewRingQueue[T any](cap int) *RingQueue[T] {
@@ -47,6 +49,7 @@ func (q *RingQueue[T]) Enqueue(v T) error {
 		return ErrClosed
 	}
 	if q.size == q.capacity {
+		q.dropped.Add(1)
 		return ErrFull
 	}
 
@@ -145,3 +148,8 @@ func (q *RingQueue[T]) Len() int {
 func (q *RingQueue[T]) Cap() int {
 	return q.capacity
 }
+
+// Dropped 因队列已满被拒绝的元素数量
+func (q *RingQueue[T]) Dropped() uint64 {
+	return q.dropped.Load()
+}